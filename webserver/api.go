@@ -0,0 +1,262 @@
+/*
+ * api.go contains the helpers shared by the /api/v1 handlers.
+ *
+ * Every /api/v1 response is JSON. Errors use a single schema:
+ *     {"error": {"code": "not_found", "message": "...", "details": [{"field": "...", "message": "..."}]}}
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/logging"
+	"webserver/openapi"
+)
+
+// maxJSONBodySize limits JSON request bodies read for validation
+const maxJSONBodySize = 1 << 20
+
+// Error codes used in the error schema
+const (
+	errCodeBadRequest          = "bad_request"
+	errCodeValidation          = "validation_failed"
+	errCodeTooLarge            = "request_too_large"
+	errCodeNotFound            = "not_found"
+	errCodeUnauthorized        = "unauthorized"
+	errCodeForbidden           = "forbidden"
+	errCodeQuotaExceeded       = "quota_exceeded"
+	errCodeConflict            = "conflict"
+	errCodeIdempotencyMismatch = "idempotency_key_mismatch"
+	errCodeMethodNotAllowed    = "method_not_allowed"
+	errCodeInternal            = "internal_error"
+	errCodeStorage             = "storage_unavailable"
+	errCodeDocker              = "docker_error"
+	errCodeTimeout             = "timeout"
+)
+
+//fieldError describes a problem with a single field of a request
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+//apiError is the error body returned by every /api/v1 endpoint
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []fieldError `json:"details,omitempty"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+//containerResult is the outcome of an operation on a single container
+type containerResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// writeJSON writes v as the JSON response body with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Error.Println(err)
+	}
+}
+
+// writeError writes an error response following the error schema
+func writeError(w http.ResponseWriter, status int, code, message string, details ...fieldError) {
+	writeJSON(w, status, errorResponse{Error: apiError{Code: code, Message: message, Details: details}})
+}
+
+// notFoundHandler returns the JSON 404 for unknown routes
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, errCodeNotFound, "No route for "+r.URL.Path)
+}
+
+// methodNotAllowedHandler returns the JSON 405 for known routes called with an unsupported method
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, r.Method+" is not supported on "+r.URL.Path)
+}
+
+// openapihandler serves the OpenAPI specification of the server
+func openapihandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	w.Write(openapi.Default.JSON())
+}
+
+// uploadRoutes are the routes taking large request bodies, by method and path template
+var uploadRoutes = map[string]bool{
+	"PUT /api/v1/testbeds/{id}/containers/{name}/files": true,
+	"POST /api/v1/artifacts":                            true,
+}
+
+// uploadTimeout is the time to read the request of an upload route, set from the config (see config.go)
+var uploadTimeout = 30 * time.Minute
+
+// extendUploadDeadline is a middleware giving upload routes uploadTimeout to read their request instead of
+// server.read_timeout. It comes before authenticate, which reads signed bodies.
+func extendUploadDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if pathTemplate, err := route.GetPathTemplate(); err == nil && uploadRoutes[r.Method+" "+pathTemplate] {
+				err := http.NewResponseController(w).SetReadDeadline(time.Now().Add(uploadTimeout))
+				if err != nil && !errors.Is(err, http.ErrNotSupported) {
+					logging.Warning.Println("Could not extend the read deadline of ", r.Method, " ", r.URL.Path, ": ", err)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateRequestBody is a middleware rejecting JSON request bodies which do not match the OpenAPI specification
+func validateRequestBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil || r.Body == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pathTemplate, err := route.GetPathTemplate()
+		if err != nil || !openapi.Default.HasJSONBody(r.Method, pathTemplate) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxJSONBodySize+1))
+		r.Body.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeBadRequest, "Could not read request body: "+err.Error())
+			return
+		}
+		if len(body) > maxJSONBodySize {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Request body exceeds 1MB")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if errs := openapi.Default.ValidateRequest(r.Method, pathTemplate, body); len(errs) > 0 {
+			details := make([]fieldError, 0, len(errs))
+			for _, e := range errs {
+				details = append(details, fieldError{Field: e.Field, Message: e.Message})
+			}
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Request body does not match the API specification", details...)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecated marks a legacy route as a deprecated alias of its /api/v1 successor.
+// Route variables in the successor path are filled in from the request, legacy {tag} standing in for {id}.
+func deprecated(successor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		if tag, ok := vars["tag"]; ok {
+			vars["id"] = tag
+		}
+		link := successor
+		for k, v := range vars {
+			link = strings.Replace(link, "{"+k+"}", v, -1)
+		}
+
+		logging.Warning.Println("Deprecated route called: ", r.Method, " ", r.URL.Path, ", use ", link)
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+link+">; rel=\"successor-version\"")
+		h(w, r)
+	}
+}
+
+// containerName returns the docker container name of a testbed container
+func containerName(testbedID, image string) string {
+	return testbedID + "-" + image
+}
+
+// Store lookups of single resources by the loaders, tests replace them with fixtures
+var (
+	getTestBed  = db.GetTestBedFromID
+	getTemplate = db.GetTestBedTemplate
+	getArtifact = db.GetArtifactFromID
+	getSnapshot = db.GetSnapshotFromID
+	getWebhook  = db.GetWebhookFromID
+)
+
+// loadTestBed fetches the testbed named by the {id} route variable if the request may access it at level
+// (see authz.go), writing the error response if it can't
+func loadTestBed(w http.ResponseWriter, r *http.Request, level accessLevel) (db.TestBed, bool) {
+	testbedID := mux.Vars(r)["id"]
+
+	tb, err := getTestBed(ctx, testbedID)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No testbed found with id "+testbedID)
+		return tb, false
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching testbed "+testbedID)
+		return tb, false
+	}
+	if !authorize(w, r, tb.Owner, tb.Team, level, "testbed with id "+testbedID) {
+		return tb, false
+	}
+	return tb, true
+}
+
+// loadContainer returns the container named by the {name} route variable within a testbed
+func loadContainer(w http.ResponseWriter, r *http.Request, tb db.TestBed) (db.ContainerProp, bool) {
+	name := mux.Vars(r)["name"]
+
+	for _, cnt := range tb.Container {
+		if cnt.Image == name {
+			return cnt, true
+		}
+	}
+	writeError(w, http.StatusNotFound, errCodeNotFound, "No container "+name+" in testbed "+tb.ID)
+	return db.ContainerProp{}, false
+}
+
+// loadInstance returns the docker container name of the instance selected by ?instance (see scale.go) of the
+// container named by the {name} route variable within a testbed, the first instance by default
+func loadInstance(w http.ResponseWriter, r *http.Request, tb db.TestBed) (string, bool) {
+	cnt, ok := loadContainer(w, r, tb)
+	if !ok {
+		return "", false
+	}
+	instance := 1
+	if v := r.URL.Query().Get("instance"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid instance",
+				fieldError{Field: "instance", Message: "must be a positive integer"})
+			return "", false
+		}
+		instance = n
+	}
+	if instance == 1 {
+		return containerName(tb.ID, cnt.Image), true
+	}
+	for _, replica := range cnt.Replicas {
+		if replica.Index == instance {
+			return containerName(tb.ID, cnt.Image) + replicaSuffix(instance), true
+		}
+	}
+	writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Service %v of testbed %v has no instance %v", cnt.Image, tb.ID, instance))
+	return "", false
+}
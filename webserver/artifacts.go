@@ -0,0 +1,228 @@
+/*
+ * artifacts.go contains the handlers for uploaded artifacts, e.g. database dumps which are
+ * referenced by the seed steps of a testbed (see seed.go).
+ * Supports
+ *     Upload an artifact (raw request body, ?name=dump.tar.gz)
+ *     List artifacts
+ *     Get an artifact
+ *     Delete an artifact
+ *
+ * Artifact content is kept on disk in artifactDir, named by the artifact id. Artifacts belong to the
+ * principal who uploaded them and its team (see authz.go).
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/logging"
+)
+
+var (
+	// Directory holding the content of uploaded artifacts, set from the config (see config.go)
+	artifactDir string
+
+	artifactNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$`)
+)
+
+// maxArtifactSize limits the size of an uploaded artifact
+const maxArtifactSize = 512 << 20
+
+// Handler for POST /api/v1/artifacts?name=<file name> call, the request body is the artifact content
+func createartifacthandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if !artifactNameRegexp.MatchString(name) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid artifact name",
+			fieldError{Field: "name", Message: "must match " + artifactNameRegexp.String()})
+		return
+	}
+
+	var owner, team string
+	if p := requestPrincipal(r); p != nil {
+		owner, team = p.Name, p.Team
+	}
+	artifact, err := storeArtifact(name, owner, team, http.MaxBytesReader(w, r.Body, maxArtifactSize))
+	if readErr, ok := err.(errArtifactRead); ok {
+		if strings.Contains(readErr.Error(), "request body too large") {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Artifact exceeds 512MB")
+			return
+		}
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Could not read artifact: "+readErr.Error())
+		return
+	} else if err == errArtifactRecord {
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record artifact")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Could not store artifact")
+		return
+	}
+
+	logging.Info.Println("Stored artifact ", artifact.ID, " ", artifact.Name, " of ", artifact.Size, " bytes")
+	w.Header().Set("location", "/api/v1/artifacts/"+artifact.ID)
+	writeJSON(w, http.StatusCreated, artifact)
+}
+
+// Handler for GET /api/v1/artifacts call
+func listartifactshandler(w http.ResponseWriter, r *http.Request) {
+	artifacts, err := db.ListArtifacts(ctx, visibleTo(r))
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing artifacts")
+		return
+	}
+	writeJSON(w, http.StatusOK, artifacts)
+}
+
+// Handler for GET /api/v1/artifacts/{id} call
+func getartifacthandler(w http.ResponseWriter, r *http.Request) {
+	artifact, ok := loadArtifact(w, r, accessRead)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, artifact)
+}
+
+// Handler for DELETE /api/v1/artifacts/{id} call, artifacts holding the volume content of a snapshot
+// are deleted with the snapshot
+func deleteartifacthandler(w http.ResponseWriter, r *http.Request) {
+	artifact, ok := loadArtifact(w, r, accessDelete)
+	if !ok {
+		return
+	}
+	id := artifact.ID
+
+	snapshot, err := db.GetSnapshotReferencingArtifact(ctx, id)
+	if err == nil {
+		writeError(w, http.StatusConflict, errCodeConflict, "Artifact "+id+" holds volume content of snapshot "+snapshot.ID+", delete the snapshot instead")
+		return
+	} else if err != db.ErrNoMatchDocument {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while looking up the snapshots of artifact "+id)
+		return
+	}
+
+	found, err := removeArtifact(id)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while deleting artifact")
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No artifact found with id "+id)
+		return
+	}
+
+	logging.Info.Println("Deleted artifact ", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadArtifact returns the artifact named by the {id} route variable if the request may access it at level,
+// writing the error response if it cannot
+func loadArtifact(w http.ResponseWriter, r *http.Request, level accessLevel) (db.Artifact, bool) {
+	id := mux.Vars(r)["id"]
+
+	artifact, err := getArtifact(ctx, id)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No artifact found with id "+id)
+		return artifact, false
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching artifact "+id)
+		return artifact, false
+	}
+	if !authorize(w, r, artifact.Owner, artifact.Team, level, "artifact with id "+id) {
+		return artifact, false
+	}
+	return artifact, true
+}
+
+// errArtifactRead is returned by storeArtifact when the content could not be read
+type errArtifactRead struct{ error }
+
+// errArtifactRecord is returned by storeArtifact when the content was stored but could not be recorded
+var errArtifactRecord = errors.New("artifact could not be recorded")
+
+// storeArtifact copies content to artifactDir and records it as a new artifact called name, belonging to owner and team
+func storeArtifact(name, owner, team string, content io.Reader) (*db.Artifact, error) {
+	if err := os.MkdirAll(artifactDir, 0755); err != nil {
+		logging.Error.Println(err)
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(artifactDir, ".upload-")
+	if err != nil {
+		logging.Error.Println(err)
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	artifact := db.NewArtifact(name)
+	artifact.Owner = owner
+	artifact.Team = team
+	hash := sha256.New()
+	artifact.Size, err = io.Copy(io.MultiWriter(tmp, hash), content)
+	if err != nil {
+		return nil, errArtifactRead{err}
+	}
+	artifact.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	if err := tmp.Close(); err != nil {
+		logging.Error.Println(err)
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), artifactPath(artifact.ID)); err != nil {
+		logging.Error.Println(err)
+		return nil, err
+	}
+	if _, err := db.InsertArtifact(ctx, artifact); err != nil {
+		logging.Error.Println(err)
+		os.Remove(artifactPath(artifact.ID))
+		return nil, errArtifactRecord
+	}
+	return artifact, nil
+}
+
+// removeArtifact deletes the record and the content of an artifact, it reports whether the artifact existed
+func removeArtifact(id string) (bool, error) {
+	deleteResult, err := db.DeleteArtifact(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if deleteResult.DeletedCount == 0 {
+		return false, nil
+	}
+	if err := os.Remove(artifactPath(id)); err != nil {
+		logging.Warning.Println(err)
+	}
+	return true, nil
+}
+
+// artifactPath returns the file holding the content of an artifact
+func artifactPath(id string) string {
+	return filepath.Join(artifactDir, filepath.Base(id))
+}
+
+// isArchiveName reports whether a file name denotes a tar archive, compressed or not
+func isArchiveName(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tar.xz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
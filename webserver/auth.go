@@ -0,0 +1,404 @@
+/*
+ * auth.go authenticates the requests of the provisioning API.
+ *
+ * Authenticators are read from the JSON file named by the auth.config setting (see config.go):
+ *     {"tokens":    [{"token": "<random string>", "principal": "ci"}],
+ *      "hmac_keys": [{"key_id": "jenkins", "secret": "<random string>", "principal": "ci"}],
+ *      "client_certs": [{"subject": "CN=ci-runner,O=Payments", "principal": "ci"}],
+ *      "principals": [{"name": "ci", "team": "payments"}, {"name": "alice", "admin": true}]}
+ *
+ * A request is authenticated by the first authenticator its credentials are meant for:
+ *     a verified TLS client certificate (see tls.go)
+ * or
+ *     Authorization:         Bearer <token>
+ * or a signed request:
+ *     X-Auth-Key:            key id
+ *     X-Auth-Timestamp:      unix seconds, at most maxSignatureAge away from the server clock
+ *     X-Auth-Nonce:          random string unique per request of the key, see authNonceRegexp
+ *     X-Auth-Content-SHA256: hex SHA-256 of the body, of the empty string without a body
+ *     X-Auth-Signature:      sha256=<hex HMAC-SHA256 of "<timestamp>.<nonce>.<method>.<request uri>.<content sha256>">
+ * The body of a signed request is checked against its digest before the request is served, bodies over
+ * 1MB or without a length are spooled to a temporary file for it. The nonces of accepted requests are
+ * recorded in the authnonce collection until their timestamp is out of maxSignatureAge, a nonce is
+ * accepted once per key, also across restarts and instances of the server.
+ *
+ * The principal is recorded as the owner of the testbeds created by the request, principals declare
+ * their team and admin role (see authz.go). Without the config file requests are not authenticated
+ * and the server only listens on localhost (see main.go).
+ * The OpenAPI specification is served without authentication.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"webserver/db"
+	"webserver/logging"
+)
+
+// maxSignatureAge is the largest difference between the timestamp of a signed request and the server clock
+const maxSignatureAge = 5 * time.Minute
+
+// maxSignedBodySize is the largest body of a signed request, the largest upload accepted by the API
+const maxSignedBodySize = maxFileUploadSize
+
+// minAuthSecretLength is the shortest token or HMAC secret accepted in the auth config
+const minAuthSecretLength = 16
+
+var (
+	// Authenticators tried in order, requests are not authenticated when there are none
+	authenticators []authenticator
+
+	// Declared principals by name, undeclared ones have no team and are not admins
+	principals = map[string]principal{}
+
+	// Routes served without authentication
+	publicPaths = map[string]bool{"/openapi.json": true, "/api/v1/openapi.json": true}
+
+	// errNoCredentials is returned by an authenticator when a request carries no credentials meant for it
+	errNoCredentials = errors.New("no credentials")
+
+	// errSignedBodyTooLarge is returned when the body of a signed request exceeds maxSignedBodySize
+	errSignedBodyTooLarge = fmt.Errorf("Signed bodies are limited to %d bytes", maxSignedBodySize)
+
+	// errNonceUnavailable is returned when the nonce of a signed request cannot be recorded
+	errNonceUnavailable = errors.New("Could not record X-Auth-Nonce")
+
+	authNonceRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]{16,128}$`)
+
+	// recordNonce records the nonce of a signed request of a key until it expires, it returns
+	// db.ErrDocumentExists when the key used the nonce already
+	recordNonce = func(keyID, nonce string, expires time.Time) error {
+		return db.InsertAuthNonce(ctx, keyID, nonce, expires)
+	}
+)
+
+//authenticator resolves the principal of a request. It returns errNoCredentials when the request does
+//not carry its kind of credentials, and another error when they are invalid.
+type authenticator interface {
+	authenticate(r *http.Request) (string, error)
+}
+
+//authConfig is the content of the auth config file
+type authConfig struct {
+	Tokens      []authToken      `json:"tokens"`
+	HMACKeys    []authHMACKey    `json:"hmac_keys"`
+	ClientCerts []authClientCert `json:"client_certs"`
+	Principals  []principal      `json:"principals"`
+}
+
+//principal is an authenticated caller
+type principal struct {
+	Name  string `json:"name"`
+	Team  string `json:"team"`
+	Admin bool   `json:"admin"`
+}
+
+//authToken is a static API token
+type authToken struct {
+	Token     string `json:"token"`
+	Principal string `json:"principal"`
+}
+
+//authHMACKey is a shared secret signing requests
+type authHMACKey struct {
+	KeyID     string `json:"key_id"`
+	Secret    string `json:"secret"`
+	Principal string `json:"principal"`
+}
+
+// principalKey is the request context key of the authenticated principal
+type principalKey struct{}
+
+// loadAuthenticators reads the authenticators and principals from an auth config file
+func loadAuthenticators(path string) ([]authenticator, map[string]principal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := authConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, nil, fmt.Errorf("invalid auth config %v: %v", path, err)
+	}
+
+	declared := make(map[string]principal)
+	for i, p := range config.Principals {
+		if p.Name == "" {
+			return nil, nil, fmt.Errorf("invalid auth config %v: principals[%d] needs a name", path, i)
+		}
+		declared[p.Name] = p
+	}
+
+	tokens := tokenAuthenticator{tokens: make(map[string]string)}
+	for i, t := range config.Tokens {
+		if len(t.Token) < minAuthSecretLength || t.Principal == "" {
+			return nil, nil, fmt.Errorf("invalid auth config %v: tokens[%d] needs a principal and a token of at least %v characters", path, i, minAuthSecretLength)
+		}
+		tokens.tokens[tokenDigest(t.Token)] = t.Principal
+	}
+	keys := hmacAuthenticator{keys: make(map[string]authHMACKey)}
+	for i, k := range config.HMACKeys {
+		if k.KeyID == "" || len(k.Secret) < minAuthSecretLength || k.Principal == "" {
+			return nil, nil, fmt.Errorf("invalid auth config %v: hmac_keys[%d] needs a key_id, a principal and a secret of at least %v characters", path, i, minAuthSecretLength)
+		}
+		keys.keys[k.KeyID] = k
+	}
+
+	certs := clientCertAuthenticator{subjects: make(map[string]string)}
+	for i, c := range config.ClientCerts {
+		if c.Subject == "" || c.Principal == "" {
+			return nil, nil, fmt.Errorf("invalid auth config %v: client_certs[%d] needs a subject and a principal", path, i)
+		}
+		certs.subjects[c.Subject] = c.Principal
+	}
+
+	var auth []authenticator
+	if len(certs.subjects) > 0 {
+		auth = append(auth, certs)
+	}
+	if len(tokens.tokens) > 0 {
+		auth = append(auth, tokens)
+	}
+	if len(keys.keys) > 0 {
+		auth = append(auth, keys)
+	}
+	if len(auth) == 0 {
+		return nil, nil, fmt.Errorf("auth config %v declares no tokens, hmac_keys or client_certs", path)
+	}
+	return auth, declared, nil
+}
+
+// authenticate is a middleware rejecting the requests no authenticator accepts with 401,
+// the principal of accepted requests is stored in their context
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(authenticators) == 0 || publicPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, a := range authenticators {
+			name, err := a.authenticate(r)
+			if err == errNoCredentials {
+				continue
+			}
+			if err == errSignedBodyTooLarge {
+				logging.Warning.Println("Rejected body of ", r.Method, " ", r.URL.Path, ": ", err)
+				writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, err.Error())
+				return
+			}
+			if err == errNonceUnavailable {
+				writeError(w, http.StatusServiceUnavailable, errCodeStorage, err.Error())
+				return
+			}
+			if err != nil {
+				logging.Warning.Println("Rejected credentials for ", r.Method, " ", r.URL.Path, ": ", err)
+				writeUnauthorized(w, err.Error())
+				return
+			}
+			p, ok := principals[name]
+			if !ok {
+				p = principal{Name: name}
+			}
+			if body, ok := r.Body.(*spooledBody); ok {
+				defer body.Close()
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, &p)))
+			return
+		}
+		writeUnauthorized(w, "Authentication required")
+	})
+}
+
+// writeUnauthorized writes a 401 response naming the accepted schemes
+func writeUnauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer, HMAC-SHA256`)
+	writeError(w, http.StatusUnauthorized, errCodeUnauthorized, msg)
+}
+
+// requestPrincipal returns the authenticated principal of a request, nil when requests are not authenticated
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey{}).(*principal)
+	return p
+}
+
+//tokenAuthenticator accepts static bearer tokens, they are kept as SHA-256 digests
+type tokenAuthenticator struct {
+	tokens map[string]string // token digest to principal
+}
+
+func (a tokenAuthenticator) authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", errNoCredentials
+	}
+	// Looking up the digest does not reveal through timing how much of a token matched
+	name, ok := a.tokens[tokenDigest(strings.TrimPrefix(header, "Bearer "))]
+	if !ok {
+		return "", errors.New("Invalid API token")
+	}
+	return name, nil
+}
+
+// tokenDigest returns the hex SHA-256 of a token
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//hmacAuthenticator accepts requests signed with a shared secret
+type hmacAuthenticator struct {
+	keys map[string]authHMACKey
+}
+
+func (a hmacAuthenticator) authenticate(r *http.Request) (string, error) {
+	keyID := r.Header.Get("X-Auth-Key")
+	if keyID == "" {
+		return "", errNoCredentials
+	}
+	key, ok := a.keys[keyID]
+	if !ok {
+		return "", errors.New("Unknown key " + keyID)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get("X-Auth-Timestamp"), 10, 64)
+	if err != nil {
+		return "", errors.New("X-Auth-Timestamp must be unix seconds")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxSignatureAge || age < -maxSignatureAge {
+		return "", errors.New("X-Auth-Timestamp is too far from the server clock")
+	}
+
+	nonce := r.Header.Get("X-Auth-Nonce")
+	if !authNonceRegexp.MatchString(nonce) {
+		return "", errors.New("X-Auth-Nonce must match " + authNonceRegexp.String())
+	}
+
+	contentSHA := strings.ToLower(r.Header.Get("X-Auth-Content-SHA256"))
+	expected := signRequest(key.Secret, timestamp, nonce, r.Method, r.URL.RequestURI(), contentSHA)
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Auth-Signature"))) {
+		return "", errors.New("Invalid X-Auth-Signature")
+	}
+
+	// The signature covers the announced digest, the body is checked against it before the request is served
+	if r.Body == nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(nil))
+	}
+	if r.ContentLength >= 0 && r.ContentLength <= maxJSONBodySize {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return "", errors.New("Could not read request body: " + err.Error())
+		}
+		if sum := sha256.Sum256(body); hex.EncodeToString(sum[:]) != contentSHA {
+			return "", errors.New("Body does not match X-Auth-Content-SHA256")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	} else if err := spoolSignedBody(r, contentSHA); err != nil {
+		return "", err
+	}
+
+	// The nonce is recorded as long as the timestamp is accepted, a replayed request is rejected until then
+	err = recordNonce(keyID, nonce, time.Unix(timestamp, 0).Add(maxSignatureAge))
+	if err == db.ErrDocumentExists {
+		return "", errors.New("X-Auth-Nonce was already used")
+	} else if err != nil {
+		logging.Error.Println(err)
+		return "", errNonceUnavailable
+	}
+	return key.Principal, nil
+}
+
+// spoolSignedBody copies a body over maxJSONBodySize or without a length to a temporary file and checks
+// it against its signed digest, the request reads the file then. Closing the body removes the file.
+func spoolSignedBody(r *http.Request, contentSHA string) error {
+	defer r.Body.Close()
+	if r.ContentLength > maxSignedBodySize {
+		return errSignedBodyTooLarge
+	}
+
+	tmp, err := ioutil.TempFile("", "signed-body-")
+	if err != nil {
+		logging.Error.Println(err)
+		return errors.New("Could not spool request body")
+	}
+	body := &spooledBody{File: tmp}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(r.Body, maxSignedBodySize+1))
+	if err != nil {
+		body.Close()
+		return errors.New("Could not read request body: " + err.Error())
+	}
+	if size > maxSignedBodySize {
+		body.Close()
+		return errSignedBodyTooLarge
+	}
+	if hex.EncodeToString(hash.Sum(nil)) != contentSHA {
+		body.Close()
+		return errors.New("Body does not match X-Auth-Content-SHA256")
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		body.Close()
+		logging.Error.Println(err)
+		return errors.New("Could not spool request body")
+	}
+
+	r.Body = body
+	r.ContentLength = size
+	return nil
+}
+
+//spooledBody is a request body read from a temporary file, which is removed when it is closed
+type spooledBody struct {
+	*os.File
+}
+
+func (b *spooledBody) Close() error {
+	b.File.Close()
+	if err := os.Remove(b.Name()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// signRequest returns the X-Auth-Signature value of a request
+func signRequest(secret string, timestamp int64, nonce, method, requestURI, contentSHA string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s.%s.%s.%s", timestamp, nonce, method, requestURI, contentSHA)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// initAuthenticators loads the authenticators of an auth config file, it reports whether requests
+// are authenticated
+func initAuthenticators(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	auth, declared, err := loadAuthenticators(path)
+	if err != nil {
+		return false, err
+	}
+	authenticators = auth
+	principals = declared
+	return true, nil
+}
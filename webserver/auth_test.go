@@ -0,0 +1,149 @@
+/*
+ * auth_test.go checks that signed requests are verified before they are served and accepted once.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"webserver/db"
+)
+
+const testHMACSecret = "0123456789abcdef"
+
+var testNonces = struct {
+	mu   sync.Mutex
+	next int
+	used map[string]bool
+}{used: make(map[string]bool)}
+
+// testNonce returns a nonce no other test request uses
+func testNonce() string {
+	testNonces.mu.Lock()
+	defer testNonces.mu.Unlock()
+	testNonces.next++
+	return "test-nonce-" + strconv.Itoa(testNonces.next) + "-0000"
+}
+
+// signedRequest returns a request signed with testHMACSecret and a fresh nonce, the digest is the one of signedBody
+func signedRequest(method, uri, body, signedBody string, timestamp int64) *http.Request {
+	return signedRequestWithNonce(method, uri, body, signedBody, timestamp, testNonce())
+}
+
+// signedRequestWithNonce returns a request signed with testHMACSecret and nonce
+func signedRequestWithNonce(method, uri, body, signedBody string, timestamp int64, nonce string) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	sum := sha256.Sum256([]byte(signedBody))
+	contentSHA := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Auth-Key", "ci")
+	req.Header.Set("X-Auth-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Auth-Nonce", nonce)
+	req.Header.Set("X-Auth-Content-SHA256", contentSHA)
+	req.Header.Set("X-Auth-Signature", signRequest(testHMACSecret, timestamp, nonce, method, uri, contentSHA))
+	return req
+}
+
+// serveSigned serves a request through authenticate, it returns the status and whether the handler was called
+func serveSigned(t *testing.T, req *http.Request) (int, bool) {
+	saved, savedRecord := authenticators, recordNonce
+	authenticators = []authenticator{hmacAuthenticator{keys: map[string]authHMACKey{
+		"ci": {KeyID: "ci", Secret: testHMACSecret, Principal: "ci"},
+	}}}
+	// The nonces are recorded in memory instead of the store
+	recordNonce = func(keyID, nonce string, expires time.Time) error {
+		testNonces.mu.Lock()
+		defer testNonces.mu.Unlock()
+		if testNonces.used[keyID+" "+nonce] {
+			return db.ErrDocumentExists
+		}
+		testNonces.used[keyID+" "+nonce] = true
+		return nil
+	}
+	defer func() { authenticators, recordNonce = saved, savedRecord }()
+
+	served := false
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec.Code, served
+}
+
+func TestSignedBodies(t *testing.T) {
+	now := time.Now().Unix()
+	large := strings.Repeat("x", maxJSONBodySize+1)
+
+	chunked := signedRequest("PUT", "/api/v1/artifacts?chunked", large, large, now)
+	chunked.ContentLength = -1
+	tooLarge := signedRequest("PUT", "/api/v1/artifacts?too-large", "", "", now)
+	tooLarge.ContentLength = maxSignedBodySize + 1
+
+	cases := []struct {
+		name       string
+		req        *http.Request
+		wantStatus int
+	}{
+		{"small body", signedRequest("POST", "/api/v1/testbeds?small", "{}", "{}", now), http.StatusNoContent},
+		{"small body diverges", signedRequest("POST", "/api/v1/testbeds?diverges", "{}", "[]", now), http.StatusUnauthorized},
+		{"large body", signedRequest("PUT", "/api/v1/artifacts?large", large, large, now), http.StatusNoContent},
+		{"large body diverges", signedRequest("PUT", "/api/v1/artifacts?large-diverges", large, large+"y", now), http.StatusUnauthorized},
+		{"chunked body", chunked, http.StatusNoContent},
+		{"announced body too large", tooLarge, http.StatusRequestEntityTooLarge},
+		{"stale timestamp", signedRequest("POST", "/api/v1/testbeds?stale", "{}", "{}", now-3600), http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		status, served := serveSigned(t, c.req)
+		if status != c.wantStatus {
+			t.Errorf("%v: status %v, want %v", c.name, status, c.wantStatus)
+		}
+		if served != (c.wantStatus < 400) {
+			t.Errorf("%v: handler called %v", c.name, served)
+		}
+	}
+}
+
+func TestSignedRequestsAreNotReplayed(t *testing.T) {
+	now := time.Now().Unix()
+	nonce := testNonce()
+	if status, _ := serveSigned(t, signedRequestWithNonce("DELETE", "/api/v1/testbeds/replayed", "", "", now, nonce)); status != http.StatusNoContent {
+		t.Fatalf("first request: status %v", status)
+	}
+	if status, served := serveSigned(t, signedRequestWithNonce("DELETE", "/api/v1/testbeds/replayed", "", "", now, nonce)); status != http.StatusUnauthorized || served {
+		t.Errorf("replayed request: status %v, handler called %v", status, served)
+	}
+}
+
+func TestIdenticalSignedRequestsWithOtherNonces(t *testing.T) {
+	now := time.Now().Unix()
+	for i := 0; i < 2; i++ {
+		if status, _ := serveSigned(t, signedRequest("GET", "/api/v1/testbeds/polled", "", "", now)); status != http.StatusNoContent {
+			t.Errorf("request %v: status %v", i+1, status)
+		}
+	}
+}
+
+func TestSignedRequestsNeedANonce(t *testing.T) {
+	req := signedRequestWithNonce("GET", "/api/v1/testbeds/no-nonce", "", "", time.Now().Unix(), "")
+	if status, served := serveSigned(t, req); status != http.StatusUnauthorized || served {
+		t.Errorf("request without nonce: status %v, handler called %v", status, served)
+	}
+}
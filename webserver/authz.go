@@ -0,0 +1,81 @@
+/*
+ * authz.go decides what an authenticated principal may do (see auth.go).
+ *
+ * Testbeds, snapshots and artifacts belong to the principal who created them and to its team:
+ *     owner        read, operate and delete
+ *     team member  read and operate, e.g. stop, exec or inject faults, but not delete
+ *     admin        everything, including the host wide routes (adminOnly)
+ * Others are answered with 404 as if the resource did not exist, team members with 403 on deletes.
+ * Resources created before requests were authenticated have no owner and are left to admins.
+ *
+ * Without authentication every request may do everything.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"webserver/db"
+)
+
+//accessLevel is what a request does to a resource
+type accessLevel int
+
+// Access levels, each includes the ones before it
+const (
+	accessRead accessLevel = iota
+	accessOperate
+	accessDelete
+)
+
+// can reports whether the principal may access a resource of owner and team at level
+func (p *principal) can(owner, team string, level accessLevel) bool {
+	switch {
+	case p == nil || p.Admin:
+		return true
+	case owner != "" && owner == p.Name:
+		return true
+	case team != "" && team == p.Team:
+		return level <= accessOperate
+	}
+	return false
+}
+
+// authorize checks that a request may access a resource of owner and team at level, writing the
+// error response if it may not. what names the resource in the 404 response, e.g. "testbed 42".
+func authorize(w http.ResponseWriter, r *http.Request, owner, team string, level accessLevel, what string) bool {
+	p := requestPrincipal(r)
+	if p.can(owner, team, level) {
+		return true
+	}
+	if !p.can(owner, team, accessRead) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No "+what+" found")
+		return false
+	}
+	writeError(w, http.StatusForbidden, errCodeForbidden, "Only the owner of "+what+" or an admin may do this")
+	return false
+}
+
+// adminOnly restricts a handler to admins, e.g. for routes acting on the whole host
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p := requestPrincipal(r); p != nil && !p.Admin {
+			writeError(w, http.StatusForbidden, errCodeForbidden, "Only admins may do this")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// visibleTo returns the visibility of listings for the principal of a request, nil when it sees everything
+func visibleTo(r *http.Request) *db.Visibility {
+	p := requestPrincipal(r)
+	if p == nil || p.Admin {
+		return nil
+	}
+	return &db.Visibility{Owner: p.Name, Team: p.Team}
+}
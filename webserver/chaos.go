@@ -0,0 +1,472 @@
+/*
+ * chaos.go injects faults into testbed containers for resilience tests.
+ * Supports
+ *     Kill a container with a signal
+ *     Pause a container for a number of seconds
+ *     Disconnect a container from its networks
+ *     Add latency, jitter and packet loss to the traffic of a container (tc netem run in a sidecar)
+ *     List the active faults of a testbed, heal the fault of a container
+ *
+ *     POST /api/v1/testbeds/{id}/containers/{name}/faults    {"type": "netem", "latency_ms": 200, "loss_percent": 5, "duration_seconds": 60}
+ *
+ * Faults only apply to containers carrying the ownership label of the testbed. Except kill, a fault
+ * lasts duration_seconds or, without it, until it is healed with DELETE. A container instance has at
+ * most one active fault. Injected and healed faults are published as testbed events.
+ *
+ * Active faults are recorded in the fault collection. At startup the faults of the previous run are
+ * listed again, those whose duration is over are healed and the others heal when it ends.
+ *
+ * The tc sidecar runs PROVISIONER_CHAOS_IMAGE (nicolaka/netshoot by default) in the network namespace
+ * of the container, the container image does not need tc.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// Fault types
+const (
+	faultKill       = "kill"
+	faultPause      = "pause"
+	faultDisconnect = "disconnect"
+	faultNetem      = "netem"
+)
+
+// Limits of a fault request
+const (
+	maxFaultDuration = 3600 // seconds
+	maxFaultLatency  = 60000
+)
+
+// netemDevice is the interface of the container traffic is shaped on
+const netemDevice = "eth0"
+
+var (
+	// Image of the sidecar running tc, set from the config (see config.go)
+	chaosImage string
+
+	// Signals a container can be killed with
+	faultSignals = map[string]bool{
+		"SIGKILL": true, "SIGTERM": true, "SIGINT": true, "SIGHUP": true, "SIGQUIT": true,
+		"SIGSTOP": true, "SIGCONT": true, "SIGUSR1": true, "SIGUSR2": true,
+	}
+)
+
+//faultRequestBody is the request struct of a fault
+type faultRequestBody struct {
+	Type            string  `json:"type"`
+	Instance        int     `json:"instance"`
+	Signal          string  `json:"signal"`
+	DurationSeconds int     `json:"duration_seconds"`
+	LatencyMS       int     `json:"latency_ms"`
+	JitterMS        int     `json:"jitter_ms"`
+	LossPercent     float64 `json:"loss_percent"`
+}
+
+// faultTimers heal the active faults with a duration once it is over, by container name
+var faultTimers = struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}{timers: make(map[string]*time.Timer)}
+
+/*
+  Handler for POST /testbeds/{id}/containers/{name}/faults call
+
+  Only Completed testbeds take faults. instance selects a replica of the service (see scale.go), the
+  first instance by default. The active fault is returned, a killed container has none.
+*/
+func injectfaulthandler(w http.ResponseWriter, r *http.Request) {
+	body := faultRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid fault body: "+err.Error())
+		return
+	}
+	if errs := validateFault(&body); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid fault request", errs...)
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	if tb.Status != db.StatusCompleted {
+		writeError(w, http.StatusConflict, errCodeConflict, "Testbed "+tb.ID+" is "+tb.Status+", faults are only injected into Completed testbeds")
+		return
+	}
+	cnt, ok := loadContainer(w, r, tb)
+	if !ok {
+		return
+	}
+	name, ok := faultTarget(w, tb.ID, cnt, body.Instance)
+	if !ok {
+		return
+	}
+
+	f := &db.Fault{
+		TestBedID: tb.ID,
+		Service:   cnt.Image,
+		Container: name,
+		Type:      body.Type,
+		Signal:    body.Signal,
+		LatencyMS: body.LatencyMS,
+		JitterMS:  body.JitterMS,
+		Loss:      body.LossPercent,
+		Injected:  time.Now().UTC(),
+	}
+
+	// The record takes the slot of the container while the fault is injected, a second request is rejected meanwhile
+	if err := db.InsertFault(ctx, f); err == db.ErrDocumentExists {
+		writeError(w, http.StatusConflict, errCodeConflict, "Container "+name+" already has an active fault")
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record the fault, nothing was injected")
+		return
+	}
+
+	if err := injectFault(f); err != nil {
+		if err := db.DeleteFault(ctx, name); err != nil {
+			logging.Error.Println(err)
+		}
+		logging.Error.Println("Could not inject ", f.Type, " into ", name, ": ", err)
+		publishEvent(tb.ID, events.FaultFailed, cnt.Image, f.Type+" of "+name+" failed: "+err.Error())
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not inject "+f.Type+" into "+name+": "+err.Error())
+		return
+	}
+	publishEvent(tb.ID, events.FaultInjected, cnt.Image, "Injected "+describeFault(f)+" into "+name)
+
+	if f.Type == faultKill {
+		if err := db.DeleteFault(ctx, name); err != nil {
+			logging.Error.Println(err)
+		}
+	} else {
+		if body.DurationSeconds > 0 {
+			expires := f.Injected.Add(time.Duration(body.DurationSeconds) * time.Second)
+			f.Expires = &expires
+		}
+		// The record gets the expiry and the networks of a disconnect, which are needed to heal it
+		if err := db.UpdateFault(ctx, f); err != nil {
+			logging.Error.Println("Could not record fault of ", name, ": ", err)
+		}
+		armFault(f)
+	}
+
+	syncTestBedStatus(tb)
+	writeJSON(w, http.StatusOK, f)
+}
+
+// Handler for GET /api/v1/testbeds/{id}/faults call, lists the active faults of a testbed
+func listfaultshandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+
+	active, err := db.ListFaults(ctx, tb.ID)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing the faults of testbed "+tb.ID)
+		return
+	}
+	writeJSON(w, http.StatusOK, active)
+}
+
+// Handler for DELETE /api/v1/testbeds/{id}/containers/{name}/faults?instance=<n> call, heals the active fault
+func healfaulthandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+
+	f, err := takeFault(name)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching the fault of "+name)
+		return
+	}
+	if f == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" has no active fault")
+		return
+	}
+	if err := healFault(f); err != nil {
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not heal "+f.Type+" of "+name+": "+err.Error())
+		return
+	}
+	syncTestBedStatus(tb)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateFault returns the field level errors of a fault request and fills in its defaults
+func validateFault(body *faultRequestBody) []fieldError {
+	var errs []fieldError
+
+	if body.Instance == 0 {
+		body.Instance = 1
+	}
+	if body.Instance < 1 {
+		errs = append(errs, fieldError{Field: "instance", Message: "must be a positive integer"})
+	}
+	if body.DurationSeconds < 0 || body.DurationSeconds > maxFaultDuration {
+		errs = append(errs, fieldError{Field: "duration_seconds", Message: fmt.Sprintf("must be between 0 and %v", maxFaultDuration)})
+	}
+
+	switch body.Type {
+	case faultKill:
+		if body.Signal == "" {
+			body.Signal = "SIGKILL"
+		}
+		if !faultSignals[body.Signal] {
+			errs = append(errs, fieldError{Field: "signal", Message: "is not a supported signal"})
+		}
+		if body.DurationSeconds != 0 {
+			errs = append(errs, fieldError{Field: "duration_seconds", Message: "does not apply to kill"})
+		}
+	case faultPause:
+		if body.DurationSeconds == 0 {
+			errs = append(errs, fieldError{Field: "duration_seconds", Message: "is required for pause"})
+		}
+	case faultDisconnect:
+	case faultNetem:
+		if body.LatencyMS < 0 || body.LatencyMS > maxFaultLatency {
+			errs = append(errs, fieldError{Field: "latency_ms", Message: fmt.Sprintf("must be between 0 and %v", maxFaultLatency)})
+		}
+		if body.JitterMS < 0 || body.JitterMS > body.LatencyMS {
+			errs = append(errs, fieldError{Field: "jitter_ms", Message: "must be between 0 and latency_ms"})
+		}
+		if body.LossPercent < 0 || body.LossPercent > 100 {
+			errs = append(errs, fieldError{Field: "loss_percent", Message: "must be between 0 and 100"})
+		}
+		if body.LatencyMS == 0 && body.LossPercent == 0 {
+			errs = append(errs, fieldError{Field: "latency_ms", Message: "latency_ms or loss_percent is required for netem"})
+		}
+	default:
+		errs = append(errs, fieldError{Field: "type", Message: "must be one of kill, pause, disconnect or netem"})
+	}
+	return errs
+}
+
+// faultTarget returns the container name of an instance of a testbed service, writing the error response
+// if it does not exist or is not owned by the testbed
+func faultTarget(w http.ResponseWriter, testbedID string, cnt db.ContainerProp, instance int) (string, bool) {
+	names := instanceNames(testbedID, cnt)
+	if instance > len(names) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Service %v has %v instances", cnt.Image, len(names)))
+		return "", false
+	}
+	name := containerName(testbedID, cnt.Image) + replicaSuffix(instance)
+
+	inspectData := dockercontainer.InspectContainer(ctx, name)
+	if inspectData.ContainerJSONBase == nil || inspectData.State == nil {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" does not exist on the host")
+		return "", false
+	}
+	if inspectData.Config == nil || inspectData.Config.Labels[labelTestBed] != testbedID {
+		writeError(w, http.StatusForbidden, errCodeForbidden, "Container "+name+" is not owned by testbed "+testbedID)
+		return "", false
+	}
+	if !inspectData.State.Running || inspectData.State.Paused {
+		writeError(w, http.StatusConflict, errCodeConflict, "Container "+name+" is "+inspectData.State.Status)
+		return "", false
+	}
+	return name, true
+}
+
+// injectFault applies a fault to its container
+func injectFault(f *db.Fault) error {
+	switch f.Type {
+	case faultKill:
+		return dockercontainer.KillContainer(ctx, f.Container, f.Signal)
+	case faultPause:
+		return dockercontainer.PauseContainer(ctx, f.Container)
+	case faultDisconnect:
+		inspectData := dockercontainer.InspectContainer(ctx, f.Container)
+		if inspectData.NetworkSettings == nil || len(inspectData.NetworkSettings.Networks) == 0 {
+			return fmt.Errorf("container %v is not connected to a network", f.Container)
+		}
+		for network := range inspectData.NetworkSettings.Networks {
+			f.Networks = append(f.Networks, network)
+		}
+		sort.Strings(f.Networks)
+		for i, network := range f.Networks {
+			if err := dockercontainer.DisconnectNetwork(ctx, network, f.Container); err != nil {
+				// Networks left so far are joined again, the container is not left half partitioned
+				for _, joined := range f.Networks[:i] {
+					dockercontainer.ConnectNetwork(ctx, joined, f.Container)
+				}
+				return err
+			}
+		}
+		return nil
+	case faultNetem:
+		cmd := []string{"tc", "qdisc", "replace", "dev", netemDevice, "root", "netem"}
+		if f.LatencyMS > 0 {
+			cmd = append(cmd, "delay", strconv.Itoa(f.LatencyMS)+"ms")
+			if f.JitterMS > 0 {
+				cmd = append(cmd, strconv.Itoa(f.JitterMS)+"ms")
+			}
+		}
+		if f.Loss > 0 {
+			cmd = append(cmd, "loss", strconv.FormatFloat(f.Loss, 'f', -1, 64)+"%")
+		}
+		_, err := dockercontainer.RunSidecar(ctx, f.Container, chaosImage, cmd)
+		return err
+	}
+	return fmt.Errorf("unknown fault type %v", f.Type)
+}
+
+// healFault reverts a fault and publishes it as a testbed event
+func healFault(f *db.Fault) error {
+	var err error
+	switch f.Type {
+	case faultPause:
+		err = dockercontainer.UnpauseContainer(ctx, f.Container)
+	case faultDisconnect:
+		for _, network := range f.Networks {
+			if e := dockercontainer.ConnectNetwork(ctx, network, f.Container); e != nil {
+				err = e
+			}
+		}
+	case faultNetem:
+		_, err = dockercontainer.RunSidecar(ctx, f.Container, chaosImage, []string{"tc", "qdisc", "del", "dev", netemDevice, "root"})
+	}
+	if err != nil {
+		logging.Error.Println("Could not heal ", f.Type, " of ", f.Container, ": ", err)
+		publishEvent(f.TestBedID, events.FaultFailed, f.Service, "Healing "+f.Type+" of "+f.Container+" failed: "+err.Error())
+		return err
+	}
+	publishEvent(f.TestBedID, events.FaultHealed, f.Service, "Healed "+describeFault(f)+" of "+f.Container)
+	return nil
+}
+
+// armFault starts the timer healing a fault once its duration is over, right away when it is over already
+func armFault(f *db.Fault) {
+	if f.Expires == nil {
+		return
+	}
+	name := f.Container
+	faultTimers.mu.Lock()
+	defer faultTimers.mu.Unlock()
+	if timer := faultTimers.timers[name]; timer != nil {
+		timer.Stop()
+	}
+	faultTimers.timers[name] = time.AfterFunc(time.Until(*f.Expires), func() { expireFault(name) })
+}
+
+// stopFaultTimer stops the timer of the fault of a container, if it has one
+func stopFaultTimer(name string) {
+	faultTimers.mu.Lock()
+	defer faultTimers.mu.Unlock()
+	if timer := faultTimers.timers[name]; timer != nil {
+		timer.Stop()
+		delete(faultTimers.timers, name)
+	}
+}
+
+// takeFault removes the active fault of a container from the fault records and returns it, nil if there is none
+func takeFault(name string) (*db.Fault, error) {
+	f, err := db.TakeFault(ctx, name)
+	if err == db.ErrNoMatchDocument {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	stopFaultTimer(name)
+	return &f, nil
+}
+
+// clearFault forgets the fault of a container which is removed, without healing it
+func clearFault(name string) {
+	stopFaultTimer(name)
+	if err := db.DeleteFault(ctx, name); err != nil {
+		logging.Error.Println("Could not delete the fault record of ", name, ": ", err)
+	}
+}
+
+// expireFault heals a fault once its duration is over, containers removed meanwhile are left alone
+func expireFault(name string) {
+	f, err := takeFault(name)
+	if err != nil {
+		logging.Error.Println("Could not fetch the fault of ", name, ", it is not healed: ", err)
+		return
+	}
+	if f == nil {
+		return
+	}
+	if containerState(name) == "unknown" {
+		return
+	}
+	if err := healFault(f); err == nil {
+		if tb, err := db.GetTestBedFromID(ctx, f.TestBedID); err == nil {
+			syncTestBedStatus(tb)
+		}
+	}
+}
+
+// resumeFaults takes over the faults recorded by the previous run of the server. Faults whose duration
+// is over are healed, the others heal when it ends. Interrupted kills and faults of containers which
+// are gone are dropped.
+func resumeFaults() {
+	active, err := db.ListFaults(ctx, "")
+	if err != nil {
+		logging.Error.Println("Could not list the active faults: ", err)
+		return
+	}
+	_, err = dockercontainer.HostInfo(ctx)
+	dockerUp := err == nil
+
+	for i := range active {
+		f := &active[i]
+		if f.Type == faultKill || (dockerUp && containerState(f.Container) == "unknown") {
+			logging.Info.Println("Dropping ", f.Type, " of ", f.Container)
+			clearFault(f.Container)
+			continue
+		}
+		if f.Expires != nil {
+			logging.Info.Println("Resuming ", f.Type, " of ", f.Container, " until ", *f.Expires)
+			armFault(f)
+		}
+	}
+}
+
+// describeFault returns a short description of a fault for events, e.g. netem delay 200ms loss 5%
+func describeFault(f *db.Fault) string {
+	switch f.Type {
+	case faultKill:
+		return "kill " + f.Signal
+	case faultNetem:
+		s := "netem"
+		if f.LatencyMS > 0 {
+			s += fmt.Sprintf(" delay %vms", f.LatencyMS)
+			if f.JitterMS > 0 {
+				s += fmt.Sprintf(" ±%vms", f.JitterMS)
+			}
+		}
+		if f.Loss > 0 {
+			s += fmt.Sprintf(" loss %v%%", f.Loss)
+		}
+		return s
+	}
+	return f.Type
+}
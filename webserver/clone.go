@@ -0,0 +1,201 @@
+/*
+ * clone.go creates a testbed like an existing one, e.g. so that a second investigator gets the
+ * same flaky environment without rebuilding it by hand.
+ *
+ *     POST /api/v1/testbeds/{id}/clone    {"name": "flaky-run-2", "data": true}
+ *
+ * The clone gets the services, replicas, volumes, seed steps, owner and labels of the source from the store
+ * and the image digests, environment and resource limits of its containers from docker. With
+ * "data" the source is captured as a snapshot first (see snapshots.go) and the clone starts from it.
+ * When requests are authenticated the clone is owned by the caller (see auth.go), it counts towards
+ * the quotas of its owner and lives as long as they allow (see quota.go). A clone the host has no capacity
+ * for is Queued like a created testbed, its data is copied once it is admitted (see queue.go).
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/logging"
+)
+
+//cloneRequestBody is the optional request struct of a clone
+type cloneRequestBody struct {
+	Name string `json:"name"`
+	Data bool   `json:"data"`
+}
+
+/*
+  Handler for POST /testbeds/{id}/clone call
+
+  The clone is recorded and answered with 202 like a created testbed, it is named <source name>-clone
+  unless a name is given. A data copy is taken before provisioning starts, while it is captured the
+  clone stays initiated.
+*/
+func clonetestbedhandler(w http.ResponseWriter, r *http.Request) {
+	body := cloneRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid clone body: "+err.Error())
+		return
+	}
+
+	// A data copy pauses the containers of the source while it is captured
+	level := accessRead
+	if body.Data {
+		level = accessOperate
+	}
+	src, ok := loadTestBed(w, r, level)
+	if !ok {
+		return
+	}
+	if body.Name == "" {
+		body.Name = src.Name + "-clone"
+	}
+	if !testbedNameRegexp.MatchString(body.Name) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid clone request",
+			fieldError{Field: "name", Message: "must match " + testbedNameRegexp.String()})
+		return
+	}
+
+	clone := db.NewTestBed()
+	clone.Name = body.Name
+	clone.Owner = src.Owner
+	clone.Team = src.Team
+	if p := requestPrincipal(r); p != nil {
+		clone.Owner = p.Name
+		clone.Team = p.Team
+	}
+	clone.Labels = src.Labels
+	clone.Template = src.Template
+	clone.ClonedFrom = src.ID
+	clone.CloneData = body.Data
+	for _, cnt := range src.Container {
+		clone.Container = append(clone.Container, cloneContainer(src.ID, cnt, body.Data))
+	}
+
+	ttl, ok := quotaTTL(w, clone.Owner, clone.Team, 0)
+	if !ok {
+		return
+	}
+	clone.ExpiresAt = expiresAt(ttl)
+	release, ok := reserveQuota(w, clone.Owner, clone.Team, testbedUsage(clone.Container))
+	if !ok {
+		return
+	}
+	admitted, ok := admitOrQueue(w, clone, "")
+	if !ok {
+		release()
+		return
+	}
+	_, err := db.InsertTestBed(ctx, clone)
+	admitted()
+	release()
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record testbed, nothing was provisioned")
+		return
+	}
+	logging.Info.Println("Cloning testbed ", src.ID, " as ", clone.ID)
+
+	w.Header().Set("location", "/api/v1/testbeds/"+clone.ID)
+	if clone.Status == db.StatusQueued {
+		setQueuePosition(clone)
+		writeJSON(w, http.StatusAccepted, initResp{Status: "queued", RequestID: clone.ID, QueuePosition: clone.QueuePosition, ETASeconds: clone.ETASeconds})
+		return
+	}
+
+	go provisionClone(src, clone, body.Data)
+
+	writeJSON(w, http.StatusAccepted, initResp{Status: "pending", RequestID: clone.ID})
+}
+
+// cloneContainer returns the properties of the clone of a testbed container. The stored properties are
+// completed from the container on the host when it still exists, its image is pinned by digest.
+func cloneContainer(testbedID string, cnt db.ContainerProp, withData bool) db.ContainerProp {
+	clone := db.ContainerProp{
+		Image:     cnt.Image,
+		CID:       "0",
+		IP:        "0.0.0.0",
+		Volumes:   cnt.Volumes,
+		Env:       cnt.Env,
+		Resources: cnt.Resources,
+		ImageRef:  cnt.ImageRef,
+	}
+	// Copied data replaces the initial data
+	if !withData {
+		clone.Seed = cnt.Seed
+		clone.Restore = cnt.Restore
+	}
+	// The replicas are planned, they are created like the first instance once it is ready (see scale.go)
+	for _, replica := range cnt.Replicas {
+		clone.Replicas = append(clone.Replicas, db.Replica{Index: replica.Index})
+	}
+
+	inspectData := dockercontainer.InspectContainer(ctx, containerName(testbedID, cnt.Image))
+	if inspectData.ContainerJSONBase == nil {
+		logging.Warning.Println("Could not inspect container, cloning stored properties of ", cnt.Image)
+		return clone
+	}
+
+	if inspectData.Config != nil {
+		clone.Env = inspectData.Config.Env
+	}
+	if limits := inspectData.HostConfig; limits != nil && (limits.Memory > 0 || limits.NanoCPUs > 0) {
+		clone.Resources = &db.Resources{MemoryMB: limits.Memory >> 20, CPUs: float64(limits.NanoCPUs) / 1e9}
+	}
+
+	// Images without a registry digest, e.g. snapshots, only exist on this host and are pinned by id
+	clone.ImageRef = inspectData.Image
+	if image, err := dockercontainer.InspectImage(ctx, inspectData.Image); err == nil && len(image.RepoDigests) > 0 {
+		clone.ImageRef = image.RepoDigests[0]
+	}
+	return clone
+}
+
+// provisionClone copies the data of the source testbed if asked to and provisions the clone
+func provisionClone(src db.TestBed, clone *db.TestBed, withData bool) {
+	if withData {
+		snapshot := db.NewSnapshot(src)
+		snapshot.Name = "clone " + clone.ID
+		if _, err := db.InsertSnapshot(ctx, snapshot); err != nil {
+			logging.Error.Println(err)
+			setTestBedStatus(clone.ID, db.StatusFailed, "Could not record the data copy: "+err.Error())
+			return
+		}
+		captureSnapshot(src, snapshot)
+		if snapshot.Status != db.StatusCompleted {
+			setTestBedStatus(clone.ID, db.StatusFailed, "Data copy failed: "+snapshot.Error)
+			return
+		}
+
+		applySnapshot(clone, *snapshot)
+		if _, err := db.SetTestBedSnapshot(ctx, clone.ID, snapshot.ID, clone.Container); err != nil {
+			logging.Error.Println(err)
+			setTestBedStatus(clone.ID, db.StatusFailed, "Could not record the data copy: "+err.Error())
+			return
+		}
+	}
+
+	pullDockerImageAndCreateContainer(clone.ID, clone.Container)
+}
+
+// provisionAdmittedClone provisions a clone admitted from the queue, copying the data of its source as it
+// is by now
+func provisionAdmittedClone(clone db.TestBed) {
+	src, err := db.GetTestBedFromID(ctx, clone.ClonedFrom)
+	if err != nil {
+		logging.Error.Println(err)
+		setTestBedStatus(clone.ID, db.StatusFailed, "Could not read source testbed "+clone.ClonedFrom+" to copy its data: "+err.Error())
+		return
+	}
+	provisionClone(src, &clone, true)
+}
@@ -0,0 +1,194 @@
+/*
+ * compose.go renders a provisioned testbed as a docker-compose file so that the
+ * exact environment can be reproduced outside of the provisioner host.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package compose
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"gopkg.in/yaml.v2"
+	"webserver/db"
+	"webserver/dockercontainer"
+)
+
+// Version of the compose file format that is generated
+const Version = "3.7"
+
+//File is the top level docker-compose document
+type File struct {
+	Version  string             `yaml:"version"`
+	Services map[string]Service `yaml:"services"`
+	Volumes  map[string]Volume  `yaml:"volumes,omitempty"`
+}
+
+//Volume is a named volume of a docker-compose document, created with the name and labels the provisioner gives it
+type Volume struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+//Service is a single service entry of a docker-compose document
+type Service struct {
+	Image       string            `yaml:"image"`
+	Hostname    string            `yaml:"hostname,omitempty"`
+	Entrypoint  []string          `yaml:"entrypoint,omitempty"`
+	Command     []string          `yaml:"command,omitempty"`
+	Environment []string          `yaml:"environment,omitempty"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	WorkingDir  string            `yaml:"working_dir,omitempty"`
+	User        string            `yaml:"user,omitempty"`
+	Tty         bool              `yaml:"tty,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Volumes     []ServiceVolume   `yaml:"volumes,omitempty"`
+}
+
+//ServiceVolume is a mount of a service in the compose long syntax
+type ServiceVolume struct {
+	Type     string        `yaml:"type"`
+	Source   string        `yaml:"source,omitempty"`
+	Target   string        `yaml:"target"`
+	ReadOnly bool          `yaml:"read_only,omitempty"`
+	Tmpfs    *TmpfsOptions `yaml:"tmpfs,omitempty"`
+}
+
+//TmpfsOptions limits the size of a tmpfs mount, in bytes
+type TmpfsOptions struct {
+	Size int64 `yaml:"size"`
+}
+
+//Naming gives the labels and volume names the provisioner uses for the docker objects of a testbed
+type Naming struct {
+	Labels func(image string) map[string]string         // labels of the containers and volumes of a service
+	Volume func(image, name string, replica int) string // named volume of an instance, replica is 1 for the first one
+}
+
+//instance is a container of a testbed service as stored in ContainerProp or its replicas
+type instance struct {
+	key      string // compose service name
+	replica  int
+	hostname string
+	svcPort  int
+}
+
+//Build creates a compose File from the stored testbed record and the inspected
+//docker configuration of its containers, keyed by ServiceKey. Every instance of a scaled
+//service becomes a service of its own, as each one publishes its own host port and mounts its own
+//named volumes. Containers which could not be inspected fall back to the data stored in Mongo.
+func Build(tb db.TestBed, inspected map[string]types.ContainerJSON, digests map[string]string, naming Naming) *File {
+	f := &File{Version: Version, Services: map[string]Service{}}
+
+	for _, cnt := range tb.Container {
+		instances := []instance{{key: ServiceKey(cnt.Image, 1), replica: 1, hostname: cnt.HostName, svcPort: cnt.SvcPort}}
+		for _, replica := range cnt.Replicas {
+			instances = append(instances, instance{key: ServiceKey(cnt.Image, replica.Index), replica: replica.Index, hostname: replica.Name, svcPort: replica.SvcPort})
+		}
+
+		for _, inst := range instances {
+			svc := Service{
+				Image:    cnt.Image,
+				Hostname: inst.hostname,
+				Labels:   naming.Labels(cnt.Image),
+			}
+			svc.Volumes = f.volumes(cnt, inst.replica, naming)
+
+			data, ok := inspected[inst.key]
+			if ok && data.Config != nil {
+				svc.Image = data.Config.Image
+				svc.Hostname = data.Config.Hostname
+				svc.Entrypoint = data.Config.Entrypoint
+				svc.Command = data.Config.Cmd
+				svc.Environment = data.Config.Env
+				svc.WorkingDir = data.Config.WorkingDir
+				svc.User = data.Config.User
+				svc.Tty = data.Config.Tty
+			}
+			if digest, ok := digests[cnt.Image]; ok && digest != "" {
+				svc.Image = digest
+			}
+			svc.Ports = ports(cnt.Image, inst.svcPort, data)
+
+			f.Services[inst.key] = svc
+		}
+	}
+	return f
+}
+
+// volumes returns the mounts of an instance of a testbed service, declaring its named volumes in the File
+func (f *File) volumes(cnt db.ContainerProp, replica int, naming Naming) []ServiceVolume {
+	var mounts []ServiceVolume
+	for _, spec := range cnt.Volumes {
+		m := ServiceVolume{Type: spec.Type, Target: spec.Target}
+		switch spec.Type {
+		case db.VolumeNamed:
+			m.Source = naming.Volume(cnt.Image, spec.Name, replica)
+			if f.Volumes == nil {
+				f.Volumes = map[string]Volume{}
+			}
+			f.Volumes[m.Source] = Volume{Name: m.Source, Labels: naming.Labels(cnt.Image)}
+		case db.VolumeTmpfs:
+			if spec.SizeMB > 0 {
+				m.Tmpfs = &TmpfsOptions{Size: spec.SizeMB << 20}
+			}
+		case db.VolumeBind:
+			m.Source = spec.Resolved
+			if m.Source == "" {
+				m.Source = spec.Source
+			}
+			m.ReadOnly = true
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
+
+//ServiceKey returns the compose service name of an instance of a testbed service, replica is 1 for the first one
+func ServiceKey(image string, replica int) string {
+	if replica <= 1 {
+		return image
+	}
+	return image + "-" + strconv.Itoa(replica)
+}
+
+//Marshal renders the compose File as YAML
+func (f *File) Marshal() ([]byte, error) {
+	return yaml.Marshal(f)
+}
+
+// ports returns the published ports of a container in compose short syntax.
+// Port bindings of the host config are preferred, the stored service port is used otherwise,
+// published on the exposed ports of the container or, when it was not inspected, the port of its image.
+func ports(image string, svcPort int, data types.ContainerJSON) []string {
+	var published []string
+
+	if data.ContainerJSONBase != nil && data.HostConfig != nil {
+		for port, bindings := range data.HostConfig.PortBindings {
+			for _, binding := range bindings {
+				if binding.HostPort == "" {
+					published = append(published, string(port))
+				} else {
+					published = append(published, binding.HostPort+":"+string(port))
+				}
+			}
+		}
+	}
+
+	if len(published) == 0 && svcPort != 0 {
+		if data.Config != nil {
+			for port := range data.Config.ExposedPorts {
+				published = append(published, strconv.Itoa(svcPort)+":"+string(port))
+			}
+		} else if port := dockercontainer.ServicePort(image); port != "" {
+			published = append(published, strconv.Itoa(svcPort)+":"+string(port))
+		}
+	}
+
+	sort.Strings(published)
+	return published
+}
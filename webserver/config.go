@@ -0,0 +1,412 @@
+/*
+ * config.go holds the settings of the server, read once at startup.
+ *
+ *     GET /api/v1/config    effective settings and where they come from, secrets redacted (admins only)
+ *
+ * Every setting has a key, which names it in the JSON config file, as a command line flag and in the dump,
+ * and most have an environment variable. Later sources override earlier ones:
+ *     defaults < config file < environment < command line flags
+ * The config file is named by -config or PROVISIONER_CONFIG and nests keys by their dots:
+ *     {"server": {"address": ":8443"}, "mongo": {"uri": "mongodb://mongo-1:27017"}, "volumes": {"bind_allowlist": ["/srv/fixtures"]}}
+ * Durations are written like 90s or 10m, lists as JSON arrays, or separated like PATH in the environment
+ * and in flags. Settings are validated before anything is started, the server does not start with
+ * invalid or unknown ones.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces secrets in the config dump
+const redacted = "REDACTED"
+
+//config holds the settings of the server
+type config struct {
+	Address       string
+	ReadTimeout   time.Duration
+	IdleTimeout   time.Duration
+	UploadTimeout time.Duration
+
+	MongoURI      string
+	MongoDatabase string
+
+	DockerHost       string
+	DockerAPIVersion string
+
+	Registry   string
+	ChaosImage string
+
+	ArtifactDir   string
+	BindAllowlist []string
+
+	AuthConfig  string
+	QuotaConfig string
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+
+	MaxContainers    int
+	ContainersPerCPU int
+	MemoryReserveMB  int64
+	DefaultMemoryMB  int64
+
+	ContainerHealthyTimeout time.Duration
+	SeedReadyTimeout        time.Duration
+	SeedStepTimeout         time.Duration
+}
+
+//configDump is the response of GET /api/v1/config
+type configDump struct {
+	Settings map[string]string `json:"settings"`
+	Sources  map[string]string `json:"sources"` // default, file, env <name> or flag
+}
+
+var (
+	// Settings of the running server, and the source of every setting by key
+	cfg        = defaultConfig()
+	cfgSources = map[string]string{}
+
+	// settingEnv names the environment variable of the settings which have one
+	settingEnv = map[string]string{
+		"server.address":              "PROVISIONER_ADDRESS",
+		"server.read_timeout":         "PROVISIONER_READ_TIMEOUT",
+		"server.idle_timeout":         "PROVISIONER_IDLE_TIMEOUT",
+		"server.upload_timeout":       "PROVISIONER_UPLOAD_TIMEOUT",
+		"mongo.uri":                   "PROVISIONER_MONGO_URI",
+		"mongo.database":              "PROVISIONER_MONGO_DATABASE",
+		"docker.host":                 "DOCKER_HOST",
+		"docker.api_version":          "DOCKER_API_VERSION",
+		"images.registry":             "PROVISIONER_REGISTRY",
+		"images.chaos":                "PROVISIONER_CHAOS_IMAGE",
+		"artifacts.dir":               "PROVISIONER_ARTIFACT_DIR",
+		"volumes.bind_allowlist":      "PROVISIONER_BIND_ALLOWLIST",
+		"auth.config":                 "PROVISIONER_AUTH_CONFIG",
+		"quota.config":                "PROVISIONER_QUOTA_CONFIG",
+		"tls.cert":                    "PROVISIONER_TLS_CERT",
+		"tls.key":                     "PROVISIONER_TLS_KEY",
+		"tls.client_ca":               "PROVISIONER_TLS_CLIENT_CA",
+		"capacity.max_containers":     "PROVISIONER_MAX_CONTAINERS",
+		"capacity.containers_per_cpu": "PROVISIONER_CONTAINERS_PER_CPU",
+		"capacity.memory_reserve_mb":  "PROVISIONER_MEMORY_RESERVE_MB",
+		"capacity.default_memory_mb":  "PROVISIONER_DEFAULT_MEMORY_MB",
+		"timeouts.container_healthy":  "PROVISIONER_CONTAINER_HEALTHY_TIMEOUT",
+		"timeouts.seed_ready":         "PROVISIONER_SEED_READY_TIMEOUT",
+		"timeouts.seed_step":          "PROVISIONER_SEED_STEP_TIMEOUT",
+	}
+
+	// secretSettings redact the secrets of a setting in the config dump
+	secretSettings = map[string]func(string) string{
+		"mongo.uri": redactURI,
+	}
+)
+
+// defaultConfig returns the settings used when no source sets them
+func defaultConfig() *config {
+	return &config{
+		ReadTimeout:             10 * time.Second,
+		IdleTimeout:             60 * time.Second,
+		UploadTimeout:           30 * time.Minute,
+		MongoURI:                "mongodb://localhost:27017",
+		MongoDatabase:           "infrabuilder",
+		Registry:                "docker.io/library/",
+		ChaosImage:              "nicolaka/netshoot",
+		ArtifactDir:             filepath.Join(os.TempDir(), "infra-provisioner", "artifacts"),
+		ContainersPerCPU:        16,
+		MemoryReserveMB:         1024,
+		DefaultMemoryMB:         512,
+		ContainerHealthyTimeout: 60 * time.Second,
+		SeedReadyTimeout:        60 * time.Second,
+		SeedStepTimeout:         10 * time.Minute,
+	}
+}
+
+// values returns the settings of c by key, setting a value parses it into c
+func (c *config) values() *flag.FlagSet {
+	fs := flag.NewFlagSet("settings", flag.ContinueOnError)
+	fs.StringVar(&c.Address, "server.address", c.Address, "Listen address, 127.0.0.1:8080 without authentication and :8080 with it by default")
+	fs.DurationVar(&c.ReadTimeout, "server.read_timeout", c.ReadTimeout, "Time to read a request")
+	fs.DurationVar(&c.IdleTimeout, "server.idle_timeout", c.IdleTimeout, "Time an idle keep-alive connection is kept open")
+	fs.DurationVar(&c.UploadTimeout, "server.upload_timeout", c.UploadTimeout, "Time to read a file or artifact upload, instead of server.read_timeout")
+	fs.StringVar(&c.MongoURI, "mongo.uri", c.MongoURI, "MongoDB connection string")
+	fs.StringVar(&c.MongoDatabase, "mongo.database", c.MongoDatabase, "MongoDB database of the provisioner")
+	fs.StringVar(&c.DockerHost, "docker.host", c.DockerHost, "Docker daemon socket, the local one by default")
+	fs.StringVar(&c.DockerAPIVersion, "docker.api_version", c.DockerAPIVersion, "Docker API version the client is pinned to, e.g. 1.39")
+	fs.StringVar(&c.Registry, "images.registry", c.Registry, "Registry and namespace the service images are pulled from, ending with /")
+	fs.StringVar(&c.ChaosImage, "images.chaos", c.ChaosImage, "Image of the sidecar shaping container traffic")
+	fs.StringVar(&c.ArtifactDir, "artifacts.dir", c.ArtifactDir, "Directory holding the content of uploaded artifacts")
+	fs.Var((*pathList)(&c.BindAllowlist), "volumes.bind_allowlist", "Host directories below which binds are allowed")
+	fs.StringVar(&c.AuthConfig, "auth.config", c.AuthConfig, "JSON file of tokens, HMAC keys, client certificates and principals")
+	fs.StringVar(&c.QuotaConfig, "quota.config", c.QuotaConfig, "JSON file of owner, team and host quotas")
+	fs.StringVar(&c.TLSCert, "tls.cert", c.TLSCert, "PEM certificate chain of the server")
+	fs.StringVar(&c.TLSKey, "tls.key", c.TLSKey, "PEM private key of the server")
+	fs.StringVar(&c.TLSClientCA, "tls.client_ca", c.TLSClientCA, "PEM bundle of the CAs issuing client certificates")
+	fs.IntVar(&c.MaxContainers, "capacity.max_containers", c.MaxContainers, "Containers on the host, 0 to derive it from the host CPUs")
+	fs.IntVar(&c.ContainersPerCPU, "capacity.containers_per_cpu", c.ContainersPerCPU, "Containers per host CPU when capacity.max_containers is 0")
+	fs.Int64Var(&c.MemoryReserveMB, "capacity.memory_reserve_mb", c.MemoryReserveMB, "Host memory not given to testbed containers")
+	fs.Int64Var(&c.DefaultMemoryMB, "capacity.default_memory_mb", c.DefaultMemoryMB, "Memory counted for a service without limits whose image has no estimate")
+	fs.DurationVar(&c.ContainerHealthyTimeout, "timeouts.container_healthy", c.ContainerHealthyTimeout, "Time a started container may take to become healthy")
+	fs.DurationVar(&c.SeedReadyTimeout, "timeouts.seed_ready", c.SeedReadyTimeout, "Time a datastore may take to accept connections before it is seeded")
+	fs.DurationVar(&c.SeedStepTimeout, "timeouts.seed_step", c.SeedStepTimeout, "Time a seed step may take")
+	return fs
+}
+
+// loadConfig reads the settings from the defaults, the config file, the environment and the command line args
+func loadConfig(args []string) (*config, map[string]string, error) {
+	c := defaultConfig()
+	values := c.values()
+	sources := make(map[string]string)
+	values.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = "default"
+	})
+
+	// Flags are parsed first to find the config file, and applied last
+	cmd := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	path := cmd.String("config", os.Getenv("PROVISIONER_CONFIG"), "JSON config file")
+	values.VisitAll(func(f *flag.Flag) {
+		cmd.String(f.Name, f.DefValue, f.Usage)
+	})
+	if err := cmd.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	if *path != "" {
+		file, err := readConfigFile(*path)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, value := range file {
+			if values.Lookup(key) == nil {
+				return nil, nil, fmt.Errorf("config file %v: unknown setting %v", *path, key)
+			}
+			if err := values.Set(key, value); err != nil {
+				return nil, nil, fmt.Errorf("config file %v: invalid %v: %v", *path, key, err)
+			}
+			sources[key] = "file"
+		}
+	}
+
+	for key, env := range settingEnv {
+		if value := os.Getenv(env); value != "" {
+			if err := values.Set(key, value); err != nil {
+				return nil, nil, fmt.Errorf("invalid %v: %v", env, err)
+			}
+			sources[key] = "env " + env
+		}
+	}
+
+	var flagErr error
+	cmd.Visit(func(f *flag.Flag) {
+		if f.Name == "config" || flagErr != nil {
+			return
+		}
+		if err := values.Set(f.Name, f.Value.String()); err != nil {
+			flagErr = fmt.Errorf("invalid -%v: %v", f.Name, err)
+		}
+		sources[f.Name] = "flag"
+	})
+	if flagErr != nil {
+		return nil, nil, flagErr
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, sources, nil
+}
+
+// readConfigFile returns the settings of a JSON config file by key, nested objects are flattened into dotted keys
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+
+	settings := make(map[string]string)
+	var flatten func(prefix string, v interface{}) error
+	flatten = func(prefix string, v interface{}) error {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, child := range v {
+				if err := flatten(strings.TrimPrefix(prefix+"."+k, "."), child); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			var items []string
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return fmt.Errorf("invalid config file %v: %v must be a list of strings", path, prefix)
+				}
+				items = append(items, s)
+			}
+			settings[prefix] = strings.Join(items, string(os.PathListSeparator))
+		case nil:
+		default:
+			settings[prefix] = fmt.Sprint(v)
+		}
+		return nil
+	}
+	if err := flatten("", doc); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// validate returns the problems of the settings
+func (c *config) validate() error {
+	var problems []string
+
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			problems = append(problems, "server.address must be host:port")
+		}
+	}
+	durations := map[string]time.Duration{
+		"server.read_timeout":        c.ReadTimeout,
+		"server.idle_timeout":        c.IdleTimeout,
+		"server.upload_timeout":      c.UploadTimeout,
+		"timeouts.container_healthy": c.ContainerHealthyTimeout,
+		"timeouts.seed_ready":        c.SeedReadyTimeout,
+		"timeouts.seed_step":         c.SeedStepTimeout,
+	}
+	for key, d := range durations {
+		if d <= 0 {
+			problems = append(problems, key+" must be positive")
+		}
+	}
+	if u, err := url.Parse(c.MongoURI); err != nil || (u.Scheme != "mongodb" && u.Scheme != "mongodb+srv") {
+		problems = append(problems, "mongo.uri must be a mongodb:// or mongodb+srv:// connection string")
+	}
+	if c.MongoDatabase == "" || strings.ContainsAny(c.MongoDatabase, `/\. "$`) {
+		problems = append(problems, "mongo.database must be a MongoDB database name")
+	}
+	if c.Registry != "" && !strings.HasSuffix(c.Registry, "/") {
+		problems = append(problems, "images.registry must end with /")
+	}
+	if c.ChaosImage == "" {
+		problems = append(problems, "images.chaos must not be empty")
+	}
+	if !filepath.IsAbs(c.ArtifactDir) {
+		problems = append(problems, "artifacts.dir must be an absolute path")
+	}
+	for _, dir := range c.BindAllowlist {
+		if !filepath.IsAbs(dir) {
+			problems = append(problems, "volumes.bind_allowlist must hold absolute paths, not "+dir)
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		problems = append(problems, "tls.cert and tls.key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		problems = append(problems, "tls.client_ca needs tls.cert and tls.key")
+	}
+	if c.MaxContainers < 0 {
+		problems = append(problems, "capacity.max_containers must not be negative")
+	}
+	if c.ContainersPerCPU < 1 {
+		problems = append(problems, "capacity.containers_per_cpu must be positive")
+	}
+	if c.MemoryReserveMB < 0 {
+		problems = append(problems, "capacity.memory_reserve_mb must not be negative")
+	}
+	if c.DefaultMemoryMB < 1 {
+		problems = append(problems, "capacity.default_memory_mb must be positive")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return errors.New("invalid config: " + strings.Join(problems, ", "))
+}
+
+// applyConfig hands the settings to the parts of the server they configure
+func applyConfig(c *config) {
+	baseImageRegistry = c.Registry
+	chaosImage = c.ChaosImage
+	artifactDir = c.ArtifactDir
+	bindAllowlist = c.BindAllowlist
+	uploadTimeout = c.UploadTimeout
+	maxHostContainers = c.MaxContainers
+	containersPerCPU = c.ContainersPerCPU
+	memoryReserveMB = c.MemoryReserveMB
+	defaultMemoryMB = c.DefaultMemoryMB
+	containerHealthyTimeout = c.ContainerHealthyTimeout
+	seedReadyTimeout = c.SeedReadyTimeout
+	seedStepTimeout = c.SeedStepTimeout
+}
+
+// dump returns the settings with their sources, secrets redacted
+func (c *config) dump(sources map[string]string) configDump {
+	d := configDump{Settings: make(map[string]string), Sources: make(map[string]string)}
+	c.values().VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if redact, ok := secretSettings[f.Name]; ok {
+			value = redact(value)
+		}
+		d.Settings[f.Name] = value
+		d.Sources[f.Name] = sources[f.Name]
+	})
+	return d
+}
+
+// redactURI hides the password of a connection string
+func redactURI(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// Handler for GET /api/v1/config, the settings of the running server
+func confighandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cfg.dump(cfgSources))
+}
+
+//pathList is a list setting, separated like PATH when given as a string
+type pathList []string
+
+func (l *pathList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, string(os.PathListSeparator))
+}
+
+func (l *pathList) Set(value string) error {
+	*l = nil
+	for _, item := range filepath.SplitList(value) {
+		if item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
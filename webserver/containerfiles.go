@@ -0,0 +1,154 @@
+/*
+ * containerfiles.go copies files into and out of testbed containers through the docker copy API,
+ * e.g. to pull a crash dump out of a failed container or push a TLS certificate in.
+ *
+ *     PUT /api/v1/testbeds/{id}/containers/{name}/files?path=/etc/ssl/certs
+ *     GET /api/v1/testbeds/{id}/containers/{name}/files?path=/data/diagnostic.data
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"webserver/dockercontainer"
+	"webserver/logging"
+	"webserver/util"
+)
+
+// maxFileUploadSize limits the body of a file upload
+const maxFileUploadSize = 512 << 20
+
+// archiveContentTypes are the upload content types extracted as tar archives
+var archiveContentTypes = map[string]bool{
+	"application/x-tar":  true,
+	"application/gzip":   true,
+	"application/x-gzip": true,
+}
+
+/*
+  Handler for PUT /testbeds/{id}/containers/{name}/files call
+
+  A tar archive (content-type application/x-tar or application/gzip) is extracted into the directory
+  ?path, any other body is written as the file ?path and needs a Content-Length. The target directory
+  must exist. Bodies are streamed to docker, uploads have server.upload_timeout to be read (see api.go).
+*/
+func putcontainerfileshandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := containerFilePath(w, r)
+	if !ok {
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxFileUploadSize)
+	defer body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	dir := target
+	var archive io.Reader = body
+	if !archiveContentTypes[mediaType] {
+		if target == "/" {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid path", fieldError{Field: "path", Message: "must name a file"})
+			return
+		}
+		// A single file is streamed in an archive extracted into its directory, the header needs its size
+		if r.ContentLength < 0 {
+			writeError(w, http.StatusLengthRequired, errCodeBadRequest, "Uploading a single file needs a Content-Length")
+			return
+		}
+		if r.ContentLength > maxFileUploadSize {
+			writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Upload exceeds 512MB")
+			return
+		}
+		tarStream := util.TarStream(path.Base(target), r.ContentLength, 0644, body)
+		defer tarStream.Close()
+		dir = path.Dir(target)
+		archive = tarStream
+	}
+
+	err := dockercontainer.CopyToContainer(r.Context(), name, dir, archive)
+	if dockercontainer.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" or directory "+dir+" does not exist")
+		return
+	} else if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	logging.Info.Println("Copied ", mediaType, " upload to ", name, ":", target)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeUploadError answers an upload which could not be read or copied
+func writeUploadError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), "request body too large") {
+		writeError(w, http.StatusRequestEntityTooLarge, errCodeTooLarge, "Upload exceeds 512MB")
+		return
+	}
+	logging.Error.Println(err)
+	writeError(w, http.StatusBadGateway, errCodeDocker, "Could not copy upload: "+err.Error())
+}
+
+/*
+  Handler for GET /testbeds/{id}/containers/{name}/files call
+
+  Returns ?path, a file or a directory, as a tar archive. Works on stopped containers too.
+*/
+func getcontainerfileshandler(w http.ResponseWriter, r *http.Request) {
+	src, ok := containerFilePath(w, r)
+	if !ok {
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+
+	reader, stat, err := dockercontainer.CopyFromContainer(r.Context(), name, src)
+	if dockercontainer.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" or path "+src+" does not exist")
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not copy "+src+" from "+name+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("content-type", "application/x-tar")
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", stat.Name+".tar"))
+	if _, err := io.Copy(w, reader); err != nil {
+		logging.Error.Println(err)
+	}
+}
+
+// containerFilePath returns the absolute ?path of a files request, writing the error response if it is missing
+func containerFilePath(w http.ResponseWriter, r *http.Request) (string, bool) {
+	p := r.URL.Query().Get("path")
+	if !path.IsAbs(p) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid path", fieldError{Field: "path", Message: "must be an absolute path"})
+		return "", false
+	}
+	return path.Clean(p), true
+}
@@ -0,0 +1,124 @@
+/*
+ * containerlogs.go serves the output of testbed containers, so that a failed test can be
+ * debugged from its CI job without access to the docker host.
+ *
+ *     GET /api/v1/testbeds/{id}/containers/{name}/logs?tail=100&since=10m&timestamps=true&follow=true
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webserver/dockercontainer"
+	"webserver/logging"
+)
+
+// defaultLogTail is the number of lines returned when ?tail is not given
+const defaultLogTail = "1000"
+
+/*
+  Handler for /testbeds/{id}/containers/{name}/logs call
+
+  Returns the combined stdout and stderr of a container as text/plain. Query parameters:
+      tail=100          lines from the end, or all (default 1000)
+      since=10m         duration before now, RFC3339 time or unix seconds
+      timestamps=true   prefix every line with its timestamp
+      follow=true       keep streaming new output until the client disconnects
+*/
+func containerlogshandler(w http.ResponseWriter, r *http.Request) {
+	opts, errs := logOptions(r)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid log options", errs...)
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+	reader, err := dockercontainer.ContainerLogs(r.Context(), name, opts)
+	if dockercontainer.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" does not exist on the host")
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not read logs of "+name+": "+err.Error())
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	if !opts.Follow {
+		io.Copy(w, reader)
+		return
+	}
+
+	// Flush every chunk so that followed output reaches the client as it is written
+	w.Header().Set("X-Accel-Buffering", "no")
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := reader.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// logOptions reads the log query parameters of a request
+func logOptions(r *http.Request) (dockercontainer.LogOptions, []fieldError) {
+	query := r.URL.Query()
+	opts := dockercontainer.LogOptions{Tail: defaultLogTail}
+	var errs []fieldError
+
+	if v := query.Get("tail"); v != "" {
+		if n, err := strconv.Atoi(v); v != "all" && (err != nil || n < 0) {
+			errs = append(errs, fieldError{Field: "tail", Message: "must be a number of lines or all"})
+		}
+		opts.Tail = v
+	}
+
+	if v := query.Get("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			opts.Since = strconv.FormatInt(time.Now().Add(-d).Unix(), 10)
+		} else if secs, err := parseTimeParam(v); err == nil {
+			opts.Since = strconv.Itoa(secs)
+		} else {
+			errs = append(errs, fieldError{Field: "since", Message: "must be a duration such as 10m, an RFC3339 time or unix seconds"})
+		}
+	}
+
+	flags := []struct {
+		field string
+		dst   *bool
+	}{{"timestamps", &opts.Timestamps}, {"follow", &opts.Follow}}
+	for _, flag := range flags {
+		if v := query.Get(flag.field); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fieldError{Field: flag.field, Message: "must be true or false"})
+			}
+			*flag.dst = b
+		}
+	}
+	return opts, errs
+}
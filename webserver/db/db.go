@@ -12,6 +12,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"regexp"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -25,27 +26,43 @@ var client *mongo.Client
 //ErrNoMatchDocument is returned when no matching document is found
 var ErrNoMatchDocument = errors.New("No matching document")
 
+//ErrDocumentExists is returned when a document with the same unique key already exists
+var ErrDocumentExists = errors.New("Document already exists")
+
 //ErrMultipleDocExist is returned when multiple meta docs exist
 var ErrMultipleDocExist = errors.New("More than expected number of documents")
 
-const dbName = "infrabuilder"
+// dbName is the database of the provisioner, set by Connect
+var dbName string
+
 const tbColl = "testbed"
 const tbMetaColl = "testbedmeta"
+const tbTemplateColl = "testbedtemplate"
+const tbEventColl = "testbedevent"
+const webhookColl = "webhook"
+const webhookDeliveryColl = "webhookdelivery"
+const webhookCursorColl = "webhookcursor"
+const artifactColl = "artifact"
+const snapshotColl = "snapshot"
+const faultColl = "fault"
+const authNonceColl = "authnonce"
 
-func init() {
+//Connect connects to the MongoDB of uri and uses its database name, it is called once at startup
+func Connect(uri, name string) error {
 	var err error
 
-	client, err = mongo.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	client, err = mongo.NewClient(options.Client().ApplyURI(uri))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
-	err = client.Connect(ctx)
-	if err != nil {
-		log.Fatal(err)
+	if err := client.Connect(ctx); err != nil {
+		return err
 	}
+	dbName = name
+	return nil
 }
 
 //getTestBedCollection returns testbed collection
@@ -58,12 +75,206 @@ func getTestBedMetaCollection() *mongo.Collection {
         return client.Database(dbName).Collection(tbMetaColl)
 }
 
+// getTestBedTemplateCollection returns testbedtemplate collection
+func getTestBedTemplateCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(tbTemplateColl)
+}
+
+// getTestBedEventCollection returns testbedevent collection
+func getTestBedEventCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(tbEventColl)
+}
+
+// getWebhookCollection returns webhook collection
+func getWebhookCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(webhookColl)
+}
+
+// getWebhookDeliveryCollection returns webhookdelivery collection
+func getWebhookDeliveryCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(webhookDeliveryColl)
+}
+
+// getWebhookCursorCollection returns webhookcursor collection
+func getWebhookCursorCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(webhookCursorColl)
+}
+
+// getArtifactCollection returns artifact collection
+func getArtifactCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(artifactColl)
+}
+
+// getSnapshotCollection returns snapshot collection
+func getSnapshotCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(snapshotColl)
+}
+
+// getFaultCollection returns fault collection
+func getFaultCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(faultColl)
+}
+
+// getAuthNonceCollection returns authnonce collection
+func getAuthNonceCollection() *mongo.Collection {
+	return client.Database(dbName).Collection(authNonceColl)
+}
+
 //InsertTestBed inserts testbed data into MongoDB
 func InsertTestBed(ctx context.Context, tb *TestBed) (*mongo.InsertOneResult, error) {
 	insertResult, err := getTestBedCollection().InsertOne(ctx, tb)
 	return insertResult, err
 }
 
+//InitTestBedCollection creates the indexes of testbed collection
+func InitTestBedCollection(ctx context.Context) error {
+	// Idempotency keys were unique across owners before, the key of one owner blocked every other one
+	if _, err := getTestBedCollection().Indexes().DropOne(ctx, "idempotency_key_1"); err != nil && !isIndexNotFoundError(err) {
+		return err
+	}
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "owner", Value: 1}, {Key: "idempotency_key", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"idempotency_key": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "_cts", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_cts", Value: -1}}},
+		{Keys: bson.D{{Key: "owner", Value: 1}, {Key: "_cts", Value: -1}}},
+	}
+	_, err := getTestBedCollection().Indexes().CreateMany(ctx, indexes)
+	return err
+}
+
+// filter returns the query matching the documents of the owner or team
+func (v *Visibility) filter() bson.M {
+	if v.Team == "" {
+		return bson.M{"owner": v.Owner}
+	}
+	return bson.M{"$or": []bson.M{{"owner": v.Owner}, {"team": v.Team}}}
+}
+
+//ListTestBeds returns a page of testbeds matching the query, ordered by the sort field and _id
+func ListTestBeds(ctx context.Context, q TestBedQuery) ([]TestBed, error) {
+	var and []bson.M
+	if len(q.Status) > 0 {
+		and = append(and, bson.M{"status": bson.M{"$in": q.Status}})
+	}
+	if q.NamePrefix != "" {
+		and = append(and, bson.M{"name": bson.M{"$regex": "^" + regexp.QuoteMeta(q.NamePrefix)}})
+	}
+	if q.Owner != "" {
+		and = append(and, bson.M{"owner": q.Owner})
+	}
+	if q.Team != "" {
+		and = append(and, bson.M{"team": q.Team})
+	}
+	for k, v := range q.Labels {
+		if v == "" {
+			and = append(and, bson.M{"labels." + k: bson.M{"$exists": true}})
+		} else {
+			and = append(and, bson.M{"labels." + k: v})
+		}
+	}
+	if q.CreatedAfter > 0 {
+		and = append(and, bson.M{"_cts": bson.M{"$gt": q.CreatedAfter}})
+	}
+	if q.CreatedBefore > 0 {
+		and = append(and, bson.M{"_cts": bson.M{"$lt": q.CreatedBefore}})
+	}
+	if q.Visible != nil {
+		and = append(and, q.Visible.filter())
+	}
+
+	sortField := q.SortField
+	if sortField == "" {
+		sortField = "_cts"
+	}
+	direction, op := 1, "$gt"
+	if q.Descending {
+		direction, op = -1, "$lt"
+	}
+	if q.AfterID != "" {
+		and = append(and, bson.M{"$or": []bson.M{
+			{sortField: bson.M{op: q.AfterValue}},
+			{sortField: q.AfterValue, "_id": bson.M{op: q.AfterID}},
+		}})
+	}
+
+	colQuerier := bson.M{}
+	if len(and) > 0 {
+		colQuerier["$and"] = and
+	}
+	opts := options.Find().SetSort(bson.D{{Key: sortField, Value: direction}, {Key: "_id", Value: direction}})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+
+	cur, err := getTestBedCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	testbeds := []TestBed{}
+	for cur.Next(ctx) {
+		tb := TestBed{}
+		if err := cur.Decode(&tb); err != nil {
+			return nil, err
+		}
+		testbeds = append(testbeds, tb)
+	}
+	return testbeds, cur.Err()
+}
+
+//ListExpiredTestBeds returns the testbeds whose time to live elapsed before now, unix seconds,
+//and which are neither Expired nor Deleted yet
+func ListExpiredTestBeds(ctx context.Context, now int) ([]TestBed, error) {
+	colQuerier := bson.M{
+		"expires_at": bson.M{"$gt": 0, "$lte": now},
+		"status":     bson.M{"$nin": []string{StatusExpired, StatusDeleted}},
+	}
+	cur, err := getTestBedCollection().Find(ctx, colQuerier)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	testbeds := []TestBed{}
+	for cur.Next(ctx) {
+		tb := TestBed{}
+		if err := cur.Decode(&tb); err != nil {
+			return nil, err
+		}
+		testbeds = append(testbeds, tb)
+	}
+	return testbeds, cur.Err()
+}
+
+//GetTestBedFromIdempotencyKey returns the testbed the owner created with a client supplied idempotency key,
+//keys of different owners are independent
+func GetTestBedFromIdempotencyKey(ctx context.Context, owner, key string) (TestBed, error) {
+	tb := TestBed{}
+	colQuerier := bson.M{"owner": owner, "idempotency_key": key}
+	if owner == "" {
+		// Testbeds without owner are stored without the field
+		colQuerier["owner"] = nil
+	}
+	err := getTestBedCollection().FindOne(ctx, colQuerier).Decode(&tb)
+	if err == mongo.ErrNoDocuments {
+		return tb, ErrNoMatchDocument
+	}
+	return tb, err
+}
+
+//ReleaseIdempotencyKey removes the idempotency key from a testbed so the key can be used again
+func ReleaseIdempotencyKey(ctx context.Context, id string) (*mongo.UpdateResult, error) {
+	colQuerier := bson.M{"_id": id}
+	change := bson.M{"$unset": bson.M{"idempotency_key": "", "idempotency_hash": ""}}
+
+	updateResult, err := getTestBedCollection().UpdateOne(ctx, colQuerier, change)
+	return updateResult, err
+}
+
 //UpdateTestBedStatus updates status field in testbed collection for a document
 func UpdateTestBedStatus(ctx context.Context, id, status string) (*mongo.UpdateResult, error) {
 	colQuerier := bson.M{"_id": id}
@@ -73,6 +284,22 @@ func UpdateTestBedStatus(ctx context.Context, id, status string) (*mongo.UpdateR
 	return updateResult, err
 }
 
+//AdmitTestBed moves a Queued testbed to initiated, with its expiry when it has one. It reports
+//false when the testbed is no longer Queued, e.g. because it was deleted meanwhile.
+func AdmitTestBed(ctx context.Context, id string, expiresAt int) (bool, error) {
+	colQuerier := bson.M{"_id": id, "status": StatusQueued}
+	set := bson.M{"status": StatusInitiated}
+	if expiresAt > 0 {
+		set["expires_at"] = expiresAt
+	}
+
+	updateResult, err := getTestBedCollection().UpdateOne(ctx, colQuerier, bson.M{"$set": set})
+	if err != nil {
+		return false, err
+	}
+	return updateResult.ModifiedCount == 1, nil
+}
+
 //UpdateContainerProperty updates property for a container in TestBed document
 func UpdateContainerProperty(ctx context.Context, id, container, property string, value interface{}) (*mongo.UpdateResult, error) {
 	colQuerier := bson.M{"_id": id, "container": bson.M{"$elemMatch": bson.M{"image": container}}}
@@ -83,12 +310,32 @@ func UpdateContainerProperty(ctx context.Context, id, container, property string
 	return updateResult, err
 }
 
+//SetTestBedSnapshot records the snapshot a testbed is created from along with its containers started from it
+func SetTestBedSnapshot(ctx context.Context, id, snapshot string, containers []ContainerProp) (*mongo.UpdateResult, error) {
+	colQuerier := bson.M{"_id": id}
+	change := bson.M{"$set": bson.M{"snapshot": snapshot, "container": containers}}
+
+	updateResult, err := getTestBedCollection().UpdateOne(ctx, colQuerier, change)
+	return updateResult, err
+}
+
+//RemoveContainerFromTestBed removes a container entry from a TestBed document
+func RemoveContainerFromTestBed(ctx context.Context, id, container string) (*mongo.UpdateResult, error) {
+	colQuerier := bson.M{"_id": id}
+	change := bson.M{"$pull": bson.M{"container": bson.M{"image": container}}}
+
+	updateResult, err := getTestBedCollection().UpdateOne(ctx, colQuerier, change)
+	return updateResult, err
+}
+
 //GetTestBedFromID returns document corresponding to a testbed
 func GetTestBedFromID(ctx context.Context, id string) (TestBed, error) {
 	tb := TestBed{}
 	colQuerier := bson.M{"_id": id}
 	err := getTestBedCollection().FindOne(ctx, colQuerier).Decode(&tb)
-	if err != nil {
+	if err == mongo.ErrNoDocuments {
+		return tb, ErrNoMatchDocument
+	} else if err != nil {
 		logging.Error.Println(err)
 	}
 	return tb, err
@@ -162,3 +409,489 @@ func DeletePortFromMeta(ctx context.Context, port int) error {
 	res := getTestBedMetaCollection().FindOneAndUpdate(ctx, colQuerier, change)
 	return res.Err()
 }
+
+//InitTestBedTemplateCollection creates the unique name/version index on testbedtemplate collection
+func InitTestBedTemplateCollection(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}, {Key: "version", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := getTestBedTemplateCollection().Indexes().CreateOne(ctx, index)
+	return err
+}
+
+//InsertTestBedTemplate inserts a template version into MongoDB
+func InsertTestBedTemplate(ctx context.Context, tmpl *TestBedTemplate) (*mongo.InsertOneResult, error) {
+	insertResult, err := getTestBedTemplateCollection().InsertOne(ctx, tmpl)
+	if IsDuplicateKeyError(err) {
+		return insertResult, ErrDocumentExists
+	}
+	return insertResult, err
+}
+
+//GetTestBedTemplate returns a template version. Latest version is returned when version is 0
+func GetTestBedTemplate(ctx context.Context, name string, version int) (TestBedTemplate, error) {
+	tmpl := TestBedTemplate{}
+	colQuerier := bson.M{"name": name}
+	if version > 0 {
+		colQuerier["version"] = version
+	}
+	opts := options.FindOne().SetSort(bson.M{"version": -1})
+	err := getTestBedTemplateCollection().FindOne(ctx, colQuerier, opts).Decode(&tmpl)
+	if err == mongo.ErrNoDocuments {
+		return tmpl, ErrNoMatchDocument
+	}
+	return tmpl, err
+}
+
+//ListTestBedTemplates returns all template versions, optionally restricted to one template name
+func ListTestBedTemplates(ctx context.Context, name string) ([]TestBedTemplate, error) {
+	templates := []TestBedTemplate{}
+	colQuerier := bson.M{}
+	if name != "" {
+		colQuerier["name"] = name
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}, {Key: "version", Value: 1}})
+	cur, err := getTestBedTemplateCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	for cur.Next(ctx) {
+		tmpl := TestBedTemplate{}
+		if err := cur.Decode(&tmpl); err != nil {
+			return nil, err
+		}
+		templates = append(templates, tmpl)
+	}
+	return templates, cur.Err()
+}
+
+//DeleteTestBedTemplate removes a template version, or every version of the template when version is 0
+func DeleteTestBedTemplate(ctx context.Context, name string, version int) (*mongo.DeleteResult, error) {
+	colQuerier := bson.M{"name": name}
+	if version > 0 {
+		colQuerier["version"] = version
+	}
+	deleteResult, err := getTestBedTemplateCollection().DeleteMany(ctx, colQuerier)
+	return deleteResult, err
+}
+
+// isIndexNotFoundError reports whether err is the failure to drop an index or collection which does not exist
+func isIndexNotFoundError(err error) bool {
+	ce, ok := err.(mongo.CommandError)
+	return ok && (ce.Code == 26 || ce.Code == 27) // NamespaceNotFound, IndexNotFound
+}
+
+//IsDuplicateKeyError reports whether err is a unique index violation
+func IsDuplicateKeyError(err error) bool {
+	if we, ok := err.(mongo.WriteException); ok {
+		for _, e := range we.WriteErrors {
+			if e.Code == 11000 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//InitTestBedEventCollection creates the indexes of testbedevent collection
+func InitTestBedEventCollection(ctx context.Context) error {
+	_, err := getTestBedEventCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "testbed_id", Value: 1}, {Key: "seq", Value: 1}}},
+		{Keys: bson.D{{Key: "type", Value: 1}, {Key: "seq", Value: 1}}},
+	})
+	return err
+}
+
+//InsertTestBedEvent stores a testbed lifecycle event
+func InsertTestBedEvent(ctx context.Context, event *TestBedEvent) error {
+	_, err := getTestBedEventCollection().InsertOne(ctx, event)
+	return err
+}
+
+//GetTestBedEvents returns the events of a testbed with a sequence number above afterSeq, oldest first
+func GetTestBedEvents(ctx context.Context, id string, afterSeq int64) ([]TestBedEvent, error) {
+	colQuerier := bson.M{"testbed_id": id, "seq": bson.M{"$gt": afterSeq}}
+	opts := options.Find().SetSort(bson.M{"seq": 1})
+	cur, err := getTestBedEventCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	events := []TestBedEvent{}
+	for cur.Next(ctx) {
+		event := TestBedEvent{}
+		if err := cur.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, cur.Err()
+}
+
+//ListEvents returns the events of all testbeds matching the query, oldest first
+func ListEvents(ctx context.Context, q EventQuery) ([]TestBedEvent, error) {
+	seq := bson.M{"$gt": q.AfterSeq}
+	if q.UntilSeq > 0 {
+		seq["$lte"] = q.UntilSeq
+	}
+	colQuerier := bson.M{"seq": seq}
+	if q.Type != "" {
+		colQuerier["type"] = q.Type
+	}
+	if len(q.Status) > 0 {
+		colQuerier["status"] = bson.M{"$in": q.Status}
+	}
+	opts := options.Find().SetSort(bson.M{"seq": 1})
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	cur, err := getTestBedEventCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	events := []TestBedEvent{}
+	for cur.Next(ctx) {
+		event := TestBedEvent{}
+		if err := cur.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, cur.Err()
+}
+
+//InitWebhookDeliveryCollection creates the indexes of webhookdelivery collection
+func InitWebhookDeliveryCollection(ctx context.Context) error {
+	_, err := getWebhookDeliveryCollection().Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "webhook_id", Value: 1}, {Key: "_cts", Value: -1}}},
+		{Keys: bson.D{{Key: "status", Value: 1}}},
+		{
+			// An event is delivered once to a webhook, also when it is dispatched again after a restart
+			Keys:    bson.D{{Key: "webhook_id", Value: 1}, {Key: "event_seq", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"event_seq": bson.M{"$exists": true}}),
+		},
+	})
+	return err
+}
+
+//GetWebhookCursor returns the sequence number of the last event dispatched to webhooks
+func GetWebhookCursor(ctx context.Context) (int64, error) {
+	cursor := struct {
+		Seq int64 `bson:"seq"`
+	}{}
+	err := getWebhookCursorCollection().FindOne(ctx, bson.M{"_id": "webhook"}).Decode(&cursor)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrNoMatchDocument
+	}
+	return cursor.Seq, err
+}
+
+//SetWebhookCursor records the sequence number of the last event dispatched to webhooks
+func SetWebhookCursor(ctx context.Context, seq int64) error {
+	opts := options.Update().SetUpsert(true)
+	_, err := getWebhookCursorCollection().UpdateOne(ctx, bson.M{"_id": "webhook"}, bson.M{"$set": bson.M{"seq": seq}}, opts)
+	return err
+}
+
+//InsertWebhook inserts a webhook subscription
+func InsertWebhook(ctx context.Context, hook *Webhook) (*mongo.InsertOneResult, error) {
+	insertResult, err := getWebhookCollection().InsertOne(ctx, hook)
+	return insertResult, err
+}
+
+//GetWebhookFromID returns a webhook subscription
+func GetWebhookFromID(ctx context.Context, id string) (Webhook, error) {
+	hook := Webhook{}
+	err := getWebhookCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&hook)
+	if err == mongo.ErrNoDocuments {
+		return hook, ErrNoMatchDocument
+	}
+	return hook, err
+}
+
+//ListWebhooks returns the webhook subscriptions, restricted to those receiving event when event is given
+func ListWebhooks(ctx context.Context, event string) ([]Webhook, error) {
+	colQuerier := bson.M{}
+	if event != "" {
+		colQuerier["$or"] = bson.A{
+			bson.M{"events": event},
+			bson.M{"events": bson.M{"$exists": false}},
+		}
+	}
+	opts := options.Find().SetSort(bson.M{"_cts": 1})
+	cur, err := getWebhookCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	hooks := []Webhook{}
+	for cur.Next(ctx) {
+		hook := Webhook{}
+		if err := cur.Decode(&hook); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, cur.Err()
+}
+
+//DeleteWebhook deletes a webhook subscription along with its delivery log
+func DeleteWebhook(ctx context.Context, id string) (*mongo.DeleteResult, error) {
+	deleteResult, err := getWebhookCollection().DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil || deleteResult.DeletedCount == 0 {
+		return deleteResult, err
+	}
+	if _, err := getWebhookDeliveryCollection().DeleteMany(ctx, bson.M{"webhook_id": id}); err != nil {
+		logging.Error.Println(err)
+	}
+	return deleteResult, nil
+}
+
+//InsertWebhookDelivery records a delivery, ErrDocumentExists when the event was already delivered to the webhook
+func InsertWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	_, err := getWebhookDeliveryCollection().InsertOne(ctx, delivery)
+	if IsDuplicateKeyError(err) {
+		return ErrDocumentExists
+	}
+	return err
+}
+
+//UpdateWebhookDelivery stores the outcome of a delivery attempt
+func UpdateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) error {
+	change := bson.M{"$set": bson.M{
+		"status":        delivery.Status,
+		"attempts":      delivery.Attempts,
+		"response_code": delivery.ResponseCode,
+		"error":         delivery.Error,
+		"last_attempt":  delivery.LastAttempt,
+	}}
+	_, err := getWebhookDeliveryCollection().UpdateOne(ctx, bson.M{"_id": delivery.ID}, change)
+	return err
+}
+
+//ListWebhookDeliveries returns the latest deliveries of a webhook, newest first
+func ListWebhookDeliveries(ctx context.Context, webhookID string, limit int) ([]WebhookDelivery, error) {
+	return findWebhookDeliveries(ctx, bson.M{"webhook_id": webhookID},
+		options.Find().SetSort(bson.M{"_cts": -1}).SetLimit(int64(limit)))
+}
+
+//GetPendingWebhookDeliveries returns the deliveries which were not finished, oldest first
+func GetPendingWebhookDeliveries(ctx context.Context) ([]WebhookDelivery, error) {
+	return findWebhookDeliveries(ctx, bson.M{"status": DeliveryPending}, options.Find().SetSort(bson.M{"_cts": 1}))
+}
+
+func findWebhookDeliveries(ctx context.Context, colQuerier bson.M, opts *options.FindOptions) ([]WebhookDelivery, error) {
+	cur, err := getWebhookDeliveryCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	deliveries := []WebhookDelivery{}
+	for cur.Next(ctx) {
+		delivery := WebhookDelivery{}
+		if err := cur.Decode(&delivery); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, cur.Err()
+}
+
+//InsertArtifact records an uploaded artifact
+func InsertArtifact(ctx context.Context, artifact *Artifact) (*mongo.InsertOneResult, error) {
+	insertResult, err := getArtifactCollection().InsertOne(ctx, artifact)
+	return insertResult, err
+}
+
+//GetArtifactFromID returns an artifact record
+func GetArtifactFromID(ctx context.Context, id string) (Artifact, error) {
+	artifact := Artifact{}
+	err := getArtifactCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&artifact)
+	if err == mongo.ErrNoDocuments {
+		return artifact, ErrNoMatchDocument
+	}
+	return artifact, err
+}
+
+//ListArtifacts returns the artifact records visible as given, newest first
+func ListArtifacts(ctx context.Context, visible *Visibility) ([]Artifact, error) {
+	colQuerier := bson.M{}
+	if visible != nil {
+		colQuerier = visible.filter()
+	}
+	opts := options.Find().SetSort(bson.M{"_cts": -1})
+	cur, err := getArtifactCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	artifacts := []Artifact{}
+	for cur.Next(ctx) {
+		artifact := Artifact{}
+		if err := cur.Decode(&artifact); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, artifact)
+	}
+	return artifacts, cur.Err()
+}
+
+//DeleteArtifact deletes an artifact record
+func DeleteArtifact(ctx context.Context, id string) (*mongo.DeleteResult, error) {
+	deleteResult, err := getArtifactCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return deleteResult, err
+}
+
+//InsertSnapshot records a snapshot
+func InsertSnapshot(ctx context.Context, snapshot *Snapshot) (*mongo.InsertOneResult, error) {
+	insertResult, err := getSnapshotCollection().InsertOne(ctx, snapshot)
+	return insertResult, err
+}
+
+//UpdateSnapshot replaces a snapshot record, e.g. once its capture ended
+func UpdateSnapshot(ctx context.Context, snapshot *Snapshot) error {
+	_, err := getSnapshotCollection().ReplaceOne(ctx, bson.M{"_id": snapshot.ID}, snapshot)
+	return err
+}
+
+//GetSnapshotFromID returns a snapshot record
+func GetSnapshotFromID(ctx context.Context, id string) (Snapshot, error) {
+	snapshot := Snapshot{}
+	err := getSnapshotCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&snapshot)
+	if err == mongo.ErrNoDocuments {
+		return snapshot, ErrNoMatchDocument
+	}
+	return snapshot, err
+}
+
+//GetSnapshotReferencingArtifact returns a snapshot keeping volume content in an artifact,
+//ErrNoMatchDocument when no snapshot references it
+func GetSnapshotReferencingArtifact(ctx context.Context, artifactID string) (Snapshot, error) {
+	snapshot := Snapshot{}
+	colQuerier := bson.M{"$or": []bson.M{
+		{"containers.data.artifact": artifactID},
+		{"containers.replicas.data.artifact": artifactID},
+	}}
+	err := getSnapshotCollection().FindOne(ctx, colQuerier).Decode(&snapshot)
+	if err == mongo.ErrNoDocuments {
+		return snapshot, ErrNoMatchDocument
+	}
+	return snapshot, err
+}
+
+//ListSnapshots returns the snapshots of a testbed, newest first
+func ListSnapshots(ctx context.Context, testbedID string) ([]Snapshot, error) {
+	opts := options.Find().SetSort(bson.M{"_cts": -1})
+	cur, err := getSnapshotCollection().Find(ctx, bson.M{"testbed_id": testbedID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	snapshots := []Snapshot{}
+	for cur.Next(ctx) {
+		snapshot := Snapshot{}
+		if err := cur.Decode(&snapshot); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, cur.Err()
+}
+
+//DeleteSnapshot deletes a snapshot record
+func DeleteSnapshot(ctx context.Context, id string) (*mongo.DeleteResult, error) {
+	deleteResult, err := getSnapshotCollection().DeleteOne(ctx, bson.M{"_id": id})
+	return deleteResult, err
+}
+
+//InitFaultCollection creates the index of fault collection
+func InitFaultCollection(ctx context.Context) error {
+	index := mongo.IndexModel{Keys: bson.M{"testbed_id": 1}}
+	_, err := getFaultCollection().Indexes().CreateOne(ctx, index)
+	return err
+}
+
+//InsertFault records an active fault, ErrDocumentExists when its container already has one
+func InsertFault(ctx context.Context, f *Fault) error {
+	_, err := getFaultCollection().InsertOne(ctx, f)
+	if IsDuplicateKeyError(err) {
+		return ErrDocumentExists
+	}
+	return err
+}
+
+//UpdateFault replaces an active fault record, e.g. once it is injected
+func UpdateFault(ctx context.Context, f *Fault) error {
+	_, err := getFaultCollection().ReplaceOne(ctx, bson.M{"_id": f.Container}, f)
+	return err
+}
+
+//TakeFault deletes the active fault of a container and returns it, ErrNoMatchDocument when there is none.
+//Kill faults are only recorded while they are injected and are not taken.
+func TakeFault(ctx context.Context, container string) (Fault, error) {
+	f := Fault{}
+	colQuerier := bson.M{"_id": container, "type": bson.M{"$ne": "kill"}}
+	err := getFaultCollection().FindOneAndDelete(ctx, colQuerier).Decode(&f)
+	if err == mongo.ErrNoDocuments {
+		return f, ErrNoMatchDocument
+	}
+	return f, err
+}
+
+//DeleteFault deletes the fault record of a container
+func DeleteFault(ctx context.Context, container string) error {
+	_, err := getFaultCollection().DeleteOne(ctx, bson.M{"_id": container})
+	return err
+}
+
+//ListFaults returns the active faults of a testbed ordered by container, of every testbed when testbedID is empty
+func ListFaults(ctx context.Context, testbedID string) ([]Fault, error) {
+	colQuerier := bson.M{}
+	if testbedID != "" {
+		colQuerier["testbed_id"] = testbedID
+	}
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	cur, err := getFaultCollection().Find(ctx, colQuerier, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	faults := []Fault{}
+	for cur.Next(ctx) {
+		f := Fault{}
+		if err := cur.Decode(&f); err != nil {
+			return nil, err
+		}
+		faults = append(faults, f)
+	}
+	return faults, cur.Err()
+}
+
+//InitAuthNonceCollection creates the index removing the nonces of signed requests once they expired
+func InitAuthNonceCollection(ctx context.Context) error {
+	index := mongo.IndexModel{Keys: bson.M{"expires_at": 1}, Options: options.Index().SetExpireAfterSeconds(0)}
+	_, err := getAuthNonceCollection().Indexes().CreateOne(ctx, index)
+	return err
+}
+
+//InsertAuthNonce records the nonce of a signed request until it expires, ErrDocumentExists when the key
+//used it already
+func InsertAuthNonce(ctx context.Context, keyID, nonce string, expires time.Time) error {
+	doc := bson.M{"_id": bson.M{"key_id": keyID, "nonce": nonce}, "expires_at": expires}
+	_, err := getAuthNonceCollection().InsertOne(ctx, doc)
+	if IsDuplicateKeyError(err) {
+		return ErrDocumentExists
+	}
+	return err
+}
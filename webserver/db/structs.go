@@ -1,59 +1,397 @@
-/*
- * Structures and functions defined in this file are used to store/fetch data in MongoDB
- *
- * API version: 1.0.0
- * Contact: Arun K
- */
-
-
-package db
-
-import (
-	"fmt"
-	"time"
-
-	"github.com/google/uuid"
-)
-
-//ContainerProp is the container struct
-type ContainerProp struct {
-	Image    string `json:"image" bson:"image"`
-	CID      string `json:"cid" bson:"cid"`
-	HostName string `json:"hostname" bson:"hostname"`
-	IP       string `json:"ip" bson:"ip"`
-	SvcPort  int    `json:"svc_port" bson:"svc_port"`
-	RestPort int    `json:"rest_port" bson:"rest_port"`
-}
-
-//TestBed is the test bed struct
-type TestBed struct {
-	ID        string          `json:"_id" bson:"_id"`
-	CTS       int             `json:"_cts" bson:"_cts"`
-	Name      string          `json:"name" bson:"name"`
-	Container []ContainerProp `json:"container" bson:"container"`
-	Status    string          `json:"status" bson:"status"`
-}
-
-// TestBedMeta is the TestBedMeta collection struct
-type TestBedMeta struct {
-	ID             string `json:"_id" bson:"_id"`
-	AllocatedPorts []int  `json:"allocatedPorts,omitempty" bson:"allocatedPorts,omitempty"`
-}
-
-//NewTestBed creates a new TestBed
-func NewTestBed() *TestBed {
-	testbedID := uuid.New().String()
-	return &TestBed{
-		ID:     fmt.Sprintf("%v", testbedID),
-		CTS:    int(time.Now().Unix()),
-		Status: "initiated",
-	}
-}
-
-// NewTestBedMeta creates a new TestBedMeta document
-func NewTestBedMeta() *TestBedMeta {
-	id := uuid.New().String()
-	return &TestBedMeta{
-		ID: fmt.Sprintf("%v", id),
-	}
-}
+/*
+ * Structures and functions defined in this file are used to store/fetch data in MongoDB
+ *
+ * API version: 1.0.0
+ * Contact: Arun K
+ */
+
+
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Testbed status values
+const (
+	StatusQueued     = "Queued" // waits for host capacity, see the admission queue
+	StatusInitiated  = "initiated"
+	StatusInProgress = "In-progress"
+	StatusCompleted  = "Completed"
+	StatusStopped    = "Stopped"
+	StatusPaused     = "Paused"
+	StatusFailed     = "Failed"
+	StatusExpired    = "Expired" // outlived its time to live and was torn down
+	StatusDeleted    = "Deleted"
+)
+
+// Webhook delivery status values
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+//ContainerProp is the container struct
+type ContainerProp struct {
+	Image       string       `json:"image" bson:"image"`
+	CID         string       `json:"cid" bson:"cid"`
+	HostName    string       `json:"hostname" bson:"hostname"`
+	IP          string       `json:"ip" bson:"ip"`
+	SvcPort     int          `json:"svc_port" bson:"svc_port"`
+	RestPort    int          `json:"rest_port" bson:"rest_port"`
+	Seed        []SeedStep   `json:"seed,omitempty" bson:"seed,omitempty"`
+	SeedResults []SeedResult `json:"seed_results,omitempty" bson:"seed_results,omitempty"`
+	Volumes     []VolumeSpec `json:"volumes,omitempty" bson:"volumes,omitempty"`
+
+	Env       []string   `json:"env,omitempty" bson:"env,omitempty"`
+	Resources *Resources `json:"resources,omitempty" bson:"resources,omitempty"`
+
+	// Image the container is created from instead of the service image, e.g. a snapshot
+	ImageRef string `json:"image_ref,omitempty" bson:"image_ref,omitempty"`
+	// Volume contents copied into the container before it is started
+	Restore []VolumeArchive `json:"restore,omitempty" bson:"restore,omitempty"`
+
+	// Additional instances of the service, the properties above describe the first one
+	Replicas []Replica `json:"replicas,omitempty" bson:"replicas,omitempty"`
+}
+
+//Replica is an additional instance of a testbed service, numbered from 2. A replica without a container
+//is planned, it is created when the testbed is provisioned, e.g. for a clone or a snapshot.
+type Replica struct {
+	Index       int          `json:"index" bson:"index"`
+	Name        string       `json:"name" bson:"name"` // container name
+	CID         string       `json:"cid" bson:"cid"`
+	IP          string       `json:"ip" bson:"ip"`
+	SvcPort     int          `json:"svc_port" bson:"svc_port"`
+	SeedResults []SeedResult `json:"seed_results,omitempty" bson:"seed_results,omitempty"`
+
+	// Image and volume content of a planned replica restored from a snapshot, see ContainerProp
+	ImageRef string          `json:"image_ref,omitempty" bson:"image_ref,omitempty"`
+	Restore  []VolumeArchive `json:"restore,omitempty" bson:"restore,omitempty"`
+}
+
+//Resources limits the memory and CPU of a container, zero values do not limit
+type Resources struct {
+	MemoryMB int64   `json:"memory_mb,omitempty" bson:"memory_mb,omitempty"`
+	CPUs     float64 `json:"cpus,omitempty" bson:"cpus,omitempty"`
+}
+
+//VolumeArchive is the content of a container volume kept as a tar artifact
+type VolumeArchive struct {
+	Target   string `json:"target" bson:"target"` // mount point in the container
+	Artifact string `json:"artifact" bson:"artifact"`
+}
+
+//Volume types
+const (
+	VolumeNamed = "volume"
+	VolumeTmpfs = "tmpfs"
+	VolumeBind  = "bind"
+)
+
+//VolumeSpec is a mount of a testbed container: a named volume, a tmpfs or a read-only bind of a host path.
+//Named volumes are called <testbed id>-<service>-<name> on the host and removed on teardown unless Retain is set.
+type VolumeSpec struct {
+	Type   string `json:"type" bson:"type"`
+	Target string `json:"target" bson:"target"` // mount point in the container
+	Name   string `json:"name,omitempty" bson:"name,omitempty"`
+	Source string `json:"source,omitempty" bson:"source,omitempty"`   // host path of a bind
+	SizeMB int64  `json:"size_mb,omitempty" bson:"size_mb,omitempty"` // size limit of a tmpfs
+	Retain bool   `json:"retain,omitempty" bson:"retain,omitempty"`
+
+	// Source with its symlinks resolved when the request was validated, it is the path mounted
+	Resolved string `json:"-" bson:"resolved,omitempty"`
+}
+
+//SeedStep copies files into a container once it is ready and optionally runs a command.
+//Exactly one of Content (an inline file called Name), Archive (base64 tar) or Artifact is set.
+type SeedStep struct {
+	Name     string   `json:"name,omitempty" bson:"name,omitempty"`
+	Content  string   `json:"content,omitempty" bson:"content,omitempty"`
+	Archive  string   `json:"archive,omitempty" bson:"archive,omitempty"`
+	Artifact string   `json:"artifact,omitempty" bson:"artifact,omitempty"`
+	Path     string   `json:"path,omitempty" bson:"path,omitempty"` // directory the files are copied to
+	Run      []string `json:"run,omitempty" bson:"run,omitempty"`
+}
+
+//SeedResult is the outcome of a SeedStep
+type SeedResult struct {
+	Step     int    `json:"step" bson:"step"`
+	OK       bool   `json:"ok" bson:"ok"`
+	ExitCode int    `json:"exit_code" bson:"exit_code"`
+	Output   string `json:"output,omitempty" bson:"output,omitempty"`
+	Error    string `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+//Artifact is an uploaded file, e.g. a database dump, stored on disk under its ID
+type Artifact struct {
+	ID     string `json:"_id" bson:"_id"`
+	CTS    int    `json:"_cts" bson:"_cts"`
+	Name   string `json:"name" bson:"name"`
+	Size   int64  `json:"size" bson:"size"`
+	SHA256 string `json:"sha256" bson:"sha256"`
+	Owner  string `json:"owner,omitempty" bson:"owner,omitempty"`
+	Team   string `json:"team,omitempty" bson:"team,omitempty"`
+}
+
+//TestBed is the test bed struct
+type TestBed struct {
+	ID        string            `json:"_id" bson:"_id"`
+	CTS       int               `json:"_cts" bson:"_cts"`
+	Name      string            `json:"name" bson:"name"`
+	Container []ContainerProp   `json:"container" bson:"container"`
+	Status    string            `json:"status" bson:"status"`
+	Template  string            `json:"template,omitempty" bson:"template,omitempty"`
+	Snapshot  string            `json:"snapshot,omitempty" bson:"snapshot,omitempty"`
+	Owner     string            `json:"owner,omitempty" bson:"owner,omitempty"`
+	Team      string            `json:"team,omitempty" bson:"team,omitempty"` // team of the owner, its members share the testbed
+	Labels    map[string]string `json:"labels,omitempty" bson:"labels,omitempty"`
+
+	// Testbed this testbed was cloned from (see clone.go), with whether its data is copied when provisioned
+	ClonedFrom string `json:"cloned_from,omitempty" bson:"cloned_from,omitempty"`
+	CloneData  bool   `json:"clone_data,omitempty" bson:"clone_data,omitempty"`
+
+	// Unix seconds after which the testbed is torn down and Expired, 0 for never
+	ExpiresAt int `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+
+	// Admission of a testbed waiting for host capacity, position and ETA are computed when it is read
+	Priority      string     `json:"priority,omitempty" bson:"priority,omitempty"`
+	QueuedAt      *time.Time `json:"queued_at,omitempty" bson:"queued_at,omitempty"`
+	QueuePosition int        `json:"queue_position,omitempty" bson:"-"`
+	ETASeconds    int        `json:"eta_seconds,omitempty" bson:"-"`
+
+	// Client supplied key making creation idempotent, with the fingerprint of the original request
+	IdempotencyKey  string `json:"idempotency_key,omitempty" bson:"idempotency_key,omitempty"`
+	IdempotencyHash string `json:"-" bson:"idempotency_hash,omitempty"`
+}
+
+// TestBedMeta is the TestBedMeta collection struct
+type TestBedMeta struct {
+	ID             string `json:"_id" bson:"_id"`
+	AllocatedPorts []int  `json:"allocatedPorts,omitempty" bson:"allocatedPorts,omitempty"`
+}
+
+//TestBedQuery selects a sorted page of testbeds. Zero values do not filter.
+type TestBedQuery struct {
+	Status        []string
+	NamePrefix    string
+	Owner         string
+	Team          string
+	Labels        map[string]string // an empty value matches any value of the label
+	CreatedAfter  int
+	CreatedBefore int
+	Visible       *Visibility
+
+	SortField  string // _cts, name or status
+	Descending bool
+
+	// Sort value and id of the last testbed of the previous page
+	AfterValue interface{}
+	AfterID    string
+
+	Limit int
+}
+
+//EventQuery selects the events of all testbeds. Zero values do not filter.
+type EventQuery struct {
+	Type     string
+	Status   []string
+	AfterSeq int64
+	UntilSeq int64 // inclusive
+	Limit    int
+}
+
+//Visibility restricts a listing to the documents of Owner and, when Team is set, of the team.
+//A nil Visibility does not restrict.
+type Visibility struct {
+	Owner string
+	Team  string
+}
+
+//TestBedEvent is a lifecycle event of a testbed, Seq orders the events of the whole server
+type TestBedEvent struct {
+	Seq       int64     `json:"seq" bson:"seq"`
+	TestBedID string    `json:"testbed_id" bson:"testbed_id"`
+	Type      string    `json:"type" bson:"type"`
+	Container string    `json:"container,omitempty" bson:"container,omitempty"`
+	Status    string    `json:"status,omitempty" bson:"status,omitempty"`
+	Message   string    `json:"message,omitempty" bson:"message,omitempty"`
+	Time      time.Time `json:"time" bson:"time"`
+}
+
+//Webhook is a subscription receiving signed POSTs for testbed lifecycle events
+type Webhook struct {
+	ID     string   `json:"_id" bson:"_id"`
+	CTS    int      `json:"_cts" bson:"_cts"`
+	URL    string   `json:"url" bson:"url"`
+	Events []string `json:"events,omitempty" bson:"events,omitempty"` // empty subscribes to every event
+	Secret string   `json:"-" bson:"secret"`
+}
+
+//WebhookDelivery records the attempts to deliver one event to one webhook
+type WebhookDelivery struct {
+	ID           string    `json:"_id" bson:"_id"`
+	CTS          int       `json:"_cts" bson:"_cts"`
+	WebhookID    string    `json:"webhook_id" bson:"webhook_id"`
+	Event        string    `json:"event" bson:"event"`
+	TestBedID    string    `json:"testbed_id" bson:"testbed_id"`
+	EventSeq     int64     `json:"event_seq,omitempty" bson:"event_seq,omitempty"` // Seq of the delivered TestBedEvent
+	Payload      string    `json:"payload" bson:"payload"`
+	Status       string    `json:"status" bson:"status"`
+	Attempts     int       `json:"attempts" bson:"attempts"`
+	ResponseCode int       `json:"response_code,omitempty" bson:"response_code,omitempty"`
+	Error        string    `json:"error,omitempty" bson:"error,omitempty"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty" bson:"last_attempt,omitempty"`
+}
+
+//TestBedTemplate is a named, versioned testbed definition. TestBedName, Containers and the services
+//Seed, Volumes and Resources are given for may reference variables as ${var}, which are substituted
+//when the template is instantiated. Every version belongs to the owner and team of the first one.
+type TestBedTemplate struct {
+	ID          string            `json:"_id" bson:"_id"`
+	CTS         int               `json:"_cts" bson:"_cts"`
+	Name        string            `json:"name" bson:"name"`
+	Version     int               `json:"version" bson:"version"`
+	Owner       string            `json:"owner,omitempty" bson:"owner,omitempty"`
+	Team        string            `json:"team,omitempty" bson:"team,omitempty"`
+	Description string            `json:"description,omitempty" bson:"description,omitempty"`
+	TestBedName string            `json:"testbed_name" bson:"testbed_name"`
+	Containers  []string          `json:"containers" bson:"containers"`
+	Vars        map[string]string `json:"vars,omitempty" bson:"vars,omitempty"`
+
+	// Settings of the created testbeds, as in a create request
+	Seed       map[string][]SeedStep   `json:"seed,omitempty" bson:"seed,omitempty"`
+	Volumes    map[string][]VolumeSpec `json:"volumes,omitempty" bson:"volumes,omitempty"`
+	Resources  map[string]*Resources   `json:"resources,omitempty" bson:"resources,omitempty"`
+	TTLSeconds int                     `json:"ttl_seconds,omitempty" bson:"ttl_seconds,omitempty"`
+	Priority   string                  `json:"priority,omitempty" bson:"priority,omitempty"`
+}
+
+//NewTestBed creates a new TestBed
+func NewTestBed() *TestBed {
+	testbedID := uuid.New().String()
+	return &TestBed{
+		ID:     fmt.Sprintf("%v", testbedID),
+		CTS:    int(time.Now().Unix()),
+		Status: StatusInitiated,
+	}
+}
+
+// NewTestBedMeta creates a new TestBedMeta document
+func NewTestBedMeta() *TestBedMeta {
+	id := uuid.New().String()
+	return &TestBedMeta{
+		ID: fmt.Sprintf("%v", id),
+	}
+}
+
+// NewArtifact creates a new Artifact document
+func NewArtifact(name string) *Artifact {
+	id := uuid.New().String()
+	return &Artifact{
+		ID:   fmt.Sprintf("%v", id),
+		CTS:  int(time.Now().Unix()),
+		Name: name,
+	}
+}
+
+//Snapshot captures the containers of a testbed, their filesystems as committed images and the
+//content of their volumes as artifacts. Status is InProgress until capture is Completed or Failed.
+type Snapshot struct {
+	ID          string              `json:"_id" bson:"_id"`
+	CTS         int                 `json:"_cts" bson:"_cts"`
+	TestBedID   string              `json:"testbed_id" bson:"testbed_id"`
+	TestBedName string              `json:"testbed_name" bson:"testbed_name"`
+	Name        string              `json:"name,omitempty" bson:"name,omitempty"`
+	Status      string              `json:"status" bson:"status"`
+	Error       string              `json:"error,omitempty" bson:"error,omitempty"`
+	Containers  []SnapshotContainer `json:"containers" bson:"containers"`
+	Owner       string              `json:"owner,omitempty" bson:"owner,omitempty"`
+	Team        string              `json:"team,omitempty" bson:"team,omitempty"`
+}
+
+//Fault is a fault injected into a testbed container instance, recorded while it is active
+type Fault struct {
+	Container string     `json:"container" bson:"_id"` // container name, an instance has one active fault
+	TestBedID string     `json:"testbed_id" bson:"testbed_id"`
+	Service   string     `json:"service" bson:"service"`
+	Type      string     `json:"type" bson:"type"`
+	Signal    string     `json:"signal,omitempty" bson:"signal,omitempty"`
+	LatencyMS int        `json:"latency_ms,omitempty" bson:"latency_ms,omitempty"`
+	JitterMS  int        `json:"jitter_ms,omitempty" bson:"jitter_ms,omitempty"`
+	Loss      float64    `json:"loss_percent,omitempty" bson:"loss_percent,omitempty"`
+	Networks  []string   `json:"networks,omitempty" bson:"networks,omitempty"` // networks a disconnected container is reconnected to
+	Injected  time.Time  `json:"injected" bson:"injected"`
+	Expires   *time.Time `json:"expires,omitempty" bson:"expires,omitempty"`
+}
+
+//SnapshotContainer is the captured state of a testbed service, its first instance and its replicas
+type SnapshotContainer struct {
+	Image     string            `json:"image" bson:"image"`         // service
+	ImageRef  string            `json:"image_ref" bson:"image_ref"` // committed image
+	Volumes   []VolumeSpec      `json:"volumes,omitempty" bson:"volumes,omitempty"`
+	Env       []string          `json:"env,omitempty" bson:"env,omitempty"`
+	Resources *Resources        `json:"resources,omitempty" bson:"resources,omitempty"`
+	Data      []VolumeArchive   `json:"data,omitempty" bson:"data,omitempty"`
+	Replicas  []SnapshotReplica `json:"replicas,omitempty" bson:"replicas,omitempty"`
+}
+
+//SnapshotReplica is the capture of an additional instance of a service
+type SnapshotReplica struct {
+	Index    int             `json:"index" bson:"index"`
+	ImageRef string          `json:"image_ref" bson:"image_ref"`
+	Data     []VolumeArchive `json:"data,omitempty" bson:"data,omitempty"`
+}
+
+// NewSnapshot creates a new Snapshot document of a testbed
+func NewSnapshot(tb TestBed) *Snapshot {
+	id := uuid.New().String()
+	return &Snapshot{
+		ID:          fmt.Sprintf("%v", id),
+		CTS:         int(time.Now().Unix()),
+		TestBedID:   tb.ID,
+		TestBedName: tb.Name,
+		Status:      StatusInProgress,
+		Owner:       tb.Owner,
+		Team:        tb.Team,
+		Containers:  []SnapshotContainer{},
+	}
+}
+
+// NewWebhook creates a new Webhook document
+func NewWebhook() *Webhook {
+	id := uuid.New().String()
+	return &Webhook{
+		ID:  fmt.Sprintf("%v", id),
+		CTS: int(time.Now().Unix()),
+	}
+}
+
+// NewWebhookDelivery creates a pending delivery of an event to a webhook
+func NewWebhookDelivery(webhookID, event, testbedID, payload string) *WebhookDelivery {
+	id := uuid.New().String()
+	return &WebhookDelivery{
+		ID:        fmt.Sprintf("%v", id),
+		CTS:       int(time.Now().Unix()),
+		WebhookID: webhookID,
+		Event:     event,
+		TestBedID: testbedID,
+		Payload:   payload,
+		Status:    DeliveryPending,
+	}
+}
+
+// NewTestBedTemplate creates a new TestBedTemplate document
+func NewTestBedTemplate(name string, version int) *TestBedTemplate {
+	id := uuid.New().String()
+	return &TestBedTemplate{
+		ID:      fmt.Sprintf("%v", id),
+		CTS:     int(time.Now().Unix()),
+		Name:    name,
+		Version: version,
+	}
+}
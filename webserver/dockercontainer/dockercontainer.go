@@ -2,14 +2,26 @@
  * Infra Provisioner - dockercontainer.go
  *
  * dockercontainer.go wrapper is used to handle docker image and container related operations.
- *     Pulling Image
+ *     Pulling Image, reporting its progress
  *     List Images
  *     Create Container
  *     List Container
  *     Start Container
+ *     Wait for a Container to become healthy
  *     Stop Container
  *     Remove Container
  *     Inspect Container
+ *     Inspect Image
+ *     Read Container logs
+ *     Exec commands in a Container, collected or interactive
+ *     Copy files into and out of a Container
+ *     Remove Volume
+ *     Start an existing Container, Restart Container
+ *     Pause and Unpause Container
+ *     Commit Container, Remove Image
+ *     Kill Container with a signal, Disconnect and Connect Container networks
+ *     Run a sidecar Container in the network namespace of a Container
+ *     Check for "not found" errors
  *
  * API version: 1.0.0
  * Author - Vibhore
@@ -18,26 +30,51 @@
 package dockercontainer
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/docker/go-connections/nat"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 	"webserver/logging"
 )
 
 
 var (
 	results []string
-	// Due to incompatibility with latest client, pinning client version to 1.39 using [export DOCKER_API_VERSION='1.39']
-        cli, err = client.NewEnvClient()
+	cli *client.Client
+	err error
 	wg sync.WaitGroup
 )
 
+//Connect creates the docker client, host and apiVersion default to DOCKER_HOST and DOCKER_API_VERSION.
+//Due to incompatibility with latest client, the client version may have to be pinned, e.g. to 1.39
+func Connect(host, apiVersion string) error {
+	c, err := client.NewClientWithOpts(client.FromEnv)
+	if err == nil && host != "" {
+		err = client.WithHost(host)(c)
+	}
+	if err == nil && apiVersion != "" {
+		err = client.WithVersion(apiVersion)(c)
+	}
+	if err != nil {
+		return err
+	}
+	cli = c
+	return nil
+}
+
 
 func init() {
 	logging.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
@@ -69,51 +106,103 @@ func ListContainers(ctx context.Context) ([]types.Container) {
 	return containers
 }
 
+//PullMessage is a message of the image pull stream, e.g. status "Downloading" for layer ID
+type PullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
+}
+
+//PullProgress is called with the progress messages of an image pull
+type PullProgress func(imageName string, msg PullMessage)
+
 //PullDockerImages function is used to pull docker images concurrently. Goroutines are used.
-func PullDockerImages(ctx context.Context, imageName string, wg *sync.WaitGroup) {
+//The pull stream is read until the pull completes, progress may be nil.
+func PullDockerImages(ctx context.Context, imageName string, wg *sync.WaitGroup, progress PullProgress) error {
+	defer wg.Done()
         logging.Info.Println( "Pulling docker image ", imageName)
 
-	_, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
-	//reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
+	reader, err := cli.ImagePull(ctx, imageName, types.ImagePullOptions{})
         if err != nil {
 		logging.Error.Println(err)
-		err.Error()
+		return err
         }
+	defer reader.Close()
 
-	/*_, err = io.Copy(os.Stdout, reader)
-	if err != nil {
-		log.Fatal(err)
-	}*/
-	defer wg.Done()
+	dec := json.NewDecoder(reader)
+	for {
+		var msg PullMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			logging.Error.Println("Reading pull progress failed for ", imageName, ": ", err)
+			return err
+		}
+		if msg.Error != "" {
+			logging.Error.Println("Pull failed for ", imageName, ": ", msg.Error)
+			return errors.New(msg.Error)
+		}
+		if progress != nil {
+			progress(imageName, msg)
+		}
+	}
+	logging.Info.Println("Pulled docker image ", imageName)
+	return nil
 }
 
-//CreateDockerContainer function is used to create docker containers. Goroutines are used for concurrent container creation.
-func CreateDockerContainer(ctx context.Context, image string, tag string, hostport int) (container.ContainerCreateCreatedBody, nat.Port) {
-	logging.Info.Println("Inside CreateDockerContainer")
-	var hostname string
-	var port nat.Port
+//ContainerOptions are the optional settings of a container created by CreateDockerContainer
+type ContainerOptions struct {
+	Name   string // container and host name, <tag>-<image> when empty
+	Image  string // image reference, the service image when empty
+	Env    []string
+	Labels map[string]string
+	Mounts []mount.Mount
+
+	Memory   int64 // bytes, 0 for no limit
+	NanoCPUs int64 // CPU quota in units of 1e-9 CPUs, 0 for no limit
+}
+
+//ServicePort returns the container port a service image listens on, empty for unknown images
+func ServicePort(image string) nat.Port {
 	switch {
 		case image == "mongo":
-			port = "27017/tcp"
+			return "27017/tcp"
 		case image == "redis":
-			port = "6379/tcp"
+			return "6379/tcp"
 		case image == "zookeeper":
-			port = "2181/tcp"
+			return "2181/tcp"
 		case image == "kafka":
-			port = "9092/tcp"
+			return "9092/tcp"
 	}
+	return ""
+}
+
+//CreateDockerContainer function is used to create docker containers. Goroutines are used for concurrent container creation.
+func CreateDockerContainer(ctx context.Context, image string, tag string, hostport int, opts ContainerOptions) (container.ContainerCreateCreatedBody, nat.Port, error) {
+	logging.Info.Println("Inside CreateDockerContainer")
+	var hostname string
+	port := ServicePort(image)
 
 	hostname = tag + "-" + image
+	if opts.Name != "" {
+		hostname = opts.Name
+	}
 	logging.Info.Println(hostname)
 
 	hport := strconv.Itoa(hostport)
+	ref := image
+	if opts.Image != "" {
+		ref = opts.Image
+	}
 
 	resp, err := cli.ContainerCreate(ctx, &container.Config{
-	                Image: image,
-			Cmd:   []string{"tail", "-f", "/dev/null"},
+	                Image: ref,
 			Tty:   true,
 			Hostname: hostname,
 			WorkingDir: "/root/",
+			Env: opts.Env,
+			Labels: opts.Labels,
 			ExposedPorts: nat.PortSet{
 				port: struct{}{},
 			},
@@ -127,18 +216,22 @@ func CreateDockerContainer(ctx context.Context, image string, tag string, hostpo
 					},
 				},
 			},
+			Mounts: opts.Mounts,
+			Resources: container.Resources{
+				Memory:   opts.Memory,
+				NanoCPUs: opts.NanoCPUs,
+			},
 		}, nil, hostname)
 	if err != nil {
-		logging.Error.Println("Container creation failed for container ")
-                panic(err)
-	} else {
-		logging.Info.Println("Container created successfully for container ", resp.ID)
+		logging.Error.Println("Container creation failed for container ", hostname)
+		return resp, port, err
 	}
-	return resp, port
+	logging.Info.Println("Container created successfully for container ", resp.ID)
+	return resp, port, nil
 }
 
 //StartContainer function is used to start a container
-func StartContainer(ctx context.Context, resp container.ContainerCreateCreatedBody) {
+func StartContainer(ctx context.Context, resp container.ContainerCreateCreatedBody) error {
 	logging.Info.Println("Inside Start Container")
 
 	err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
@@ -148,6 +241,37 @@ func StartContainer(ctx context.Context, resp container.ContainerCreateCreatedBo
 	} else {
 		logging.Info.Println("Container start successful for container : ", resp.ID)
 	}
+	return err
+}
+
+//WaitHealthy function waits until a container is running and, if the image defines a health check, healthy
+func WaitHealthy(ctx context.Context, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		inspectData, err := cli.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		state := inspectData.State
+		switch {
+		case state == nil:
+		case state.Status == "exited" || state.Status == "dead":
+			return fmt.Errorf("container %v %v with exit code %v", id, state.Status, state.ExitCode)
+		case state.Health != nil && state.Health.Status == "unhealthy":
+			return errors.New("container " + id + " is unhealthy")
+		case state.Running && (state.Health == nil || state.Health.Status == "healthy"):
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("container %v not healthy after %v", id, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
 }
 
 //InspectContainer function is used to inspect a container
@@ -187,3 +311,329 @@ func RemoveContainer(ctx context.Context, resp string) error {
 	}
 	return err
 }
+
+//InspectImage function is used to inspect an image, e.g. to resolve the repo digest a container was created from
+func InspectImage(ctx context.Context, image string) (types.ImageInspect, error) {
+	inspectData, _, err := cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		logging.Error.Println("Inspect command failed for the image ", image)
+	}
+	return inspectData, err
+}
+
+//LogOptions selects the output returned by ContainerLogs
+type LogOptions struct {
+	Tail       string // number of lines from the end, or "all"
+	Since      string // unix timestamp or duration relative to now, e.g. 10m
+	Timestamps bool
+	Follow     bool
+}
+
+//ContainerLogs function returns the combined stdout and stderr of a container. With Follow the reader
+//keeps returning output until the container stops or ctx is cancelled. The caller closes the reader.
+func ContainerLogs(ctx context.Context, id string, opts LogOptions) (io.ReadCloser, error) {
+	inspectData, err := cli.ContainerInspect(ctx, id)
+	if err != nil {
+		logging.Error.Println("Inspect command failed for the container ", id)
+		return nil, err
+	}
+
+	reader, err := cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       opts.Tail,
+		Since:      opts.Since,
+		Timestamps: opts.Timestamps,
+		Follow:     opts.Follow,
+	})
+	if err != nil {
+		logging.Error.Println("Reading logs failed for the container ", id)
+		return nil, err
+	}
+	if inspectData.Config != nil && inspectData.Config.Tty {
+		return reader, nil
+	}
+
+	// Without a TTY stdout and stderr are multiplexed into one stream
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, reader)
+		reader.Close()
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+//ExecResult is the outcome of a command run by ExecRun
+type ExecResult struct {
+	Stdout    []byte
+	Stderr    []byte
+	ExitCode  int
+	Truncated bool // output beyond the limit of ExecRun was discarded
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the rest
+type limitedBuffer struct {
+	bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+//ExecRun function runs a command in a container and waits for it, keeping at most maxOutput bytes of
+//stdout and of stderr. stdin may be nil. When ctx ends first the output so far is returned with ctx.Err().
+func ExecRun(ctx context.Context, id string, cmd, env []string, workdir string, stdin io.Reader, maxOutput int) (ExecResult, error) {
+	var result ExecResult
+	execID, resp, err := execStart(ctx, id, types.ExecConfig{
+		Cmd:          cmd,
+		Env:          env,
+		WorkingDir:   workdir,
+		AttachStdin:  stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return result, err
+	}
+	defer resp.Close()
+
+	if stdin != nil {
+		go func() {
+			io.Copy(resp.Conn, stdin)
+			resp.CloseWrite()
+		}()
+	}
+
+	stdout := &limitedBuffer{max: maxOutput}
+	stderr := &limitedBuffer{max: maxOutput}
+	done := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, resp.Reader)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		resp.Close()
+		<-done
+		err = ctx.Err()
+	}
+	result.Stdout, result.Stderr = stdout.Bytes(), stderr.Bytes()
+	result.Truncated = stdout.truncated || stderr.truncated
+	if err != nil {
+		return result, err
+	}
+
+	result.ExitCode, _, err = ExecExitCode(ctx, execID)
+	return result, err
+}
+
+//ExecAttach function starts an interactive command in a container. The caller writes stdin to and reads
+//the output from the returned connection, multiplexed as for ContainerLogs unless tty is set, and closes it.
+func ExecAttach(ctx context.Context, id string, cmd []string, tty bool) (string, types.HijackedResponse, error) {
+	return execStart(ctx, id, types.ExecConfig{
+		Cmd:          cmd,
+		Tty:          tty,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+}
+
+// execStart creates an exec instance and attaches to it, which starts the command
+func execStart(ctx context.Context, id string, config types.ExecConfig) (string, types.HijackedResponse, error) {
+	created, err := cli.ContainerExecCreate(ctx, id, config)
+	if err != nil {
+		logging.Error.Println("Exec create failed for the container ", id)
+		return "", types.HijackedResponse{}, err
+	}
+	resp, err := cli.ContainerExecAttach(ctx, created.ID, types.ExecStartCheck{Tty: config.Tty})
+	if err != nil {
+		logging.Error.Println("Exec attach failed for the container ", id)
+		return "", resp, err
+	}
+	logging.Info.Println("Started exec ", created.ID, " in container ", id, ": ", config.Cmd)
+	return created.ID, resp, nil
+}
+
+//ExecResize function resizes the TTY of an interactive exec
+func ExecResize(ctx context.Context, execID string, height, width uint) error {
+	return cli.ContainerExecResize(ctx, execID, types.ResizeOptions{Height: height, Width: width})
+}
+
+//ExecExitCode function returns the exit code of an exec and whether it is still running
+func ExecExitCode(ctx context.Context, execID string) (int, bool, error) {
+	inspectData, err := cli.ContainerExecInspect(ctx, execID)
+	if err != nil {
+		return 0, false, err
+	}
+	return inspectData.ExitCode, inspectData.Running, nil
+}
+
+//CopyToContainer function extracts a tar archive, optionally compressed, into dir of a container.
+//dir must exist in the container.
+func CopyToContainer(ctx context.Context, id, dir string, archive io.Reader) error {
+	err := cli.CopyToContainer(ctx, id, dir, archive, types.CopyToContainerOptions{})
+	if err != nil {
+		logging.Error.Println("Copy to ", dir, " failed for the container ", id)
+	}
+	return err
+}
+
+//CopyFromContainer function returns a tar archive of a file or directory of a container, which may be stopped.
+//The caller closes the reader.
+func CopyFromContainer(ctx context.Context, id, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	reader, stat, err := cli.CopyFromContainer(ctx, id, srcPath)
+	if err != nil {
+		logging.Error.Println("Copy of ", srcPath, " failed for the container ", id)
+	}
+	return reader, stat, err
+}
+
+//IsNotFound reports whether err was returned for a container or image that does not exist
+func IsNotFound(err error) bool {
+	return client.IsErrNotFound(err)
+}
+
+//RemoveVolume removes a named volume, it fails while a container still uses the volume
+func RemoveVolume(ctx context.Context, name string) error {
+	logging.Info.Println("Removing volume ", name)
+	if err := cli.VolumeRemove(ctx, name, false); err != nil {
+		logging.Error.Println("Volume removal failed for ", name, ": ", err)
+		return err
+	}
+	return nil
+}
+
+//StartContainerByName starts an existing container, e.g. a stopped one
+func StartContainerByName(ctx context.Context, name string) error {
+	logging.Info.Println("Starting container ", name)
+	return cli.ContainerStart(ctx, name, types.ContainerStartOptions{})
+}
+
+//RestartContainer stops a container, with the default timeout, and starts it again
+func RestartContainer(ctx context.Context, resp string) error {
+	logging.Info.Println("Restarting container ", resp)
+	return cli.ContainerRestart(ctx, resp, nil)
+}
+
+//PauseContainer freezes the processes of a container
+func PauseContainer(ctx context.Context, id string) error {
+	logging.Info.Println("Pausing container ", id)
+	return cli.ContainerPause(ctx, id)
+}
+
+//UnpauseContainer resumes the processes of a paused container
+func UnpauseContainer(ctx context.Context, id string) error {
+	logging.Info.Println("Unpausing container ", id)
+	return cli.ContainerUnpause(ctx, id)
+}
+
+//CommitContainer stores the filesystem of a container as the image ref and returns the image id.
+//Volumes are not part of the image.
+func CommitContainer(ctx context.Context, id string, ref string) (string, error) {
+	logging.Info.Println("Committing container ", id, " as ", ref)
+	resp, err := cli.ContainerCommit(ctx, id, types.ContainerCommitOptions{Reference: ref, Pause: true})
+	if err != nil {
+		logging.Error.Println("Commit failed for container ", id, ": ", err)
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+//RemoveImage removes an image reference, the image is deleted once no reference is left
+func RemoveImage(ctx context.Context, ref string) error {
+	logging.Info.Println("Removing image ", ref)
+	_, err := cli.ImageRemove(ctx, ref, types.ImageRemoveOptions{PruneChildren: true})
+	return err
+}
+
+//KillContainer sends a signal to the main process of a container, e.g. SIGKILL
+func KillContainer(ctx context.Context, id string, signal string) error {
+	logging.Info.Println("Sending ", signal, " to container ", id)
+	return cli.ContainerKill(ctx, id, signal)
+}
+
+//DisconnectNetwork disconnects a container from a network, force also disconnects stopped containers
+func DisconnectNetwork(ctx context.Context, network, id string) error {
+	logging.Info.Println("Disconnecting container ", id, " from network ", network)
+	return cli.NetworkDisconnect(ctx, network, id, true)
+}
+
+//ConnectNetwork connects a container to a network
+func ConnectNetwork(ctx context.Context, network, id string) error {
+	logging.Info.Println("Connecting container ", id, " to network ", network)
+	return cli.NetworkConnect(ctx, network, id, nil)
+}
+
+//HostInfo returns the resources and container counts of the docker host
+func HostInfo(ctx context.Context) (types.Info, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		logging.Error.Println("Info command failed: ", err)
+	}
+	return info, err
+}
+
+//RunSidecar runs cmd in a short lived container sharing the network namespace of the container id,
+//with the NET_ADMIN capability, e.g. to shape its traffic with tc. The image is pulled when it is not
+//on the host. It waits for the command and returns its output, a non zero exit code is an error.
+func RunSidecar(ctx context.Context, id string, image string, cmd []string) (string, error) {
+	if _, _, err := cli.ImageInspectWithRaw(ctx, image); err != nil {
+		var pullWg sync.WaitGroup
+		pullWg.Add(1)
+		if err := PullDockerImages(ctx, image, &pullWg, nil); err != nil {
+			return "", err
+		}
+	}
+
+	hostname := id + "-sidecar-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	resp, err := cli.ContainerCreate(ctx, &container.Config{
+			Image:      image,
+			Entrypoint: cmd[:1],
+			Cmd:        cmd[1:],
+		},
+		&container.HostConfig{
+			NetworkMode: container.NetworkMode("container:" + id),
+			CapAdd:      []string{"NET_ADMIN"},
+		}, nil, hostname)
+	if err != nil {
+		logging.Error.Println("Sidecar creation failed for container ", id, ": ", err)
+		return "", err
+	}
+	defer cli.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+
+	statusCh, errCh := cli.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+	if err := cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		logging.Error.Println("Sidecar start failed for container ", id, ": ", err)
+		return "", err
+	}
+	var exitCode int64
+	select {
+	case status := <-statusCh:
+		exitCode = status.StatusCode
+	case err := <-errCh:
+		return "", err
+	}
+
+	var output bytes.Buffer
+	if reader, err := cli.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{ShowStdout: true, ShowStderr: true}); err == nil {
+		stdcopy.StdCopy(&output, &output, reader)
+		reader.Close()
+	}
+	if exitCode != 0 {
+		return output.String(), fmt.Errorf("sidecar %v exited with %v: %v", cmd, exitCode, output.String())
+	}
+	return output.String(), nil
+}
@@ -0,0 +1,136 @@
+/*
+ * events.go publishes testbed lifecycle events.
+ *
+ * Events are stored in the testbedevent collection, so that a client reconnecting with
+ * Last-Event-ID can replay what it missed, and handed to the subscribers of the testbed.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"webserver/db"
+	"webserver/logging"
+)
+
+// Event types
+const (
+	PullStarted       = "pull.started"
+	PullProgress      = "pull.progress"
+	PullDone          = "pull.done"
+	ContainerCreated  = "container.created"
+	ContainerStarted  = "container.started"
+	ContainerHealthy  = "container.healthy"
+	ContainerFailed   = "container.failed"
+	ContainerStopped  = "container.stopped"
+	ContainerPaused   = "container.paused"
+	ContainerUnpaused = "container.unpaused"
+	SeedStarted       = "seed.started"
+	SeedDone          = "seed.done"
+	SeedFailed        = "seed.failed"
+	SnapshotDone      = "snapshot.done"
+	SnapshotFailed    = "snapshot.failed"
+	ServiceScaled     = "service.scaled"
+	FaultInjected     = "fault.injected"
+	FaultHealed       = "fault.healed"
+	FaultFailed       = "fault.failed"
+	StatusChanged     = "testbed.status"
+)
+
+// subscriberBuffer is the number of events a slow subscriber may lag behind before its subscription is closed
+const subscriberBuffer = 64
+
+// Broker hands published events to the subscribers of a testbed
+type Broker struct {
+	mu      sync.Mutex
+	lastSeq int64
+	subs    map[string]map[chan db.TestBedEvent]struct{}
+}
+
+//Default is the broker used by the server
+var Default = NewBroker()
+
+//NewBroker creates a broker without subscribers
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string]map[chan db.TestBedEvent]struct{})}
+}
+
+//Publish stores an event and hands it to the subscribers of its testbed and to those of all testbeds
+func (b *Broker) Publish(ctx context.Context, event db.TestBedEvent) db.TestBedEvent {
+	b.mu.Lock()
+	event.Time = time.Now().UTC()
+	event.Seq = event.Time.UnixNano()
+	if event.Seq <= b.lastSeq {
+		event.Seq = b.lastSeq + 1
+	}
+	b.lastSeq = event.Seq
+	b.mu.Unlock()
+
+	if err := db.InsertTestBedEvent(ctx, &event); err != nil {
+		logging.Error.Println("Could not store event ", event.Type, " of testbed ", event.TestBedID, ": ", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, key := range []string{event.TestBedID, ""} {
+		for ch := range b.subs[key] {
+			select {
+			case ch <- event:
+			default:
+				// Closing rather than dropping the event, the subscriber resumes from the stored events
+				logging.Warning.Println("Subscriber is too slow, closing its subscription at event ", event.Seq, " of testbed ", event.TestBedID)
+				b.unsubscribe(key, ch)
+				close(ch)
+			}
+		}
+	}
+	return event
+}
+
+//Subscribe returns the events published for a testbed from now on, an empty testbedID subscribes
+//to the events of all testbeds. The returned function cancels the subscription. The channel is closed
+//when the subscriber lags more than subscriberBuffer events behind, it has to subscribe again and
+//read what it missed from the store.
+func (b *Broker) Subscribe(testbedID string) (<-chan db.TestBedEvent, func()) {
+	ch := make(chan db.TestBedEvent, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[testbedID] == nil {
+		b.subs[testbedID] = make(map[chan db.TestBedEvent]struct{})
+	}
+	b.subs[testbedID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			b.unsubscribe(testbedID, ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+// unsubscribe removes a subscription, b.mu is held
+func (b *Broker) unsubscribe(testbedID string, ch chan db.TestBedEvent) {
+	delete(b.subs[testbedID], ch)
+	if len(b.subs[testbedID]) == 0 {
+		delete(b.subs, testbedID)
+	}
+}
+
+//Publish publishes an event on the default broker
+func Publish(ctx context.Context, event db.TestBedEvent) db.TestBedEvent {
+	return Default.Publish(ctx, event)
+}
+
+//Subscribe subscribes to the default broker
+func Subscribe(testbedID string) (<-chan db.TestBedEvent, func()) {
+	return Default.Subscribe(testbedID)
+}
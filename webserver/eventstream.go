@@ -0,0 +1,262 @@
+/*
+ * eventstream.go reports testbed progress without polling.
+ *
+ *     GET /api/v1/testbeds/{id}/events                     streams lifecycle events as Server-Sent Events
+ *     GET /api/v1/testbeds/{id}?wait=ready&timeout=120s    holds the response until the testbed is settled
+ *
+ * Provisioning publishes its steps through setTestBedStatus, publishEvent and failContainer,
+ * events are kept in the testbedevent collection so that reconnecting clients can resume
+ * with Last-Event-ID. The stream of a client lagging too far behind is ended (see events.go),
+ * it reconnects and resumes from there.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// containerHealthyTimeout is how long a started container may take to become healthy, set from the config
+var containerHealthyTimeout time.Duration
+
+// pullProgressInterval throttles the pull.progress events of an image
+const pullProgressInterval = 2 * time.Second
+
+// sseKeepAlive is the interval of comment lines keeping idle event streams open through proxies
+const sseKeepAlive = 15 * time.Second
+
+// Bounds of the ?timeout of a long-poll
+const (
+	defaultWaitTimeout = 120 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// publishEvent publishes a lifecycle event of a testbed container
+func publishEvent(tbid, eventType, container, message string) {
+	events.Publish(ctx, db.TestBedEvent{TestBedID: tbid, Type: eventType, Container: container, Message: message})
+}
+
+// setTestBedStatus stores the status of a testbed and publishes the transition
+func setTestBedStatus(tbid, status, message string) error {
+	if _, err := db.UpdateTestBedStatus(ctx, tbid, status); err != nil {
+		logging.Error.Println(err)
+		return err
+	}
+	events.Publish(ctx, db.TestBedEvent{TestBedID: tbid, Type: events.StatusChanged, Status: status, Message: message})
+	// Queued testbeds may fit now
+	wakeAdmission()
+	return nil
+}
+
+// failContainer reports a container which could not be provisioned and fails its testbed
+func failContainer(tbid, container, message string) {
+	logging.Error.Println("Provisioning of ", container, " in testbed ", tbid, " failed: ", message)
+	publishEvent(tbid, events.ContainerFailed, container, message)
+	setTestBedStatus(tbid, db.StatusFailed, container+": "+message)
+}
+
+// isSettled reports whether a testbed status will not change without a client request
+func isSettled(status string) bool {
+	switch status {
+	case db.StatusCompleted, db.StatusFailed, db.StatusStopped, db.StatusPaused, db.StatusExpired, db.StatusDeleted:
+		return true
+	}
+	return false
+}
+
+// pullProgress turns the progress messages of the image pulls of a testbed into throttled events
+type pullProgress struct {
+	tbid string
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newPullProgress(tbid string) *pullProgress {
+	return &pullProgress{tbid: tbid, last: make(map[string]time.Time)}
+}
+
+// report publishes a pull message of the image of a service, called concurrently for the services of the testbed
+func (p *pullProgress) report(service string, msg dockercontainer.PullMessage) {
+	p.mu.Lock()
+	if time.Since(p.last[service]) < pullProgressInterval {
+		p.mu.Unlock()
+		return
+	}
+	p.last[service] = time.Now()
+	p.mu.Unlock()
+
+	message := msg.Status
+	if msg.ID != "" {
+		message = msg.ID + ": " + message
+	}
+	if msg.Progress != "" {
+		message += " " + msg.Progress
+	}
+	publishEvent(p.tbid, events.PullProgress, service, message)
+}
+
+/*
+  Handler for /testbeds/{id}/events call
+
+  Streams the events of a testbed as text/event-stream. Stored events are replayed first, starting
+  after the Last-Event-ID header (or ?since) when given, then new events follow as they are published.
+  The stream stays open until the client disconnects.
+*/
+func eventshandler(w http.ResponseWriter, r *http.Request) {
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("since")
+	}
+	var afterSeq int64
+	if after != "" {
+		var err error
+		if afterSeq, err = strconv.ParseInt(after, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid event id",
+				fieldError{Field: "Last-Event-ID", Message: "must be the id of a previous event"})
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Streaming is not supported")
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+
+	// Subscribe before reading the stored events, so that nothing published in between is lost
+	sub, cancel := events.Subscribe(tb.ID)
+	defer cancel()
+
+	stored, err := db.GetTestBedEvents(ctx, tb.ID, afterSeq)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not read events of testbed "+tb.ID)
+		return
+	}
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	lastSeq := afterSeq
+	for _, event := range stored {
+		if err := writeEvent(w, event); err != nil {
+			return
+		}
+		lastSeq = event.Seq
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-sub:
+			if !ok {
+				logging.Warning.Println("Ending the event stream of testbed ", tb.ID, " at event ", lastSeq, ", the client is too slow")
+				return
+			}
+			if event.Seq <= lastSeq {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				return
+			}
+			lastSeq = event.Seq
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event db.TestBedEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	return err
+}
+
+// waitTimeout parses the ?timeout of a long-poll, either a duration such as 120s or a number of seconds
+func waitTimeout(v string) (time.Duration, error) {
+	if v == "" {
+		return defaultWaitTimeout, nil
+	}
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("must be a duration such as 120s")
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout <= 0 || timeout > maxWaitTimeout {
+		return 0, fmt.Errorf("must be between 1s and %v", maxWaitTimeout)
+	}
+	return timeout, nil
+}
+
+// waitForTestBed holds a ?wait=ready request until the testbed is settled, the timeout expires
+// or the client goes away, then answers with the testbed as it is at that point
+func waitForTestBed(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	sub, cancel := events.Subscribe(mux.Vars(r)["id"])
+	defer func() { cancel() }()
+
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !isSettled(tb.Status) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			logging.Info.Println("Wait for testbed ", tb.ID, " timed out in status ", tb.Status)
+			if tb, ok = loadTestBed(w, r, accessRead); ok {
+				writeJSON(w, http.StatusOK, tb)
+			}
+			return
+		case event, subscribed := <-sub:
+			if !subscribed {
+				// Too slow for the events, subscribe again and check the status missed meanwhile
+				sub, cancel = events.Subscribe(tb.ID)
+			} else if event.Type != events.StatusChanged || !isSettled(event.Status) {
+				continue
+			}
+			if tb, ok = loadTestBed(w, r, accessRead); !ok {
+				return
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, tb)
+}
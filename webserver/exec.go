@@ -0,0 +1,255 @@
+/*
+ * exec.go runs commands inside testbed containers, so that tests can reset their data
+ * (mongo --eval, redis-cli FLUSHALL) without access to the docker socket.
+ *
+ *     POST /api/v1/testbeds/{id}/containers/{name}/exec       runs a command, returns stdout, stderr and exit code
+ *     GET  /api/v1/testbeds/{id}/containers/{name}/exec/ws    interactive command over a WebSocket
+ *
+ * WebSocket protocol: binary frames from the client are stdin, text frames are JSON control
+ * messages {"type": "resize", "rows": 40, "cols": 120}. Output is sent as binary frames, the
+ * exit code as a final text frame {"type": "exit", "exit_code": 0} before the socket is closed.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gorilla/websocket"
+	"webserver/dockercontainer"
+	"webserver/logging"
+)
+
+// maxExecOutput limits stdout and stderr of a collected exec, each
+const maxExecOutput = 1 << 20
+
+// Bounds of the timeout of a collected exec
+const (
+	defaultExecTimeout = 60
+	maxExecTimeout     = 600
+)
+
+var execUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+//execRequestBody is the request struct of a collected exec
+type execRequestBody struct {
+	Cmd            []string `json:"cmd"`
+	Env            []string `json:"env"`
+	WorkDir        string   `json:"workdir"`
+	Stdin          string   `json:"stdin"`
+	TimeoutSeconds int      `json:"timeout_seconds"`
+}
+
+//execResp is the response of a collected exec
+type execResp struct {
+	ExitCode  int    `json:"exit_code"`
+	Stdout    string `json:"stdout"`
+	Stderr    string `json:"stderr"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+//execControl is a JSON control message of the exec WebSocket
+type execControl struct {
+	Type     string `json:"type"`
+	Rows     uint   `json:"rows,omitempty"`
+	Cols     uint   `json:"cols,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+/*
+  Handler for POST /testbeds/{id}/containers/{name}/exec call
+
+  Runs cmd in the container and answers once it exits. A command which does not exit within
+  timeout_seconds (default 60, at most 600) is answered with 504 and its output so far is discarded.
+*/
+func exechandler(w http.ResponseWriter, r *http.Request) {
+	body := execRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid exec body: "+err.Error())
+		return
+	}
+	if len(body.Cmd) == 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid exec request", fieldError{Field: "cmd", Message: "must not be empty"})
+		return
+	}
+	if body.TimeoutSeconds == 0 {
+		body.TimeoutSeconds = defaultExecTimeout
+	} else if body.TimeoutSeconds < 0 || body.TimeoutSeconds > maxExecTimeout {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid exec request",
+			fieldError{Field: "timeout_seconds", Message: "must be between 1 and " + strconv.Itoa(maxExecTimeout)})
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+
+	var stdin io.Reader
+	if body.Stdin != "" {
+		stdin = strings.NewReader(body.Stdin)
+	}
+
+	execCtx, cancel := context.WithTimeout(r.Context(), time.Duration(body.TimeoutSeconds)*time.Second)
+	defer cancel()
+	result, err := dockercontainer.ExecRun(execCtx, name, body.Cmd, body.Env, body.WorkDir, stdin, maxExecOutput)
+	switch {
+	case err == context.DeadlineExceeded:
+		writeError(w, http.StatusGatewayTimeout, errCodeTimeout, "Command did not exit within "+strconv.Itoa(body.TimeoutSeconds)+"s")
+		return
+	case dockercontainer.IsNotFound(err):
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" does not exist on the host")
+		return
+	case err != nil:
+		logging.Error.Println(err)
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not run command in "+name+": "+err.Error())
+		return
+	}
+
+	logging.Info.Println("Exec in ", name, " exited with ", result.ExitCode)
+	writeJSON(w, http.StatusOK, execResp{
+		ExitCode:  result.ExitCode,
+		Stdout:    string(result.Stdout),
+		Stderr:    string(result.Stderr),
+		Truncated: result.Truncated,
+	})
+}
+
+/*
+  Handler for GET /testbeds/{id}/containers/{name}/exec/ws call
+
+  Upgrades to a WebSocket running ?cmd (repeated for each argument, default sh) in the container,
+  with a TTY unless tty=false.
+*/
+func execwshandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cmd := query["cmd"]
+	if len(cmd) == 0 {
+		cmd = []string{"sh"}
+	}
+	tty := true
+	if v := query.Get("tty"); v != "" {
+		var err error
+		if tty, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid exec request", fieldError{Field: "tty", Message: "must be true or false"})
+			return
+		}
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	name, ok := loadInstance(w, r, tb)
+	if !ok {
+		return
+	}
+
+	execCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	execID, resp, err := dockercontainer.ExecAttach(execCtx, name, cmd, tty)
+	if dockercontainer.IsNotFound(err) {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "Container "+name+" does not exist on the host")
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusBadGateway, errCodeDocker, "Could not run command in "+name+": "+err.Error())
+		return
+	}
+	defer resp.Close()
+
+	conn, err := execUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has written the error response
+		logging.Error.Println(err)
+		return
+	}
+	defer conn.Close()
+	logging.Info.Println("Interactive exec ", execID, " in ", name)
+
+	out := &wsWriter{conn: conn}
+
+	// Client to container: stdin and resize messages. Once the client is gone the
+	// connection to the exec is closed, which ends the output copy below.
+	go func() {
+		defer resp.Close()
+		for {
+			msgType, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if msgType == websocket.BinaryMessage {
+				if _, err := resp.Conn.Write(data); err != nil {
+					return
+				}
+				continue
+			}
+			ctl := execControl{}
+			if err := json.Unmarshal(data, &ctl); err == nil && ctl.Type == "resize" {
+				if err := dockercontainer.ExecResize(execCtx, execID, ctl.Rows, ctl.Cols); err != nil {
+					logging.Warning.Println("Resize of exec ", execID, " failed: ", err)
+				}
+			}
+		}
+	}()
+
+	// Container to client: output until the command exits
+	if tty {
+		io.Copy(out, resp.Reader)
+	} else {
+		stdcopy.StdCopy(out, out, resp.Reader)
+	}
+
+	exitCode, _, err := dockercontainer.ExecExitCode(execCtx, execID)
+	if err != nil {
+		logging.Error.Println(err)
+	}
+	out.control(execControl{Type: "exit", ExitCode: exitCode})
+	out.close()
+}
+
+// wsWriter sends output as binary WebSocket frames, serialising writes to the connection
+type wsWriter struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (ws *wsWriter) Write(p []byte) (int, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ws.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (ws *wsWriter) control(ctl execControl) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ws.conn.WriteJSON(ctl); err != nil {
+		logging.Warning.Println(err)
+	}
+}
+
+func (ws *wsWriter) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	ws.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+}
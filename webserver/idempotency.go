@@ -0,0 +1,80 @@
+/*
+ * idempotency.go makes testbed creation safe to retry.
+ *
+ * A client sends an Idempotency-Key header (or client_request_id in the body) with createenv.
+ * The key is stored with the testbed, a repeated request of the same owner with the same key within
+ * idempotencyWindow returns the original testbed instead of provisioning again. Keys are scoped by
+ * owner, different owners may use the same key without seeing each other's testbeds.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"webserver/db"
+	"webserver/logging"
+)
+
+// idempotencyWindow is how long a key keeps mapping to the testbed it created
+const idempotencyWindow = 24 * time.Hour
+
+// maxIdempotencyKeyLength limits the size of client supplied keys
+const maxIdempotencyKeyLength = 255
+
+// idempotencyKey returns the key of a createenv request, the header takes precedence over the body field
+func idempotencyKey(r *http.Request, post postRequestBody) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return post.ClientRequestID
+}
+
+// requestFingerprint hashes the parts of a createenv request which decide what gets provisioned
+func requestFingerprint(post postRequestBody) string {
+	post.ClientRequestID = ""
+	data, _ := json.Marshal(post)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// findIdempotentTestBed returns the testbed the owner created with key within the idempotency window.
+// A key older than the window is released so that it provisions a new testbed.
+func findIdempotentTestBed(owner, key string) (db.TestBed, bool, error) {
+	tb, err := db.GetTestBedFromIdempotencyKey(ctx, owner, key)
+	if err == db.ErrNoMatchDocument {
+		return tb, false, nil
+	} else if err != nil {
+		return tb, false, err
+	}
+
+	if time.Since(time.Unix(int64(tb.CTS), 0)) > idempotencyWindow {
+		logging.Info.Println("Idempotency key expired, releasing it from testbed ", tb.ID)
+		if _, err := db.ReleaseIdempotencyKey(ctx, tb.ID); err != nil {
+			return tb, false, err
+		}
+		return tb, false, nil
+	}
+	return tb, true, nil
+}
+
+// writeIdempotentReplay answers a retried createenv request with the testbed of the original request
+func writeIdempotentReplay(w http.ResponseWriter, tb db.TestBed, fingerprint string) {
+	if tb.IdempotencyHash != fingerprint {
+		writeError(w, http.StatusUnprocessableEntity, errCodeIdempotencyMismatch,
+			"Idempotency-Key was already used for a different request, testbed "+tb.ID)
+		return
+	}
+
+	logging.Info.Println("Replaying createenv for idempotency key ", tb.IdempotencyKey, " testbed ", tb.ID)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("location", "/api/v1/testbeds/"+tb.ID)
+	writeJSON(w, http.StatusAccepted, initResp{Status: tb.Status, RequestID: tb.ID})
+}
@@ -0,0 +1,166 @@
+/*
+ * lifecycle.go contains the lifecycle controls of testbeds and their containers.
+ * Supports
+ *     Stop, pause, unpause, start and restart every container of a testbed
+ *     Stop, pause, unpause, start and restart a single container of a testbed
+ *
+ * Stopped and paused testbeds keep their records and their port allocations in TestBedMeta, so that
+ * they come back on the same ports. The testbed status follows the containers: Stopped, Paused, or
+ * Completed once they run again. Started and restarted containers are waited on until healthy.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+//lifecycleAction is a docker operation applied to testbed containers
+type lifecycleAction struct {
+	name   string
+	run    func(ctx context.Context, name string) error
+	state  string // docker state in which the action is skipped, as the container is already there
+	status string // testbed status once every container went through the action
+	event  string
+	ready  bool // wait until the container is healthy
+}
+
+// Lifecycle actions of testbeds and containers
+var (
+	stopAction    = lifecycleAction{name: "stop", run: dockercontainer.StopContainer, state: "exited", status: db.StatusStopped, event: events.ContainerStopped}
+	pauseAction   = lifecycleAction{name: "pause", run: dockercontainer.PauseContainer, state: "paused", status: db.StatusPaused, event: events.ContainerPaused}
+	unpauseAction = lifecycleAction{name: "unpause", run: dockercontainer.UnpauseContainer, state: "running", status: db.StatusCompleted, event: events.ContainerUnpaused}
+	startAction   = lifecycleAction{name: "start", run: dockercontainer.StartContainerByName, state: "running", status: db.StatusCompleted, event: events.ContainerStarted, ready: true}
+	restartAction = lifecycleAction{name: "restart", run: dockercontainer.RestartContainer, status: db.StatusCompleted, event: events.ContainerStarted, ready: true}
+)
+
+// containerStatuses maps the docker state shared by all containers of a testbed to its status
+var containerStatuses = map[string]string{
+	"running": db.StatusCompleted,
+	"paused":  db.StatusPaused,
+	"exited":  db.StatusStopped,
+	"created": db.StatusStopped,
+}
+
+// testbedactionhandler returns the handler for POST /api/v1/testbeds/{id}/<action>, applying it to every container
+func testbedactionhandler(action lifecycleAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tb, ok := loadTestBed(w, r, accessOperate)
+		if !ok || !checkControllable(w, tb) {
+			return
+		}
+
+		var results []containerResult
+		var failed []fieldError
+		for _, cnt := range tb.Container {
+			res := runLifecycleAction(tb.ID, cnt, action)
+			results = append(results, res)
+			if !res.OK {
+				failed = append(failed, fieldError{Field: cnt.Image, Message: res.Error})
+			}
+		}
+
+		if len(failed) > 0 {
+			syncTestBedStatus(tb)
+			writeError(w, http.StatusInternalServerError, errCodeDocker, "Could not "+action.name+" every container of testbed "+tb.ID, failed...)
+			return
+		}
+
+		if err := setTestBedStatus(tb.ID, action.status, ""); err != nil {
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Containers went through "+action.name+" but testbed status could not be updated")
+			return
+		}
+		writeJSON(w, http.StatusOK, testbedActionResp{ID: tb.ID, Status: action.status, Containers: results})
+	}
+}
+
+// containeractionhandler returns the handler for POST /api/v1/testbeds/{id}/containers/{name}/<action>
+func containeractionhandler(action lifecycleAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tb, ok := loadTestBed(w, r, accessOperate)
+		if !ok || !checkControllable(w, tb) {
+			return
+		}
+		cnt, ok := loadContainer(w, r, tb)
+		if !ok {
+			return
+		}
+
+		res := runLifecycleAction(tb.ID, cnt, action)
+		syncTestBedStatus(tb)
+		if !res.OK {
+			writeError(w, http.StatusInternalServerError, errCodeDocker, res.Error)
+			return
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// checkControllable answers 409 for testbeds which are being provisioned or were torn down
+func checkControllable(w http.ResponseWriter, tb db.TestBed) bool {
+	switch tb.Status {
+	case db.StatusCompleted, db.StatusStopped, db.StatusPaused, db.StatusFailed:
+		return true
+	}
+	writeError(w, http.StatusConflict, errCodeConflict, "Testbed "+tb.ID+" is "+tb.Status)
+	return false
+}
+
+// runLifecycleAction applies an action to the instances of a testbed service and publishes it as testbed events
+func runLifecycleAction(testbedID string, cnt db.ContainerProp, action lifecycleAction) containerResult {
+	res := containerResult{Name: cnt.Image, OK: true}
+
+	for _, name := range instanceNames(testbedID, cnt) {
+		if action.state != "" && containerState(name) == action.state {
+			continue
+		}
+		err := action.run(ctx, name)
+		if err == nil && action.ready {
+			err = dockercontainer.WaitHealthy(ctx, name, containerHealthyTimeout)
+		}
+		if err != nil {
+			logging.Error.Println("Could not ", action.name, " container ", name, ": ", err)
+			res.OK = false
+			res.Error = err.Error()
+			publishEvent(testbedID, events.ContainerFailed, cnt.Image, action.name+" of "+name+" failed: "+err.Error())
+			return res
+		}
+		publishEvent(testbedID, action.event, cnt.Image, "Container "+name+" went through "+action.name)
+	}
+	return res
+}
+
+// syncTestBedStatus sets the status of a testbed from the state of its containers, once they all share one
+func syncTestBedStatus(tb db.TestBed) {
+	state := ""
+	for _, cnt := range tb.Container {
+		for _, name := range instanceNames(tb.ID, cnt) {
+			s := containerState(name)
+			if state != "" && s != state {
+				return
+			}
+			state = s
+		}
+	}
+	if status, ok := containerStatuses[state]; ok && status != tb.Status {
+		setTestBedStatus(tb.ID, status, "All containers are "+state)
+	}
+}
+
+// containerState returns the docker state of a container, e.g. running, or unknown if it cannot be inspected
+func containerState(name string) string {
+	inspectData := dockercontainer.InspectContainer(ctx, name)
+	if inspectData.ContainerJSONBase == nil || inspectData.State == nil {
+		return "unknown"
+	}
+	return inspectData.State.Status
+}
@@ -1,12 +1,35 @@
 /*
  * Main contains the logic to create routing based on Mux and their respective handling
  * Supports
- *     Get All Config (Not implemented for now)
+ *     Read the settings from a config file, the environment and flags, and dump them (see config.go)
  *     Create Environment
+ *     Seed datastore containers from inline files, archives or uploaded artifacts (see seed.go)
+ *     Mount named volumes, tmpfs and read-only binds into testbed containers (see volumes.go)
+ *     Snapshot testbeds and create testbeds from snapshots (see snapshots.go)
+ *     Clone a testbed, optionally with a copy of its data (see clone.go)
+ *     Stop, pause, unpause, start and restart testbeds and their containers (see lifecycle.go)
+ *     Scale a service within a running testbed (see scale.go)
+ *     Inject faults into testbed containers: kill, pause, network disconnect, latency and loss (see chaos.go)
+ *     Authenticate requests with API tokens or HMAC signatures (see auth.go)
+ *     Serve over TLS with rotating certificates, and authenticate client certificates (see tls.go)
+ *     Restrict testbeds to their owner, team and admins (see authz.go)
+ *     Limit the testbeds of owners, teams and the host, and tear down testbeds whose time to live elapsed (see quota.go)
+ *     Queue testbeds while the host is at capacity and admit them by priority (see queue.go)
  *     Get Environment based on tag
  *     Get Environment
  *     Stop a Container based on tag
+ *     Read or follow the logs of a testbed container (see containerlogs.go)
+ *     Exec commands in a testbed container, collected or over a WebSocket (see exec.go)
+ *     Copy files into and out of a testbed container (see containerfiles.go)
  *     Delete a Container based on tag
+ *     Export a testbed as docker-compose file
+ *     Stream testbed progress events (see eventstream.go)
+ *     Deliver testbed lifecycle events to webhooks (see webhooks.go)
+ *     Manage testbed templates and create testbeds from them (see templates.go)
+ *
+ * Routes are served under /api/v1 (see api.go and testbeds.go), the original
+ * routes are kept as deprecated aliases. Every route is described in openapi/spec.go,
+ * JSON request bodies are validated against it before reaching the handlers.
  *
  * Hard coded to support only Mongo and Redis images
  *
@@ -19,7 +42,9 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/docker/docker/api/types"
 	"github.com/gorilla/mux"
 	"io/ioutil"
 	"log"
@@ -30,28 +55,111 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
+	"webserver/compose"
 	"webserver/db"
 	"webserver/dockercontainer"
+	"webserver/events"
 	"webserver/logging"
 	"webserver/util"
+	"webserver/webhook"
 )
 
 var (
-	baseImageRegistry = "docker.io/library/"
+	// Registry the service images are pulled from, set from the config (see config.go)
+	baseImageRegistry string
 	ctx = context.Background()
 	mongoPortID string
+
+	// Services which can be provisioned, images are pulled from baseImageRegistry
+	supportedServices = []string{"mongo", "redis"}
+	testbedNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+	labelKeyRegexp    = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,63}$`)
 )
 
+// maxContainersPerTestBed limits the number of services of a single testbed
+const maxContainersPerTestBed = 10
+
+// maxPortAttempts bounds the search for a free port which is not allocated to a stopped testbed
+const maxPortAttempts = 20
+
 
 func newRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/", getallconfighandler).Methods("GET")
-	r.HandleFunc("/set/createenv", createenvhandler).Methods("POST")
-	r.HandleFunc("/get/getenv/{tag}", getenvbytaghandler).Methods("GET")
-	r.HandleFunc("/get/getenv", getenvhandler).Methods("GET")
-	r.HandleFunc("/update/stop/{tag}", stophandler).Methods("POST")
-	r.HandleFunc("/delete/container/{tag}", delhandler).Methods("DELETE","POST")
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	r.Use(extendUploadDeadline)
+	r.Use(authenticate)
+	r.Use(validateRequestBody)
+	r.HandleFunc("/", deprecated("/api/v1/config", adminOnly(confighandler))).Methods("GET")
+	r.HandleFunc("/openapi.json", openapihandler).Methods("GET")
+
+	v1 := r.PathPrefix("/api/v1").Subrouter()
+	v1.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	v1.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	v1.HandleFunc("/openapi.json", openapihandler).Methods("GET")
+	v1.HandleFunc("/testbeds", createenvhandler).Methods("POST")
+	v1.HandleFunc("/testbeds", listtestbedshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}", gettestbedhandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}", deletetestbedhandler).Methods("DELETE")
+	v1.HandleFunc("/testbeds/{id}/stop", testbedactionhandler(stopAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/pause", testbedactionhandler(pauseAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/unpause", testbedactionhandler(unpauseAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/start", testbedactionhandler(startAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/restart", testbedactionhandler(restartAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/compose", composehandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/events", eventshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/clone", clonetestbedhandler).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/snapshots", createsnapshothandler).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/snapshots", listsnapshotshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/services/{name}", scaleservicehandler).Methods("PATCH")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}", gettestbedcontainerhandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}", deletecontainerhandler).Methods("DELETE")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/stop", containeractionhandler(stopAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/pause", containeractionhandler(pauseAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/unpause", containeractionhandler(unpauseAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/start", containeractionhandler(startAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/restart", containeractionhandler(restartAction)).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/logs", containerlogshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/exec", exechandler).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/files", putcontainerfileshandler).Methods("PUT")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/files", getcontainerfileshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/exec/ws", execwshandler).Methods("GET")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/faults", injectfaulthandler).Methods("POST")
+	v1.HandleFunc("/testbeds/{id}/containers/{name}/faults", healfaulthandler).Methods("DELETE")
+	v1.HandleFunc("/testbeds/{id}/faults", listfaultshandler).Methods("GET")
+	v1.HandleFunc("/templates", createtemplatehandler).Methods("POST")
+	v1.HandleFunc("/templates", listtemplateshandler).Methods("GET")
+	v1.HandleFunc("/templates/{name}", gettemplatehandler).Methods("GET")
+	v1.HandleFunc("/templates/{name}", updatetemplatehandler).Methods("PUT")
+	v1.HandleFunc("/templates/{name}", deltemplatehandler).Methods("DELETE")
+	v1.HandleFunc("/containers", adminOnly(hostcontainershandler)).Methods("GET")
+	v1.HandleFunc("/queue", queuehandler).Methods("GET")
+	v1.HandleFunc("/config", adminOnly(confighandler)).Methods("GET")
+	v1.HandleFunc("/artifacts", createartifacthandler).Methods("POST")
+	v1.HandleFunc("/artifacts", listartifactshandler).Methods("GET")
+	v1.HandleFunc("/artifacts/{id}", getartifacthandler).Methods("GET")
+	v1.HandleFunc("/artifacts/{id}", deleteartifacthandler).Methods("DELETE")
+	v1.HandleFunc("/snapshots/{id}", getsnapshothandler).Methods("GET")
+	v1.HandleFunc("/snapshots/{id}", deletesnapshothandler).Methods("DELETE")
+	v1.HandleFunc("/webhooks", adminOnly(createwebhookhandler)).Methods("POST")
+	v1.HandleFunc("/webhooks", adminOnly(listwebhookshandler)).Methods("GET")
+	v1.HandleFunc("/webhooks/{id}", adminOnly(getwebhookhandler)).Methods("GET")
+	v1.HandleFunc("/webhooks/{id}", adminOnly(deletewebhookhandler)).Methods("DELETE")
+	v1.HandleFunc("/webhooks/{id}/deliveries", adminOnly(listwebhookdeliverieshandler)).Methods("GET")
+
+	// Deprecated aliases kept for existing clients, responses carry a Link to the /api/v1 successor
+	r.HandleFunc("/set/createenv", deprecated("/api/v1/testbeds", createenvhandler)).Methods("POST")
+	r.HandleFunc("/get/getenv/{tag}", deprecated("/api/v1/testbeds/{id}", getenvbytaghandler)).Methods("GET")
+	r.HandleFunc("/get/getenv", deprecated("/api/v1/containers", adminOnly(getenvhandler))).Methods("GET")
+	r.HandleFunc("/update/stop/{tag}", deprecated("/api/v1/testbeds/{id}/stop", adminOnly(stophandler))).Methods("POST")
+	r.HandleFunc("/delete/container/{id}", deprecated("/api/v1/testbeds/{id}", deletetestbedhandler)).Methods("DELETE","POST")
+	r.HandleFunc("/testbeds", deprecated("/api/v1/testbeds", createenvhandler)).Methods("POST")
+	r.HandleFunc("/testbeds/{id}/compose", deprecated("/api/v1/testbeds/{id}/compose", composehandler)).Methods("GET")
+	r.HandleFunc("/templates", deprecated("/api/v1/templates", createtemplatehandler)).Methods("POST")
+	r.HandleFunc("/templates", deprecated("/api/v1/templates", listtemplateshandler)).Methods("GET")
+	r.HandleFunc("/templates/{name}", deprecated("/api/v1/templates/{name}", gettemplatehandler)).Methods("GET")
+	r.HandleFunc("/templates/{name}", deprecated("/api/v1/templates/{name}", updatetemplatehandler)).Methods("PUT")
+	r.HandleFunc("/templates/{name}", deprecated("/api/v1/templates/{name}", deltemplatehandler)).Methods("DELETE")
 	return r
 }
 
@@ -60,30 +168,146 @@ func newRouter() *mux.Router {
 type initResp struct {
 	Status    string `json:"status"`
 	RequestID string `json:"requestid"`
+
+	// Admission of a queued testbed (see queue.go)
+	QueuePosition int `json:"queue_position,omitempty"`
+	ETASeconds    int `json:"eta_seconds,omitempty"`
 }
 
 //requestData is the request struct
 type postRequestBody struct {
-	Name       string   `json:"name"`
-	Containers []string `json:"containers"`
+	Name            string            `json:"name"`
+	Containers      []string          `json:"containers"`
+	ClientRequestID string            `json:"client_request_id,omitempty"`
+	Owner           string            `json:"owner,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+
+	// Seed steps per service, run once the container is ready (see seed.go)
+	Seed map[string][]db.SeedStep `json:"seed,omitempty"`
+
+	// Mounts per service (see volumes.go)
+	Volumes map[string][]db.VolumeSpec `json:"volumes,omitempty"`
+
+	// Resource limits per service and seconds until the testbed is torn down (see quota.go)
+	Resources  map[string]*db.Resources `json:"resources,omitempty"`
+	TTLSeconds int                      `json:"ttl_seconds,omitempty"`
+
+	// Priority class when the testbed has to wait for host capacity (see queue.go)
+	Priority string `json:"priority,omitempty"`
 }
 
 func main() {
 	logging.Init(ioutil.Discard, os.Stdout, os.Stdout, os.Stderr)
 
+	var err error
+	cfg, cfgSources, err = loadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	applyConfig(cfg)
+
+	authenticated, err := initAuthenticators(cfg.AuthConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Without authentication the API can stop every container on the host, it is only served locally
+	// unless an address is configured
+	if cfg.Address == "" {
+		cfg.Address = "127.0.0.1:8080"
+		if authenticated {
+			cfg.Address = ":8080"
+		}
+	}
+	if !authenticated {
+		logging.Warning.Println("auth.config is not set, requests are not authenticated and accepted on ", cfg.Address)
+	}
+	limited, err := initQuotas(cfg.QuotaConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !limited {
+		logging.Warning.Println("quota.config is not set, testbeds are not limited")
+	}
+	tlsConfig, err := initTLS(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	logging.Info.Println("Connecting to ", redactURI(cfg.MongoURI), " and docker")
+	if err := db.Connect(cfg.MongoURI, cfg.MongoDatabase); err != nil {
+		log.Fatal(err)
+	}
+	if err := dockercontainer.Connect(cfg.DockerHost, cfg.DockerAPIVersion); err != nil {
+		log.Fatal(err)
+	}
+
 	logging.Info.Println("Initializing router")
 	r := newRouter()
 
 	srv := &http.Server{
 		Handler:      r,
-		Addr:         ":8080",
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		Addr:         cfg.Address,
+		TLSConfig:    tlsConfig,
+		ReadTimeout:  cfg.ReadTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+		// No WriteTimeout, event streams and ?wait=ready long-polls outlive any fixed write deadline.
+		// Uploads get server.upload_timeout to be read instead of ReadTimeout (see api.go)
+	}
+
+	logging.Info.Println("Initialize test bed collection")
+	if err := db.InitTestBedCollection(ctx); err != nil {
+		logging.Error.Println(err)
 	}
 
 	logging.Info.Println("Initialize test bed meta collection")
 	db.InitTestBedMetaCollection(ctx)
 
+	logging.Info.Println("Initialize test bed template collection")
+	if err := db.InitTestBedTemplateCollection(ctx); err != nil {
+		logging.Error.Println(err)
+	}
+
+	logging.Info.Println("Initialize test bed event collection")
+	if err := db.InitTestBedEventCollection(ctx); err != nil {
+		logging.Error.Println(err)
+	}
+
+	logging.Info.Println("Initialize webhook delivery collection")
+	if err := db.InitWebhookDeliveryCollection(ctx); err != nil {
+		logging.Error.Println(err)
+	}
+
+	logging.Info.Println("Initialize fault collection")
+	if err := db.InitFaultCollection(ctx); err != nil {
+		logging.Error.Println(err)
+	}
+
+	logging.Info.Println("Initialize auth nonce collection")
+	if err := db.InitAuthNonceCollection(ctx); err != nil {
+		logging.Error.Println(err)
+	}
+
+	logging.Info.Println("Resuming injected faults")
+	resumeFaults()
+
+	logging.Info.Println("Starting webhook delivery")
+	go webhook.Run(ctx)
+
+	logging.Info.Println("Starting expired testbed reaper")
+	go reapExpiredTestBeds(ctx)
+
+	logging.Info.Println("Starting admission queue")
+	go runAdmission(ctx)
+
+	if tlsConfig != nil {
+		// The certificate comes from the TLS config, which reloads it when it is rotated (see tls.go)
+		logging.Info.Println("Starting Server with TLS")
+		if err := srv.ListenAndServeTLS("", ""); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	logging.Warning.Println("tls.cert is not set, serving without TLS")
 	logging.Info.Println("Starting Server")
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatal(err)
@@ -102,24 +326,22 @@ func getenvhandler(w http.ResponseWriter, r *http.Request) {
         }
 }
 
-// Handler for /getenv/<container-id> call read from Mongo
+// Handler for /getenv/<testbed id> call read from Mongo, a missing testbed is answered with 404
+// and a failed lookup with 500 like on /api/v1/testbeds/{id}
 func getenvbytaghandler(w http.ResponseWriter, r *http.Request) {
-        vars := mux.Vars(r)
-        testbedID := vars["tag"]
+	testbedInfo, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
 
-	if testbedID != "" {
-		testbedInfo, err := db.GetTestBedFromID(ctx, testbedID)
-		if err != nil {
-			logging.Error.Println("Error observed while fetching testbedInfo.")
-		} else {
-			logging.Info.Println(testbedInfo)
-			// todo - Add logic to print detailed test bed info
-			fmt.Fprintf(w, "%v", testbedInfo)
-			//fmt.Println(w, testbedInfo.ID)
-			//fmt.Println(w, testbedInfo.Name)
+	logging.Info.Println("Read testbed ", testbedInfo.ID)
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Testbed %v (%v) is %v\n", testbedInfo.Name, testbedInfo.ID, testbedInfo.Status)
+	for _, cnt := range testbedInfo.Container {
+		fmt.Fprintf(w, "%v %v %v:%v\n", containerName(testbedInfo.ID, cnt.Image), cnt.CID, cnt.IP, cnt.SvcPort)
+		for _, replica := range cnt.Replicas {
+			fmt.Fprintf(w, "%v %v %v:%v\n", replica.Name, replica.CID, replica.IP, replica.SvcPort)
 		}
-	} else {
-		logging.Error.Println("No tag information provided.")
 	}
 }
 
@@ -127,134 +349,435 @@ func getenvbytaghandler(w http.ResponseWriter, r *http.Request) {
 /* 
   Handler for /createenv call
 
-  This call will be used for capturing the json request body which will be then written to a file. 
-  Once we have data in the file, a docker image pull and container creation will begin accordingly. 
+  The json request body is validated first, a 400 with field level errors is returned for bad requests.
+  Only once the testbed is recorded in Mongo the request is accepted (202) and the docker image pull
+  and container creation begin accordingly.
+
+  When called as /testbeds?template=<name>&vars=..., the request is built from a stored template instead,
+  when called as /testbeds?from_snapshot=<id>&name=<name> from a snapshot (see snapshots.go).
+  Testbeds beyond the quotas of their owner, team or host are refused with 429 or 403 (see quota.go).
+  A testbed the host has no capacity for is recorded Queued and provisioned once admitted (see queue.go).
 */
 func createenvhandler(w http.ResponseWriter, r *http.Request) {
 	post :=  postRequestBody{}
-	w.Header().Set("content-type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	defer r.Body.Close()
 	testbed := db.NewTestBed()
-
+	var snapshot db.Snapshot
 	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
-		s := err.Error()
-		logging.Error.Println(s)
-	}
 
-        requestBody, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Query().Get("template") != "" {
+		var tmpl db.TestBedTemplate
+		var err error
+		post, tmpl, err = postRequestFromTemplate(r.URL.Query())
+		if err == db.ErrNoMatchDocument {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "No template found with name "+r.URL.Query().Get("template"))
+			return
+		} else if _, ok := err.(errTemplateRequest); ok {
+			writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+			return
+		} else if err != nil {
+			logging.Error.Println(err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching template")
+			return
+		}
+		testbed.Template = fmt.Sprintf("%v@%v", tmpl.Name, tmpl.Version)
+	} else if r.URL.Query().Get("from_snapshot") != "" {
+		var err error
+		post, snapshot, err = postRequestFromSnapshot(r.URL.Query())
+		if err == db.ErrNoMatchDocument {
+			writeError(w, http.StatusNotFound, errCodeNotFound, "No snapshot found with id "+r.URL.Query().Get("from_snapshot"))
+			return
+		} else if err != nil && err != errSnapshotNotReady {
+			logging.Error.Println(err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching snapshot")
+			return
+		} else if !authorize(w, r, snapshot.Owner, snapshot.Team, accessRead, "snapshot with id "+snapshot.ID) {
+			return
+		} else if err == errSnapshotNotReady {
+			writeError(w, http.StatusConflict, errCodeConflict, "Snapshot "+snapshot.ID+" is "+snapshot.Status+", only Completed snapshots can be restored")
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&post); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid request body: "+err.Error())
+		return
+	}
 
-	logging.Info.Println(requestBody)
+	key := idempotencyKey(r, post)
+	errs := validatePostRequest(post)
+	if len(key) > maxIdempotencyKeyLength {
+		errs = append(errs, fieldError{Field: "Idempotency-Key", Message: fmt.Sprintf("must be at most %v characters long", maxIdempotencyKeyLength)})
+	}
+	if len(errs) == 0 {
+		artifactErrs, err := seedArtifactErrors(requestPrincipal(r), post.Seed)
+		if err != nil {
+			logging.Error.Println(err)
+			writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not look up seed artifacts, nothing was provisioned")
+			return
+		}
+		errs = artifactErrs
+	}
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid testbed request", errs...)
+		return
+	}
 
-        err1 := json.Unmarshal(requestBody, &post)
-        if err1 != nil{
-                logging.Error.Println(err1)
-        }
+	testbed.Owner = post.Owner
+	if p := requestPrincipal(r); p != nil {
+		testbed.Owner = p.Name
+		testbed.Team = p.Team
+	}
+	if key != "" {
+		existing, found, err := findIdempotentTestBed(testbed.Owner, key)
+		if err != nil {
+			logging.Error.Println(err)
+			writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not look up Idempotency-Key, nothing was provisioned")
+			return
+		}
+		if found {
+			writeIdempotentReplay(w, existing, requestFingerprint(post))
+			return
+		}
+		testbed.IdempotencyKey = key
+		testbed.IdempotencyHash = requestFingerprint(post)
+	}
 
 	testbed.Name = post.Name
+	testbed.Labels = post.Labels
 	for _, cnt := range post.Containers {
-		testbed.Container = append(testbed.Container, db.ContainerProp{Image: cnt, CID: "0", IP: "0.0.0.0"})
+		testbed.Container = append(testbed.Container, db.ContainerProp{Image: cnt, CID: "0", IP: "0.0.0.0", Seed: post.Seed[cnt], Volumes: post.Volumes[cnt], Resources: containerResources(post.Resources[cnt])})
+	}
+	if snapshot.ID != "" {
+		applySnapshot(testbed, snapshot)
 	}
 
-	insertResult, err := db.InsertTestBed(context.TODO(), testbed)
+	ttl, ok := quotaTTL(w, testbed.Owner, testbed.Team, post.TTLSeconds)
+	if !ok {
+		return
+	}
+	testbed.ExpiresAt = expiresAt(ttl)
+	release, ok := reserveQuota(w, testbed.Owner, testbed.Team, testbedUsage(testbed.Container))
+	if !ok {
+		return
+	}
+	admitted, ok := admitOrQueue(w, testbed, post.Priority)
+	if !ok {
+		release()
+		return
+	}
+	insertResult, err := db.InsertTestBed(ctx, testbed)
+	admitted()
+	release()
+	if key != "" && db.IsDuplicateKeyError(err) {
+		// A concurrent request with the same key recorded its testbed first
+		if existing, found, err := findIdempotentTestBed(testbed.Owner, key); err == nil && found {
+			writeIdempotentReplay(w, existing, requestFingerprint(post))
+			return
+		}
+	}
 	if err != nil {
 		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record testbed, nothing was provisioned")
+		return
 	}
 
 	logging.Info.Println("Created testbed document: ", insertResult.InsertedID)
 
-	tbID := insertResult.InsertedID.(string)
+	tbID := testbed.ID
+	w.Header().Set("location", "/api/v1/testbeds/"+tbID)
+
+	if testbed.Status == db.StatusQueued {
+		setQueuePosition(testbed)
+		writeJSON(w, http.StatusAccepted, initResp{Status: "queued", RequestID: tbID, QueuePosition: testbed.QueuePosition, ETASeconds: testbed.ETASeconds})
+		return
+	}
 
-	go pullDockerImageAndCreateContainer(tbID, post.Containers)
+	go pullDockerImageAndCreateContainer(tbID, testbed.Container)
 
-	rsp := initResp{Status: "pending", RequestID: tbID}
-	json.NewEncoder(w).Encode(rsp)
+	writeJSON(w, http.StatusAccepted, initResp{Status: "pending", RequestID: tbID})
+}
+
+// validatePostRequest returns the field level errors of a createenv request
+func validatePostRequest(post postRequestBody) []fieldError {
+	var errs []fieldError
+
+	if post.Name == "" {
+		errs = append(errs, fieldError{Field: "name", Message: "must not be empty"})
+	} else if !testbedNameRegexp.MatchString(post.Name) {
+		errs = append(errs, fieldError{Field: "name", Message: "must match " + testbedNameRegexp.String()})
+	}
+
+	if len(post.Containers) == 0 {
+		errs = append(errs, fieldError{Field: "containers", Message: "must name at least one service"})
+	} else if len(post.Containers) > maxContainersPerTestBed {
+		errs = append(errs, fieldError{Field: "containers", Message: fmt.Sprintf("must name at most %v services", maxContainersPerTestBed)})
+	}
+
+	for k, v := range post.Labels {
+		if !labelKeyRegexp.MatchString(k) {
+			errs = append(errs, fieldError{Field: "labels." + k, Message: "label key must match " + labelKeyRegexp.String()})
+		} else if len(v) > 255 {
+			errs = append(errs, fieldError{Field: "labels." + k, Message: "label value must be at most 255 characters long"})
+		}
+	}
+
+	if post.TTLSeconds < 0 {
+		errs = append(errs, fieldError{Field: "ttl_seconds", Message: "must not be negative"})
+	}
+	if _, ok := priorityRanks[post.Priority]; post.Priority != "" && !ok {
+		errs = append(errs, fieldError{Field: "priority", Message: "must be high, normal or low"})
+	}
+
+	errs = append(errs, validateSeed(post)...)
+	errs = append(errs, validateVolumes(post)...)
+	errs = append(errs, validateResources(post)...)
+
+	seen := make(map[string]bool)
+	for i, cnt := range post.Containers {
+		field := fmt.Sprintf("containers[%d]", i)
+		switch {
+		case !isSupportedService(cnt):
+			errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf("unknown service %q, supported services are %v", cnt, strings.Join(supportedServices, ", "))})
+		case seen[cnt]:
+			errs = append(errs, fieldError{Field: field, Message: fmt.Sprintf("service %q is listed more than once", cnt)})
+		}
+		seen[cnt] = true
+	}
+	return errs
+}
+
+// isSupportedService reports whether a service can be provisioned
+func isSupportedService(name string) bool {
+	for _, svc := range supportedServices {
+		if svc == name {
+			return true
+		}
+	}
+	return false
 }
 
 /*
   pullDockerImageAndCreateContainer is used to pull docker images and create container
   Pulling docker images is a goroutine based implementation.
+
+  The stored container properties carry the seed steps and volumes of every service, the planned
+  replicas of a service are created once its first instance is ready (see scale.go).
+  Every step is published as a testbed event (see eventstream.go). The testbed ends up Completed
+  once all containers are healthy and seeded, or Failed at the first pull, create, start, health
+  check or seed error.
 */
-func pullDockerImageAndCreateContainer(tbid string, containers []string) {
+func pullDockerImageAndCreateContainer(tbid string, containers []db.ContainerProp) {
 	var images []string
+	var services []db.ContainerProp
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			logging.Error.Println("Provisioning of testbed ", tbid, " panicked: ", rec)
+			setTestBedStatus(tbid, db.StatusFailed, fmt.Sprint(rec))
+		}
+	}()
 
 	logging.Info.Println("Initializing wait group")
 	var wg sync.WaitGroup
+	progress := newPullProgress(tbid)
 
-	for _, container := range containers {
-		if container == "mongo" || container == "redis" {
-			imageName := baseImageRegistry + strings.ToLower(container)
+	for _, cnt := range containers {
+		if isSupportedService(cnt.Image) {
+			imageName := imageReference(cnt)
 			logging.Info.Println( "Image name is " + imageName )
 			images = append(images, imageName)
-			wg.Add(1)
-	                go dockercontainer.PullDockerImages(ctx, imageName, &wg)
+			services = append(services, cnt)
+		}
+	}
+
+	pullErrs := make([]error, len(images))
+	for i, imageName := range images {
+		service := services[i].Image
+		// Pinned images, e.g. of a snapshot, are only pulled when they are not on the host
+		if services[i].ImageRef != "" {
+			if _, err := dockercontainer.InspectImage(ctx, imageName); err == nil {
+				continue
+			}
 		}
+		publishEvent(tbid, events.PullStarted, service, "Pulling "+imageName)
+		wg.Add(1)
+		go func(i int, imageName string) {
+			pullErrs[i] = dockercontainer.PullDockerImages(ctx, imageName, &wg, func(_ string, msg dockercontainer.PullMessage) {
+				progress.report(service, msg)
+			})
+		}(i, imageName)
 	}
 
 	logging.Info.Println("Images list is : ", images)
 
 	wg.Wait()
 
-	tag := tbid
-
+	for i, imageName := range images {
+		if pullErrs[i] != nil {
+			failContainer(tbid, services[i].Image, "Pull of "+imageName+" failed: "+pullErrs[i].Error())
+			return
+		}
+		publishEvent(tbid, events.PullDone, services[i].Image, "Image "+imageName+" is available")
+	}
 
-	_, err := db.UpdateTestBedStatus(context.TODO(), tbid, "In-progress")
-        if err != nil {
-                logging.Error.Println(err)
-        }
+	setTestBedStatus(tbid, db.StatusInProgress, "")
 
-	for _, image := range images {
-		sImage := strings.Split(image, "/")
-		image = sImage[len(sImage)-1]
-		//fmt.Fprintf(w, image)
-		if image == "mongo" || image == "redis" {
-			port, err := util.GetFreePort()
-			resp, containerPortString := dockercontainer.CreateDockerContainer(ctx, image, tag, port)
-			containers = append(containers, resp.ID)
-			db.AddPortToMeta(context.TODO(), port)
-
-			dockercontainer.StartContainer(ctx, resp)
-			inspectData := dockercontainer.InspectContainer(ctx, resp.ID)
-			logging.Info.Println("IP Address for container : ", inspectData.NetworkSettings.IPAddress)
-			logging.Info.Println("Port map for container : ", inspectData.NetworkSettings.Ports)
-
-			logging.Info.Println("Building container : " + image)
-			containerIP := inspectData.NetworkSettings.IPAddress
-
-			hostport := inspectData.NetworkSettings.Ports[containerPortString][0].HostPort
-			hport, err1 := strconv.Atoi(hostport)
-			if err1 != nil {
-				logging.Error.Println(err)
-			}
-			logging.Info.Println("Host port value is ", hostport)
+	for _, cnt := range services {
+		image := cnt.Image
+		logging.Info.Println("Building container : " + image)
 
-			_, err = db.UpdateContainerProperty(context.TODO(), tbid, image, "ip", containerIP)
-			if err != nil {
-				logging.Error.Println(err)
-			}
-			_, err = db.UpdateContainerProperty(context.TODO(), tbid, image, "svc_port", hport)
+		inst, err := createInstance(tbid, cnt, 1)
+		if inst.SvcPort != 0 {
+			_, err := db.UpdateContainerProperty(ctx, tbid, image, "svc_port", inst.SvcPort)
 			if err != nil {
 				logging.Error.Println(err)
 			}
-			_, err = db.UpdateContainerProperty(context.TODO(), tbid, image, "rest_port", 7010)
-			if err != nil {
+		}
+		if err != nil {
+			failContainer(tbid, image, err.Error())
+			return
+		}
+		_, err = db.UpdateContainerProperty(ctx, tbid, image, "ip", inst.IP)
+		if err != nil {
+			logging.Error.Println(err)
+		}
+		_, err = db.UpdateContainerProperty(ctx, tbid, image, "rest_port", 7010)
+		if err != nil {
+			logging.Error.Println(err)
+		}
+
+		results, err := readyInstance(tbid, cnt, inst)
+		if len(results) > 0 {
+			if _, err := db.UpdateContainerProperty(ctx, tbid, image, "seed_results", results); err != nil {
 				logging.Error.Println(err)
 			}
-			logging.Info.Println("Done building container: " + image)
 		}
+		if err != nil {
+			failContainer(tbid, image, err.Error())
+			return
+		}
+		if err := provisionReplicas(tbid, cnt); err != nil {
+			failContainer(tbid, image, err.Error())
+			return
+		}
+		logging.Info.Println("Done building container: " + image)
 	}
 
-	_, err = db.UpdateTestBedStatus(context.TODO(), tbid, "Completed")
-        if err != nil {
-                logging.Error.Println(err)
-        }
+	setTestBedStatus(tbid, db.StatusCompleted, "")
+}
+
+//serviceInstance is a started container of a testbed service
+type serviceInstance struct {
+	Name    string // container name
+	ID      string
+	IP      string
+	SvcPort int
+}
+
+// createInstance creates and starts a container of a testbed service, replica is 1 for the first instance.
+// The host port is recorded in TestBedMeta once the container exists, the returned instance holds it
+// also when a later step fails.
+func createInstance(tbid string, cnt db.ContainerProp, replica int) (serviceInstance, error) {
+	image := cnt.Image
+	inst := serviceInstance{Name: containerName(tbid, image) + replicaSuffix(replica)}
+
+	mounts, err := containerMounts(tbid, cnt, replica)
+	if err != nil {
+		return inst, err
+	}
+	port, err := allocatePort()
+	if err != nil {
+		return inst, errors.New("No free host port: " + err.Error())
+	}
+	opts := dockercontainer.ContainerOptions{
+		Name:   inst.Name,
+		Image:  cnt.ImageRef,
+		Env:    cnt.Env,
+		Labels: ownershipLabels(tbid, image),
+		Mounts: mounts,
+	}
+	if cnt.Resources != nil {
+		opts.Memory = cnt.Resources.MemoryMB << 20
+		opts.NanoCPUs = int64(cnt.Resources.CPUs * 1e9)
+	}
+	resp, containerPortString, err := dockercontainer.CreateDockerContainer(ctx, image, tbid, port, opts)
+	if err != nil {
+		return inst, errors.New("Container creation failed: " + err.Error())
+	}
+	inst.ID = resp.ID
+	inst.SvcPort = port
+	publishEvent(tbid, events.ContainerCreated, image, "Created container "+inst.Name)
+	db.AddPortToMeta(ctx, port)
+
+	if err := restoreVolumes(resp.ID, cnt); err != nil {
+		return inst, err
+	}
+
+	if err := dockercontainer.StartContainer(ctx, resp); err != nil {
+		return inst, errors.New("Container start failed: " + err.Error())
+	}
+	publishEvent(tbid, events.ContainerStarted, image, "Started container "+inst.Name)
+
+	inspectData := dockercontainer.InspectContainer(ctx, resp.ID)
+	if inspectData.NetworkSettings == nil {
+		return inst, errors.New("Container " + inst.Name + " could not be inspected")
+	}
+	logging.Info.Println("IP Address for container : ", inspectData.NetworkSettings.IPAddress)
+	logging.Info.Println("Port map for container : ", inspectData.NetworkSettings.Ports)
+	inst.IP = inspectData.NetworkSettings.IPAddress
+
+	if bindings := inspectData.NetworkSettings.Ports[containerPortString]; len(bindings) > 0 {
+		hport, err := strconv.Atoi(bindings[0].HostPort)
+		if err != nil {
+			logging.Error.Println(err)
+		} else {
+			inst.SvcPort = hport
+		}
+	}
+	logging.Info.Println("Host port value is ", inst.SvcPort)
+	return inst, nil
+}
+
+// readyInstance waits until a started instance is healthy and runs the seed steps of its service.
+// It returns the seed results, if there were steps.
+func readyInstance(tbid string, cnt db.ContainerProp, inst serviceInstance) ([]db.SeedResult, error) {
+	if err := dockercontainer.WaitHealthy(ctx, inst.ID, containerHealthyTimeout); err != nil {
+		return nil, err
+	}
+	publishEvent(tbid, events.ContainerHealthy, cnt.Image, "Container "+inst.Name+" is healthy")
+
+	if len(cnt.Seed) == 0 {
+		return nil, nil
+	}
+	return seedContainer(tbid, cnt.Image, inst.ID, cnt.Seed)
 }
 
+// allocatePort returns a free host port which is not allocated to another testbed. Stopped testbeds
+// keep their ports allocated in TestBedMeta while nothing listens on them.
+func allocatePort() (int, error) {
+	meta, err := db.GetTestBedMeta(ctx)
+	if err != nil {
+		return 0, err
+	}
+	allocated := util.ConvertIntSlicetoStringBoolMap(meta.AllocatedPorts)
+
+	for i := 0; i < maxPortAttempts; i++ {
+		port, err := util.GetFreePort()
+		if err != nil {
+			return 0, err
+		}
+		if !allocated[strconv.Itoa(port)] {
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no unallocated port found in %v attempts", maxPortAttempts)
+}
 
-// Handler for / call
-func getallconfighandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "Nothing to do here as of now.\n")
+// imageReference returns the image a testbed container is created from
+func imageReference(cnt db.ContainerProp) string {
+	if cnt.ImageRef != "" {
+		return cnt.ImageRef
+	}
+	return baseImageRegistry + strings.ToLower(cnt.Image)
 }
 
 
@@ -297,46 +820,61 @@ func stophandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
-// Handler for delete request
-func delhandler(w http.ResponseWriter, r *http.Request) {
-	var killedContainer []string
-	var deallocatedPort []int
-
-	vars := mux.Vars(r)
-	tag := vars["tag"]
-
-	logging.Info.Println(tag)
-
-	tb, _ := db.GetTestBedFromID(ctx, tag)
+/*
+  Handler for /testbeds/{id}/compose call
 
-	for value := range tb.Container {
-		containername := tag + "-" + tb.Container[value].Image
-		if tb.Container[value].Image == "mongo" || tb.Container[value].Image == "redis" {
-			fmt.Fprintf(w, "Deleting container " + tb.Container[value].Image + " and deallocating ports \n")
-			err := dockercontainer.RemoveContainer(ctx, containername)
-			killedContainer = append(killedContainer, tb.Container[value].Image)
-			deallocatedPort = append(deallocatedPort, tb.Container[value].SvcPort)
+  Renders the stored container properties of a testbed along with their inspected docker
+  configuration as a docker-compose.yml, so a failed environment can be reproduced locally.
+  Services and volumes carry the labels and names the provisioner gives them (see volumes.go).
+*/
+func composehandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
 
-			if err != nil {
-				logging.Error.Println("Error shown is : ", err.Error() )
-				fmt.Fprintf(w, "Error shown is : ", err.Error() )
-			} else {
-				for _, containername := range killedContainer {
-					fmt.Fprintf(w, containername + "\n")
-					logging.Info.Println(containername)
-				}
-				for _, p := range deallocatedPort {
-					db.DeletePortFromMeta(ctx, p)
-					svcport := strconv.Itoa(p)
-					//fmt.Fprintf(w, svcport + "\n")
-					logging.Info.Println(svcport)
-				}
+	inspected := make(map[string]types.ContainerJSON)
+	digests := make(map[string]string)
+	for _, cnt := range tb.Container {
+		replicas := []int{1}
+		for _, replica := range cnt.Replicas {
+			replicas = append(replicas, replica.Index)
+		}
+		for _, replica := range replicas {
+			containername := containerName(tb.ID, cnt.Image) + replicaSuffix(replica)
+			inspectData := dockercontainer.InspectContainer(ctx, containername)
+			if inspectData.ContainerJSONBase == nil {
+				logging.Warning.Println("Could not inspect container, using stored properties for ", containername)
+				continue
+			}
+			inspected[compose.ServiceKey(cnt.Image, replica)] = inspectData
 
-				_, err := db.UpdateTestBedStatus(context.TODO(), tag, "Deleted")
-			        if err != nil {
-					logging.Error.Println(err)
-				}
+			if _, ok := digests[cnt.Image]; ok {
+				continue
+			}
+			imageData, err := dockercontainer.InspectImage(ctx, inspectData.Image)
+			if err == nil && len(imageData.RepoDigests) > 0 {
+				digests[cnt.Image] = imageData.RepoDigests[0]
 			}
 		}
 	}
+
+	naming := compose.Naming{
+		Labels: func(image string) map[string]string {
+			return ownershipLabels(tb.ID, image)
+		},
+		Volume: func(image, name string, replica int) string {
+			return volumeName(tb.ID, image, name) + replicaSuffix(replica)
+		},
+	}
+	out, err := compose.Build(tb, inspected, digests, naming).Marshal()
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Could not render compose file")
+		return
+	}
+
+	w.Header().Set("content-type", "application/x-yaml")
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=%q", tb.Name+"-docker-compose.yml"))
+	w.Write(out)
 }
@@ -0,0 +1,1379 @@
+/*
+ * spec.go holds the OpenAPI 3 specification of the Infra Provisioner API.
+ *
+ * Every route registered in newRouter must be described here, the spec is served at
+ * /openapi.json and request bodies are validated against it before reaching the handlers.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package openapi
+
+import (
+	"encoding/json"
+)
+
+//Spec is a parsed OpenAPI document
+type Spec struct {
+	raw []byte
+	doc map[string]interface{}
+}
+
+//Default is the specification of this server
+var Default = mustParse(specJSON)
+
+//JSON returns the specification document
+func (s *Spec) JSON() []byte {
+	return s.raw
+}
+
+func mustParse(raw string) *Spec {
+	s := &Spec{raw: []byte(raw)}
+	if err := json.Unmarshal(s.raw, &s.doc); err != nil {
+		panic("openapi: invalid specification: " + err.Error())
+	}
+	return s
+}
+
+const specJSON = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "Infra Provisioner",
+    "description": "Builds test beds of containers based on an input. Besides the security schemes below, a verified TLS client certificate whose subject is mapped to a principal in the auth config authenticates a request. When requests are authenticated, testbeds, snapshots and artifacts can be read and operated by their owner and its team, deleted by their owner, and admins may do everything. Resources of others answer 404, forbidden operations 403. Templates can be read by everyone, versions published by the team of their owner and deleted by their owner. Host wide routes and webhooks are reserved to admins. Testbeds beyond the quota of their owner, team or host answer 429 while the quota is used up and 403 when they alone exceed it or ask for a longer ttl_seconds than allowed.",
+    "version": "1.0.0",
+    "contact": {"name": "Arun K, Vibhore"}
+  },
+  "security": [{"bearerToken": []}, {"hmacSignature": []}],
+  "paths": {
+    "/": {
+      "get": {
+        "summary": "Get the settings",
+        "operationId": "getAllConfig",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "Settings of the running server", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Config"}}}},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "This specification",
+        "operationId": "getOpenAPI",
+        "security": [],
+        "responses": {"200": {"description": "OpenAPI document", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/api/v1/openapi.json": {
+      "get": {
+        "summary": "This specification",
+        "operationId": "getOpenAPIV1",
+        "security": [],
+        "responses": {"200": {"description": "OpenAPI document", "content": {"application/json": {"schema": {"type": "object"}}}}}
+      }
+    },
+    "/api/v1/testbeds": {
+      "get": {
+        "summary": "List testbeds",
+        "description": "Lists testbed records from the store, newest first unless sorted otherwise.",
+        "operationId": "listTestBeds",
+        "parameters": [
+          {"name": "status", "in": "query", "description": "Comma separated statuses", "schema": {"type": "string"}},
+          {"name": "name_prefix", "in": "query", "schema": {"type": "string"}},
+          {"name": "owner", "in": "query", "schema": {"type": "string"}},
+          {"name": "label", "in": "query", "description": "key=value, or key to match any value", "style": "form", "explode": true, "schema": {"type": "array", "items": {"type": "string"}}},
+          {"name": "created_after", "in": "query", "description": "RFC3339 time or unix seconds", "schema": {"type": "string"}},
+          {"name": "created_before", "in": "query", "description": "RFC3339 time or unix seconds", "schema": {"type": "string"}},
+          {"name": "sort", "in": "query", "schema": {"type": "string", "enum": ["created", "-created", "name", "-name", "status", "-status"], "default": "-created"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}},
+          {"name": "cursor", "in": "query", "description": "next_cursor of the previous page", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "Page of testbeds", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedPage"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Create a testbed",
+        "description": "Creates a testbed from the request body, from a stored template when ?template= is given, or from a snapshot when ?from_snapshot= is given. Templates carry the seed steps, volumes, resource limits, time to live and priority of their testbeds, the request body is not read then.",
+        "operationId": "createTestBed",
+        "parameters": [
+          {"name": "from_snapshot", "in": "query", "description": "Create the testbed from this Completed snapshot", "schema": {"type": "string"}},
+          {"name": "name", "in": "query", "description": "Name of a testbed created from a snapshot, the captured testbed name by default", "schema": {"type": "string"}},
+          {"$ref": "#/components/parameters/Template"},
+          {"$ref": "#/components/parameters/TemplateVersion"},
+          {"$ref": "#/components/parameters/TemplateVars"},
+          {"$ref": "#/components/parameters/IdempotencyKey"}
+        ],
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateTestBedRequest"}}}},
+        "responses": {
+          "202": {"description": "Testbed accepted, or the original testbed when Idempotent-Replayed is true", "headers": {"Location": {"schema": {"type": "string"}}, "Idempotent-Replayed": {"schema": {"type": "boolean"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InitResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "get": {
+        "summary": "Get a testbed",
+        "description": "With ?wait=ready the response is held until the testbed is Completed, Failed, Stopped or Deleted, or the timeout expires.",
+        "operationId": "getTestBed",
+        "parameters": [
+          {"name": "wait", "in": "query", "schema": {"type": "string", "enum": ["ready"]}},
+          {"name": "timeout", "in": "query", "description": "Duration such as 120s, at most 5m", "schema": {"type": "string", "default": "120s"}}
+        ],
+        "responses": {
+          "200": {"description": "Testbed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBed"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a testbed",
+        "description": "Stops and removes every container of the testbed, including the replicas of scaled services, deallocates their ports and removes their volumes.",
+        "operationId": "deleteTestBed",
+        "responses": {
+          "200": {"description": "Testbed deleted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/stop": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Stop every container of a testbed",
+        "operationId": "stopTestBed",
+        "responses": {
+          "200": {"description": "Testbed Stopped, its records and ports are kept", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/pause": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Pause every container of a testbed",
+        "operationId": "pauseTestBed",
+        "responses": {
+          "200": {"description": "Testbed Paused, its processes are frozen", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/unpause": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Unpause every container of a testbed",
+        "operationId": "unpauseTestBed",
+        "responses": {
+          "200": {"description": "Testbed Completed again", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/start": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Start the stopped containers of a testbed",
+        "operationId": "startTestBed",
+        "responses": {
+          "200": {"description": "Testbed Completed once every container is healthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/restart": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Restart every container of a testbed",
+        "operationId": "restartTestBed",
+        "responses": {
+          "200": {"description": "Testbed Completed once every container is healthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/compose": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "get": {
+        "summary": "Export a testbed as docker-compose file",
+        "operationId": "getTestBedCompose",
+        "responses": {
+          "200": {"description": "docker-compose.yml", "content": {"application/x-yaml": {"schema": {"type": "string"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/events": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "get": {
+        "summary": "Stream testbed events",
+        "description": "Server-Sent Events stream of the lifecycle events of a testbed. Stored events are replayed first, after Last-Event-ID when given. The stream ends when the client lags too far behind, it reconnects with Last-Event-ID. Each event's data is a TestBedEvent.",
+        "operationId": "streamTestBedEvents",
+        "parameters": [
+          {"name": "Last-Event-ID", "in": "header", "schema": {"type": "string"}},
+          {"name": "since", "in": "query", "description": "Same as Last-Event-ID", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "Event stream", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/TestBedEvent"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "get": {
+        "summary": "Get a container of a testbed",
+        "operationId": "getTestBedContainer",
+        "responses": {
+          "200": {"description": "Container", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerDetail"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Remove a container from a testbed",
+        "operationId": "deleteTestBedContainer",
+        "responses": {
+          "204": {"description": "Container removed"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/stop": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Stop a container of a testbed",
+        "operationId": "stopTestBedContainer",
+        "responses": {
+          "200": {"description": "Container stopped", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerResult"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/pause": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Pause a container of a testbed",
+        "operationId": "pauseTestBedContainer",
+        "responses": {
+          "200": {"description": "Container paused", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerResult"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/unpause": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Unpause a container of a testbed",
+        "operationId": "unpauseTestBedContainer",
+        "responses": {
+          "200": {"description": "Container unpaused", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerResult"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/start": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Start a stopped container of a testbed",
+        "operationId": "startTestBedContainer",
+        "responses": {
+          "200": {"description": "Container started and healthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerResult"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/restart": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Restart a container of a testbed",
+        "operationId": "restartTestBedContainer",
+        "responses": {
+          "200": {"description": "Container restarted and healthy", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerResult"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/logs": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}, {"$ref": "#/components/parameters/Instance"}],
+      "get": {
+        "summary": "Read the logs of a container",
+        "description": "Combined stdout and stderr. With follow=true the response streams new output until the client disconnects.",
+        "operationId": "getTestBedContainerLogs",
+        "parameters": [
+          {"name": "tail", "in": "query", "description": "Lines from the end, or all", "schema": {"type": "string", "default": "1000"}},
+          {"name": "since", "in": "query", "description": "Duration before now (10m), RFC3339 time or unix seconds", "schema": {"type": "string"}},
+          {"name": "timestamps", "in": "query", "schema": {"type": "boolean", "default": false}},
+          {"name": "follow", "in": "query", "schema": {"type": "boolean", "default": false}}
+        ],
+        "responses": {
+          "200": {"description": "Container output", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/exec": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}, {"$ref": "#/components/parameters/Instance"}],
+      "post": {
+        "summary": "Run a command in a container",
+        "description": "Waits for the command to exit. stdout and stderr are limited to 1MB each, truncated is set when output was discarded.",
+        "operationId": "execTestBedContainer",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ExecRequest"}}}},
+        "responses": {
+          "200": {"description": "Command exited", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ExecResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "504": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/exec/ws": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}, {"$ref": "#/components/parameters/Instance"}],
+      "get": {
+        "summary": "Run an interactive command in a container over a WebSocket",
+        "description": "Binary frames from the client are stdin, text frames are control messages {\"type\": \"resize\", \"rows\": 40, \"cols\": 120}. Output is sent as binary frames, followed by a text frame {\"type\": \"exit\", \"exit_code\": 0}.",
+        "operationId": "execTestBedContainerWebSocket",
+        "parameters": [
+          {"name": "cmd", "in": "query", "description": "Command and arguments, repeated in order", "style": "form", "explode": true, "schema": {"type": "array", "items": {"type": "string"}, "default": ["sh"]}},
+          {"name": "tty", "in": "query", "schema": {"type": "boolean", "default": true}}
+        ],
+        "responses": {
+          "101": {"description": "Switching to the WebSocket protocol"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/files": {
+      "parameters": [
+        {"$ref": "#/components/parameters/TestBedID"},
+        {"$ref": "#/components/parameters/ContainerName"},
+        {"name": "path", "in": "query", "required": true, "description": "Absolute path in the container", "schema": {"type": "string", "pattern": "^/"}},
+        {"$ref": "#/components/parameters/Instance"}
+      ],
+      "get": {
+        "summary": "Download a file or directory of a container as tar archive",
+        "operationId": "getTestBedContainerFiles",
+        "responses": {
+          "200": {"description": "Tar archive", "content": {"application/x-tar": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Upload files into a container",
+        "description": "A tar archive is extracted into the directory path, any other content type is written as the file path and needs a Content-Length. The directory must exist. At most 512MB, read within server.upload_timeout.",
+        "operationId": "putTestBedContainerFiles",
+        "requestBody": {"required": true, "content": {
+          "application/x-tar": {"schema": {"type": "string", "format": "binary"}},
+          "application/gzip": {"schema": {"type": "string", "format": "binary"}},
+          "application/octet-stream": {"schema": {"type": "string", "format": "binary"}}
+        }},
+        "responses": {
+          "204": {"description": "Copied"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "411": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/templates": {
+      "post": {
+        "summary": "Create a template",
+        "operationId": "createTemplate",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TemplateRequest"}}}},
+        "responses": {
+          "201": {"description": "Template version 1", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "get": {
+        "summary": "List templates",
+        "operationId": "listTemplates",
+        "parameters": [{"name": "name", "in": "query", "schema": {"type": "string"}}],
+        "responses": {
+          "200": {"description": "Every stored template version", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Template"}}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/templates/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/TemplateName"}],
+      "get": {
+        "summary": "Get a template",
+        "operationId": "getTemplate",
+        "parameters": [{"$ref": "#/components/parameters/TemplateVersion"}],
+        "responses": {
+          "200": {"description": "Template", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Publish the next version of a template",
+        "operationId": "updateTemplate",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TemplateRequest"}}}},
+        "responses": {
+          "200": {"description": "New template version", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a template",
+        "operationId": "deleteTemplate",
+        "parameters": [{"$ref": "#/components/parameters/TemplateVersion"}],
+        "responses": {
+          "204": {"description": "Template deleted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/containers": {
+      "get": {
+        "summary": "List every container on the host",
+        "operationId": "listHostContainers",
+        "responses": {
+          "200": {"description": "Containers", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HostContainer"}}}}}
+        }
+      }
+    },
+    "/api/v1/queue": {
+      "get": {
+        "summary": "List queued testbeds",
+        "description": "Testbeds waiting for host capacity, in admission order: by priority class, then by arrival. The ETA is estimated from the recent admission rate and omitted until the queue moved.",
+        "operationId": "listQueue",
+        "responses": {
+          "200": {"description": "Queued testbeds visible to the caller", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/QueueEntry"}}}}},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/config": {
+      "get": {
+        "summary": "Get the settings",
+        "description": "Effective settings of the running server by key, with their source. Secrets such as the password of mongo.uri are redacted. Reserved to admins.",
+        "operationId": "getConfig",
+        "responses": {
+          "200": {"description": "Settings of the running server", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Config"}}}},
+          "403": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/artifacts": {
+      "get": {
+        "summary": "List artifacts",
+        "operationId": "listArtifacts",
+        "responses": {
+          "200": {"description": "Artifacts", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Artifact"}}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Upload an artifact",
+        "description": "The request body is the artifact content, at most 512MB. Names ending in .tar, .tar.gz, .tgz, .tar.bz2 or .tar.xz are extracted when used as seed, other files are copied as is.",
+        "operationId": "createArtifact",
+        "parameters": [{"name": "name", "in": "query", "required": true, "schema": {"type": "string", "pattern": "^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,127}$"}}],
+        "requestBody": {"required": true, "content": {"application/octet-stream": {"schema": {"type": "string", "format": "binary"}}}},
+        "responses": {
+          "201": {"description": "Artifact stored", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Artifact"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "413": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/artifacts/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get an artifact",
+        "operationId": "getArtifact",
+        "responses": {
+          "200": {"description": "Artifact", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Artifact"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete an artifact",
+        "description": "Artifacts holding the volume content of a snapshot are answered with 409, they are deleted with the snapshot.",
+        "operationId": "deleteArtifact",
+        "responses": {
+          "204": {"description": "Artifact deleted"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/clone": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Clone a testbed",
+        "description": "Creates a testbed with the services, instances, image digests, environment and resource limits of the source. With data the source is captured as a snapshot first and the clone starts from it. A clone the host has no capacity for is queued, its data is copied once it is admitted.",
+        "operationId": "cloneTestBed",
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CloneRequest"}}}},
+        "responses": {
+          "202": {"description": "Clone accepted", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InitResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/services/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "patch": {
+        "summary": "Scale a service",
+        "description": "Adds or removes instances of a service of a Completed testbed. Added instances get their own host port and named volumes and are seeded, removed ones release them. Instances the host has no capacity for, or added while testbeds are queued, are refused with 429.",
+        "operationId": "scaleService",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ScaleRequest"}}}},
+        "responses": {
+          "200": {"description": "Service scaled", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ContainerProp"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "429": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/faults": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "get": {
+        "summary": "List the active faults of a testbed",
+        "operationId": "listFaults",
+        "responses": {
+          "200": {"description": "Active faults", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Fault"}}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/containers/{name}/faults": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}, {"$ref": "#/components/parameters/ContainerName"}],
+      "post": {
+        "summary": "Inject a fault into a container",
+        "description": "Kills the container with a signal, pauses it, disconnects it from its networks or adds latency and packet loss with tc netem run in a sidecar. Only containers owned by the testbed take faults.",
+        "operationId": "injectFault",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/FaultRequest"}}}},
+        "responses": {
+          "200": {"description": "Fault injected", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Fault"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Heal the active fault of a container",
+        "operationId": "healFault",
+        "parameters": [{"$ref": "#/components/parameters/Instance"}],
+        "responses": {
+          "204": {"description": "Fault healed"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "502": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/testbeds/{id}/snapshots": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "post": {
+        "summary": "Snapshot a testbed",
+        "description": "Commits every container as an image and stores the content of its volumes as artifacts, in the background. Containers are paused while they are captured.",
+        "operationId": "createSnapshot",
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SnapshotRequest"}}}},
+        "responses": {
+          "202": {"description": "Snapshot accepted", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Snapshot"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "get": {
+        "summary": "List the snapshots of a testbed",
+        "operationId": "listSnapshots",
+        "responses": {
+          "200": {"description": "Snapshots, newest first", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Snapshot"}}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/snapshots/{id}": {
+      "parameters": [{"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}],
+      "get": {
+        "summary": "Get a snapshot",
+        "operationId": "getSnapshot",
+        "responses": {
+          "200": {"description": "Snapshot", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Snapshot"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a snapshot with its images and artifacts",
+        "operationId": "deleteSnapshot",
+        "responses": {
+          "204": {"description": "Snapshot deleted"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/webhooks": {
+      "get": {
+        "summary": "List webhooks",
+        "operationId": "listWebhooks",
+        "responses": {
+          "200": {"description": "Webhooks", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Webhook"}}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Register a webhook",
+        "description": "Deliveries are POSTed with X-Webhook-Event, X-Webhook-Delivery, X-Webhook-Timestamp and X-Webhook-Signature (sha256=<hex HMAC-SHA256 of \"<timestamp>.<body>\">) headers.",
+        "operationId": "createWebhook",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateWebhookRequest"}}}},
+        "responses": {
+          "201": {"description": "Webhook registered", "headers": {"Location": {"schema": {"type": "string"}}}, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/webhooks/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/WebhookID"}],
+      "get": {
+        "summary": "Get a webhook",
+        "operationId": "getWebhook",
+        "responses": {
+          "200": {"description": "Webhook", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Webhook"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a webhook and its delivery log",
+        "operationId": "deleteWebhook",
+        "responses": {
+          "204": {"description": "Webhook deleted"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/api/v1/webhooks/{id}/deliveries": {
+      "parameters": [{"$ref": "#/components/parameters/WebhookID"}],
+      "get": {
+        "summary": "Delivery log of a webhook, newest first",
+        "operationId": "listWebhookDeliveries",
+        "parameters": [{"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 500, "default": 50}}],
+        "responses": {
+          "200": {"description": "Deliveries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookDelivery"}}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/set/createenv": {
+      "post": {
+        "summary": "Create a testbed",
+        "operationId": "legacyCreateEnv",
+        "deprecated": true,
+        "parameters": [{"$ref": "#/components/parameters/IdempotencyKey"}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateTestBedRequest"}}}},
+        "responses": {
+          "202": {"description": "Testbed accepted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InitResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/get/getenv/{tag}": {
+      "parameters": [{"$ref": "#/components/parameters/Tag"}],
+      "get": {
+        "summary": "Get a testbed",
+        "description": "The testbed and the name, id, IP and service port of each of its containers as plain text.",
+        "operationId": "legacyGetEnvByTag",
+        "deprecated": true,
+        "responses": {
+          "200": {"$ref": "#/components/responses/LegacyText"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/get/getenv": {
+      "get": {
+        "summary": "List every container on the host",
+        "operationId": "legacyGetEnv",
+        "deprecated": true,
+        "responses": {"200": {"$ref": "#/components/responses/LegacyText"}}
+      }
+    },
+    "/update/stop/{tag}": {
+      "parameters": [{"$ref": "#/components/parameters/Tag"}],
+      "post": {
+        "summary": "Stop containers whose name matches tag, or all",
+        "operationId": "legacyStop",
+        "deprecated": true,
+        "responses": {"200": {"$ref": "#/components/responses/LegacyText"}}
+      }
+    },
+    "/delete/container/{id}": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "delete": {
+        "summary": "Delete a testbed",
+        "description": "Same as DELETE /api/v1/testbeds/{id}, removes the replicas of scaled services and their volumes too.",
+        "operationId": "legacyDelete",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "Testbed deleted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "post": {
+        "summary": "Delete a testbed",
+        "description": "Same as DELETE /api/v1/testbeds/{id}",
+        "operationId": "legacyDeletePost",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "Testbed deleted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TestBedActionResponse"}}}},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/testbeds": {
+      "post": {
+        "summary": "Create a testbed",
+        "operationId": "legacyCreateTestBed",
+        "deprecated": true,
+        "parameters": [
+          {"$ref": "#/components/parameters/Template"},
+          {"$ref": "#/components/parameters/TemplateVersion"},
+          {"$ref": "#/components/parameters/TemplateVars"},
+          {"$ref": "#/components/parameters/IdempotencyKey"}
+        ],
+        "requestBody": {"required": false, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/CreateTestBedRequest"}}}},
+        "responses": {
+          "202": {"description": "Testbed accepted", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/InitResponse"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "422": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"},
+          "503": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/testbeds/{id}/compose": {
+      "parameters": [{"$ref": "#/components/parameters/TestBedID"}],
+      "get": {
+        "summary": "Export a testbed as docker-compose file",
+        "operationId": "legacyGetTestBedCompose",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "docker-compose.yml", "content": {"application/x-yaml": {"schema": {"type": "string"}}}},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/templates": {
+      "post": {
+        "summary": "Create a template",
+        "operationId": "legacyCreateTemplate",
+        "deprecated": true,
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TemplateRequest"}}}},
+        "responses": {
+          "201": {"description": "Template version 1", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "get": {
+        "summary": "List templates",
+        "operationId": "legacyListTemplates",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "Every stored template version", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Template"}}}}},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/templates/{name}": {
+      "parameters": [{"$ref": "#/components/parameters/TemplateName"}],
+      "get": {
+        "summary": "Get a template",
+        "operationId": "legacyGetTemplate",
+        "deprecated": true,
+        "responses": {
+          "200": {"description": "Template", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "Publish the next version of a template",
+        "operationId": "legacyUpdateTemplate",
+        "deprecated": true,
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/TemplateRequest"}}}},
+        "responses": {
+          "200": {"description": "New template version", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Template"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "Delete a template",
+        "operationId": "legacyDeleteTemplate",
+        "deprecated": true,
+        "responses": {
+          "204": {"description": "Template deleted"},
+          "400": {"$ref": "#/components/responses/Error"},
+          "403": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"},
+          "500": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerToken": {"type": "http", "scheme": "bearer", "description": "Static API token from the auth config. Requests without valid credentials are answered with 401 once PROVISIONER_AUTH_CONFIG is set."},
+      "hmacSignature": {"type": "apiKey", "in": "header", "name": "X-Auth-Signature", "description": "sha256=<hex HMAC-SHA256 of \"<timestamp>.<nonce>.<method>.<request uri>.<content sha256>\"> keyed with the secret of X-Auth-Key, sent with X-Auth-Key, X-Auth-Timestamp (unix seconds), X-Auth-Nonce (16 to 128 characters of [A-Za-z0-9._~-], new for every request) and X-Auth-Content-SHA256 (hex SHA-256 of the body). The body is verified before the request is served, bodies over 512MB are answered with 413. A nonce is accepted once per key."}
+    },
+    "parameters": {
+      "TestBedID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Tag": {"name": "tag", "in": "path", "required": true, "schema": {"type": "string"}},
+      "ContainerName": {"name": "name", "in": "path", "required": true, "description": "Service name, e.g. mongo", "schema": {"type": "string"}},
+      "Instance": {"name": "instance", "in": "query", "description": "Instance of the service, see replicas", "schema": {"type": "integer", "minimum": 1, "default": 1}},
+      "TemplateName": {"name": "name", "in": "path", "required": true, "schema": {"type": "string"}},
+      "WebhookID": {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+      "Template": {"name": "template", "in": "query", "description": "Create the testbed from this template", "schema": {"type": "string"}},
+      "TemplateVersion": {"name": "version", "in": "query", "description": "Template version, latest when omitted", "schema": {"type": "integer", "minimum": 1}},
+      "IdempotencyKey": {"name": "Idempotency-Key", "in": "header", "description": "Repeating a request of the same owner with the same key within 24h returns the original testbed, keys of different owners are independent", "schema": {"type": "string", "maxLength": 255}},
+      "TemplateVars": {"name": "vars", "in": "query", "description": "Template variables as key=value pairs separated by commas", "schema": {"type": "string"}}
+    },
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "LegacyText": {"description": "Plain text output", "content": {"text/plain": {"schema": {"type": "string"}}}}
+    },
+    "schemas": {
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"type": "string"},
+              "message": {"type": "string"},
+              "details": {"type": "array", "items": {"$ref": "#/components/schemas/FieldError"}}
+            }
+          }
+        }
+      },
+      "FieldError": {
+        "type": "object",
+        "required": ["field", "message"],
+        "properties": {"field": {"type": "string"}, "message": {"type": "string"}}
+      },
+      "CreateTestBedRequest": {
+        "type": "object",
+        "required": ["name", "containers"],
+        "properties": {
+          "name": {"type": "string", "pattern": "^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$"},
+          "containers": {"type": "array", "minItems": 1, "maxItems": 10, "description": "Unique service names", "items": {"type": "string", "enum": ["mongo", "redis"]}},
+          "client_request_id": {"type": "string", "maxLength": 255, "description": "Idempotency key, used when no Idempotency-Key header is sent"},
+          "owner": {"type": "string", "description": "Ignored when requests are authenticated, the caller owns the testbed"},
+          "labels": {"$ref": "#/components/schemas/Labels"},
+          "seed": {"type": "object", "description": "Seed steps per service, run in order once the container is ready", "additionalProperties": {"type": "array", "items": {"$ref": "#/components/schemas/SeedStep"}}},
+          "volumes": {"type": "object", "description": "Mounts per service", "additionalProperties": {"type": "array", "maxItems": 16, "items": {"$ref": "#/components/schemas/VolumeSpec"}}},
+          "resources": {"type": "object", "description": "Resource limits per service, the configured container defaults when none are given", "additionalProperties": {"$ref": "#/components/schemas/Resources"}},
+          "ttl_seconds": {"type": "integer", "minimum": 0, "description": "Seconds until the testbed is torn down and Expired, the longest its quotas allow by default"},
+          "priority": {"type": "string", "enum": ["high", "normal", "low"], "default": "normal", "description": "Priority class while the testbed waits for host capacity"}
+        }
+      },
+      "VolumeSpec": {
+        "type": "object",
+        "additionalProperties": false,
+        "required": ["type", "target"],
+        "description": "A named volume <testbed id>-<service>-<name>, a tmpfs or a read-only bind of an allowlisted host path",
+        "properties": {
+          "type": {"type": "string", "enum": ["volume", "tmpfs", "bind"]},
+          "target": {"type": "string", "pattern": "^/", "description": "Mount point in the container"},
+          "name": {"type": "string", "pattern": "^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$", "description": "Name of a named volume"},
+          "source": {"type": "string", "pattern": "^/", "description": "Host path of a bind"},
+          "size_mb": {"type": "integer", "minimum": 0, "description": "Size limit of a tmpfs, 0 for none"},
+          "retain": {"type": "boolean", "default": false, "description": "Keep a named volume on teardown"}
+        }
+      },
+      "SeedStep": {
+        "type": "object",
+        "additionalProperties": false,
+        "description": "Exactly one of content, archive or artifact",
+        "properties": {
+          "name": {"type": "string", "description": "File name of inline content"},
+          "content": {"type": "string", "description": "Inline file, run with the service shell unless run is given"},
+          "archive": {"type": "string", "description": "Base64 encoded tar archive"},
+          "artifact": {"type": "string", "description": "Id of an uploaded artifact"},
+          "path": {"type": "string", "pattern": "^/", "default": "/seed"},
+          "run": {"type": "array", "items": {"type": "string"}}
+        }
+      },
+      "SeedResult": {
+        "type": "object",
+        "required": ["step", "ok", "exit_code"],
+        "properties": {
+          "step": {"type": "integer"},
+          "ok": {"type": "boolean"},
+          "exit_code": {"type": "integer"},
+          "output": {"type": "string"},
+          "error": {"type": "string"}
+        }
+      },
+      "Artifact": {
+        "type": "object",
+        "required": ["_id", "name", "size", "sha256"],
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer"},
+          "name": {"type": "string"},
+          "size": {"type": "integer"},
+          "sha256": {"type": "string"},
+          "owner": {"type": "string"},
+          "team": {"type": "string"}
+        }
+      },
+      "InitResponse": {
+        "type": "object",
+        "required": ["status", "requestid"],
+        "properties": {
+          "status": {"type": "string", "enum": ["pending", "queued"]},
+          "requestid": {"type": "string"},
+          "queue_position": {"type": "integer", "description": "Position of a queued testbed, 1 is admitted next"},
+          "eta_seconds": {"type": "integer", "description": "Estimated seconds until a queued testbed is admitted"}
+        }
+      },
+      "Config": {
+        "type": "object",
+        "required": ["settings", "sources"],
+        "properties": {
+          "settings": {"type": "object", "description": "Value of every setting by key, e.g. server.address", "additionalProperties": {"type": "string"}},
+          "sources": {"type": "object", "description": "Where every setting comes from: default, file, env <variable> or flag", "additionalProperties": {"type": "string"}}
+        }
+      },
+      "QueueEntry": {
+        "type": "object",
+        "required": ["_id", "name", "priority", "queued_at", "queue_position"],
+        "properties": {
+          "_id": {"type": "string"},
+          "name": {"type": "string"},
+          "owner": {"type": "string"},
+          "priority": {"type": "string", "enum": ["high", "normal", "low"]},
+          "queued_at": {"type": "string", "format": "date-time"},
+          "queue_position": {"type": "integer"},
+          "eta_seconds": {"type": "integer"}
+        }
+      },
+      "ContainerProp": {
+        "type": "object",
+        "properties": {
+          "image": {"type": "string"},
+          "cid": {"type": "string"},
+          "hostname": {"type": "string"},
+          "ip": {"type": "string"},
+          "svc_port": {"type": "integer"},
+          "rest_port": {"type": "integer"},
+          "seed": {"type": "array", "items": {"$ref": "#/components/schemas/SeedStep"}},
+          "seed_results": {"type": "array", "items": {"$ref": "#/components/schemas/SeedResult"}},
+          "volumes": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeSpec"}},
+          "env": {"type": "array", "items": {"type": "string"}},
+          "resources": {"$ref": "#/components/schemas/Resources"},
+          "image_ref": {"type": "string", "description": "Image the container runs instead of the service image"},
+          "restore": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeArchive"}},
+          "replicas": {"type": "array", "description": "Additional instances of the service", "items": {"$ref": "#/components/schemas/Replica"}}
+        }
+      },
+      "Replica": {
+        "type": "object",
+        "properties": {
+          "index": {"type": "integer", "minimum": 2},
+          "name": {"type": "string", "description": "Container name, <testbed id>-<service>-<index>"},
+          "cid": {"type": "string"},
+          "ip": {"type": "string"},
+          "svc_port": {"type": "integer"},
+          "seed_results": {"type": "array", "items": {"$ref": "#/components/schemas/SeedResult"}},
+          "image_ref": {"type": "string", "description": "Image a planned replica restored from a snapshot is created from"},
+          "restore": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeArchive"}}
+        }
+      },
+      "FaultRequest": {
+        "type": "object",
+        "required": ["type"],
+        "additionalProperties": false,
+        "properties": {
+          "type": {"type": "string", "enum": ["kill", "pause", "disconnect", "netem"]},
+          "instance": {"type": "integer", "minimum": 1, "default": 1, "description": "Instance of the service, see replicas"},
+          "signal": {"type": "string", "default": "SIGKILL", "enum": ["SIGKILL", "SIGTERM", "SIGINT", "SIGHUP", "SIGQUIT", "SIGSTOP", "SIGCONT", "SIGUSR1", "SIGUSR2"]},
+          "duration_seconds": {"type": "integer", "minimum": 0, "maximum": 3600, "description": "Heal the fault after this time, required for pause. Without it the fault lasts until it is healed."},
+          "latency_ms": {"type": "integer", "minimum": 0, "maximum": 60000},
+          "jitter_ms": {"type": "integer", "minimum": 0},
+          "loss_percent": {"type": "number", "minimum": 0, "maximum": 100}
+        }
+      },
+      "Fault": {
+        "type": "object",
+        "properties": {
+          "testbed_id": {"type": "string"},
+          "service": {"type": "string"},
+          "container": {"type": "string"},
+          "type": {"type": "string", "enum": ["kill", "pause", "disconnect", "netem"]},
+          "signal": {"type": "string"},
+          "latency_ms": {"type": "integer"},
+          "jitter_ms": {"type": "integer"},
+          "loss_percent": {"type": "number"},
+          "networks": {"type": "array", "items": {"type": "string"}, "description": "Networks a disconnected container is reconnected to"},
+          "injected": {"type": "string", "format": "date-time"},
+          "expires": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ScaleRequest": {
+        "type": "object",
+        "required": ["replicas"],
+        "additionalProperties": false,
+        "properties": {
+          "replicas": {"type": "integer", "minimum": 1, "maximum": 10, "description": "Number of instances of the service"}
+        }
+      },
+      "ContainerDetail": {
+        "type": "object",
+        "properties": {
+          "image": {"type": "string"},
+          "cid": {"type": "string"},
+          "hostname": {"type": "string"},
+          "ip": {"type": "string"},
+          "svc_port": {"type": "integer"},
+          "rest_port": {"type": "integer"},
+          "name": {"type": "string"},
+          "state": {"type": "string"}
+        }
+      },
+      "TestBed": {
+        "type": "object",
+        "required": ["_id", "name", "status"],
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer", "description": "Creation time, unix seconds"},
+          "name": {"type": "string"},
+          "container": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/ContainerProp"}},
+          "status": {"type": "string", "enum": ["Queued", "initiated", "In-progress", "Completed", "Stopped", "Paused", "Failed", "Expired", "Deleted"]},
+          "template": {"type": "string", "description": "Template name@version the testbed was created from"},
+          "snapshot": {"type": "string", "description": "Snapshot the testbed was created from"},
+          "cloned_from": {"type": "string", "description": "Testbed this testbed was cloned from"},
+          "clone_data": {"type": "boolean", "description": "The data of the source is copied when the clone is provisioned"},
+          "expires_at": {"type": "integer", "description": "Unix seconds after which the testbed is torn down and Expired"},
+          "priority": {"type": "string", "enum": ["high", "normal", "low"]},
+          "queued_at": {"type": "string", "format": "date-time", "description": "When the testbed was queued for host capacity"},
+          "queue_position": {"type": "integer", "description": "Position while Queued, 1 is admitted next"},
+          "eta_seconds": {"type": "integer", "description": "Estimated seconds until a Queued testbed is admitted"},
+          "idempotency_key": {"type": "string"},
+          "owner": {"type": "string"},
+          "team": {"type": "string", "description": "Team of the owner, its members may read and operate the testbed"},
+          "labels": {"$ref": "#/components/schemas/Labels"}
+        }
+      },
+      "CloneRequest": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string", "pattern": "^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$", "description": "Name of the clone, <source name>-clone by default"},
+          "data": {"type": "boolean", "default": false, "description": "Copy the data of the source instead of seeding the clone"}
+        }
+      },
+      "Resources": {
+        "type": "object",
+        "properties": {
+          "memory_mb": {"type": "integer", "minimum": 0},
+          "cpus": {"type": "number", "minimum": 0}
+        }
+      },
+      "SnapshotRequest": {
+        "type": "object",
+        "additionalProperties": false,
+        "properties": {"name": {"type": "string", "maxLength": 255}}
+      },
+      "Snapshot": {
+        "type": "object",
+        "required": ["_id", "testbed_id", "status", "containers"],
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer"},
+          "testbed_id": {"type": "string"},
+          "testbed_name": {"type": "string"},
+          "name": {"type": "string"},
+          "status": {"type": "string", "enum": ["InProgress", "Completed", "Failed"]},
+          "error": {"type": "string"},
+          "containers": {"type": "array", "items": {"$ref": "#/components/schemas/SnapshotContainer"}},
+          "owner": {"type": "string"},
+          "team": {"type": "string"}
+        }
+      },
+      "SnapshotContainer": {
+        "type": "object",
+        "properties": {
+          "image": {"type": "string", "description": "Service"},
+          "image_ref": {"type": "string", "description": "Committed image"},
+          "volumes": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeSpec"}},
+          "env": {"type": "array", "items": {"type": "string"}},
+          "resources": {"$ref": "#/components/schemas/Resources"},
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeArchive"}},
+          "replicas": {"type": "array", "description": "Captures of the additional instances of the service", "items": {"$ref": "#/components/schemas/SnapshotReplica"}}
+        }
+      },
+      "SnapshotReplica": {
+        "type": "object",
+        "required": ["index", "image_ref"],
+        "properties": {
+          "index": {"type": "integer", "minimum": 2},
+          "image_ref": {"type": "string", "description": "Committed image"},
+          "data": {"type": "array", "items": {"$ref": "#/components/schemas/VolumeArchive"}}
+        }
+      },
+      "VolumeArchive": {
+        "type": "object",
+        "required": ["target", "artifact"],
+        "properties": {
+          "target": {"type": "string", "description": "Mount point of the volume"},
+          "artifact": {"type": "string", "description": "Id of the artifact holding the volume content as tar"}
+        }
+      },
+      "TestBedEvent": {
+        "type": "object",
+        "required": ["seq", "testbed_id", "type", "time"],
+        "properties": {
+          "seq": {"type": "integer", "description": "Event id, increasing"},
+          "testbed_id": {"type": "string"},
+          "type": {"type": "string", "enum": ["pull.started", "pull.progress", "pull.done", "container.created", "container.started", "container.healthy", "container.failed", "container.stopped", "container.paused", "container.unpaused", "seed.started", "seed.done", "seed.failed", "snapshot.done", "snapshot.failed", "service.scaled", "fault.injected", "fault.healed", "fault.failed", "testbed.status"]},
+          "container": {"type": "string"},
+          "status": {"type": "string", "description": "New testbed status of testbed.status events"},
+          "message": {"type": "string"},
+          "time": {"type": "string", "format": "date-time"}
+        }
+      },
+      "TestBedPage": {
+        "type": "object",
+        "required": ["items"],
+        "properties": {
+          "items": {"type": "array", "items": {"$ref": "#/components/schemas/TestBed"}},
+          "next_cursor": {"type": "string", "description": "Absent on the last page"}
+        }
+      },
+      "Labels": {"type": "object", "additionalProperties": {"type": "string", "maxLength": 255}},
+      "ContainerResult": {
+        "type": "object",
+        "required": ["name", "ok"],
+        "properties": {"name": {"type": "string"}, "ok": {"type": "boolean"}, "error": {"type": "string"}}
+      },
+      "TestBedActionResponse": {
+        "type": "object",
+        "required": ["id", "status"],
+        "properties": {
+          "id": {"type": "string"},
+          "status": {"type": "string"},
+          "containers": {"type": "array", "nullable": true, "items": {"$ref": "#/components/schemas/ContainerResult"}}
+        }
+      },
+      "TemplateRequest": {
+        "type": "object",
+        "properties": {
+          "name": {"type": "string"},
+          "description": {"type": "string"},
+          "testbed_name": {"type": "string"},
+          "containers": {"type": "array", "items": {"type": "string"}},
+          "vars": {"type": "object", "additionalProperties": {"type": "string"}},
+          "seed": {"type": "object", "description": "Seed steps per service", "additionalProperties": {"type": "array", "items": {"$ref": "#/components/schemas/SeedStep"}}},
+          "volumes": {"type": "object", "description": "Mounts per service", "additionalProperties": {"type": "array", "maxItems": 16, "items": {"$ref": "#/components/schemas/VolumeSpec"}}},
+          "resources": {"type": "object", "description": "Resource limits per service", "additionalProperties": {"$ref": "#/components/schemas/Resources"}},
+          "ttl_seconds": {"type": "integer", "minimum": 0, "description": "Seconds until the created testbeds are torn down"},
+          "priority": {"type": "string", "enum": ["high", "normal", "low"], "description": "Priority class of the created testbeds while they wait for host capacity"}
+        }
+      },
+      "Template": {
+        "type": "object",
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer"},
+          "name": {"type": "string"},
+          "version": {"type": "integer"},
+          "owner": {"type": "string"},
+          "team": {"type": "string", "description": "Team of the owner, its members may publish new versions"},
+          "description": {"type": "string"},
+          "testbed_name": {"type": "string"},
+          "containers": {"type": "array", "items": {"type": "string"}},
+          "vars": {"type": "object", "additionalProperties": {"type": "string"}},
+          "seed": {"type": "object", "description": "Seed steps per service", "additionalProperties": {"type": "array", "items": {"$ref": "#/components/schemas/SeedStep"}}},
+          "volumes": {"type": "object", "description": "Mounts per service", "additionalProperties": {"type": "array", "maxItems": 16, "items": {"$ref": "#/components/schemas/VolumeSpec"}}},
+          "resources": {"type": "object", "description": "Resource limits per service", "additionalProperties": {"$ref": "#/components/schemas/Resources"}},
+          "ttl_seconds": {"type": "integer", "minimum": 0, "description": "Seconds until the created testbeds are torn down"},
+          "priority": {"type": "string", "enum": ["high", "normal", "low"], "description": "Priority class of the created testbeds while they wait for host capacity"}
+        }
+      },
+      "CreateWebhookRequest": {
+        "type": "object",
+        "required": ["url", "secret"],
+        "additionalProperties": false,
+        "properties": {
+          "url": {"type": "string", "pattern": "^https?://"},
+          "events": {"type": "array", "description": "Events to receive, every event when omitted", "items": {"$ref": "#/components/schemas/WebhookEvent"}},
+          "secret": {"type": "string", "minLength": 16, "description": "Key of the HMAC signature, never returned"}
+        }
+      },
+      "WebhookEvent": {"type": "string", "enum": ["testbed.ready", "testbed.failed", "testbed.expired", "testbed.deleted"]},
+      "Webhook": {
+        "type": "object",
+        "required": ["_id", "url"],
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer"},
+          "url": {"type": "string"},
+          "events": {"type": "array", "items": {"$ref": "#/components/schemas/WebhookEvent"}}
+        }
+      },
+      "WebhookDelivery": {
+        "type": "object",
+        "properties": {
+          "_id": {"type": "string"},
+          "_cts": {"type": "integer"},
+          "webhook_id": {"type": "string"},
+          "event": {"$ref": "#/components/schemas/WebhookEvent"},
+          "testbed_id": {"type": "string"},
+          "event_seq": {"type": "integer", "description": "Sequence number of the testbed event delivered, see TestBedEvent"},
+          "payload": {"type": "string", "description": "JSON body POSTed to the webhook"},
+          "status": {"type": "string", "enum": ["pending", "delivered", "failed"]},
+          "attempts": {"type": "integer"},
+          "response_code": {"type": "integer"},
+          "error": {"type": "string"},
+          "last_attempt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "ExecRequest": {
+        "type": "object",
+        "required": ["cmd"],
+        "additionalProperties": false,
+        "properties": {
+          "cmd": {"type": "array", "minItems": 1, "items": {"type": "string"}},
+          "env": {"type": "array", "items": {"type": "string", "pattern": "^[^=]+="}},
+          "workdir": {"type": "string"},
+          "stdin": {"type": "string"},
+          "timeout_seconds": {"type": "integer", "minimum": 1, "maximum": 600, "default": 60}
+        }
+      },
+      "ExecResponse": {
+        "type": "object",
+        "required": ["exit_code", "stdout", "stderr"],
+        "properties": {
+          "exit_code": {"type": "integer"},
+          "stdout": {"type": "string"},
+          "stderr": {"type": "string"},
+          "truncated": {"type": "boolean"}
+        }
+      },
+      "HostContainer": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "names": {"type": "array", "items": {"type": "string"}},
+          "image": {"type": "string"},
+          "state": {"type": "string"},
+          "status": {"type": "string"}
+        }
+      }
+    }
+  }
+}`
@@ -0,0 +1,322 @@
+/*
+ * validate.go checks JSON documents against the schemas of the OpenAPI specification, request bodies
+ * before they reach the handlers and, in the tests, the responses of the handlers.
+ *
+ * Only the subset of JSON schema used by spec.go is supported:
+ *     type, nullable, enum, required, properties, additionalProperties, items,
+ *     minLength, maxLength, pattern, minimum, maximum, minItems, maxItems, $ref
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//FieldError describes a schema violation at a field of the validated document
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+type schema map[string]interface{}
+
+var (
+	patterns   = map[string]*regexp.Regexp{}
+	patternsMu sync.Mutex
+)
+
+//ValidateRequest validates a JSON request body against the request schema of the operation
+//registered for method and path template (e.g. "/api/v1/testbeds/{id}"). A nil result means
+//the body is valid or the operation declares no JSON request body.
+func (s *Spec) ValidateRequest(method, pathTemplate string, body []byte) []FieldError {
+	op := s.operation(method, pathTemplate)
+	if op == nil {
+		return nil
+	}
+	reqBody, ok := op["requestBody"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	required, _ := reqBody["required"].(bool)
+	sch := jsonSchema(reqBody)
+	if sch == nil {
+		return nil
+	}
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if required {
+			return []FieldError{{Field: "body", Message: "request body is required"}}
+		}
+		return nil
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return []FieldError{{Field: "body", Message: "invalid JSON: " + err.Error()}}
+	}
+
+	var errs []FieldError
+	s.validate(sch, doc, "", &errs)
+	return errs
+}
+
+//ValidateResponse validates a response of the operation registered for method and path template
+//against the response the spec declares for its status, the exact status, its range (e.g. "4XX") or
+//"default". A nil result means the status is declared and the body matches its JSON schema.
+//Bodies of other media types are not checked.
+func (s *Spec) ValidateResponse(method, pathTemplate string, status int, body []byte) []FieldError {
+	op := s.operation(method, pathTemplate)
+	if op == nil {
+		return []FieldError{{Field: "operation", Message: "no operation " + method + " " + pathTemplate}}
+	}
+	responses, _ := op["responses"].(map[string]interface{})
+	code := strconv.Itoa(status)
+	var resp map[string]interface{}
+	for _, key := range []string{code, code[:1] + "XX", "default"} {
+		if r, ok := responses[key].(map[string]interface{}); ok {
+			resp = s.resolve(r)
+			break
+		}
+	}
+	if resp == nil {
+		return []FieldError{{Field: "status", Message: code + " is not declared"}}
+	}
+
+	if _, ok := resp["content"]; !ok {
+		if len(bytes.TrimSpace(body)) > 0 {
+			return []FieldError{{Field: "body", Message: "no content is declared for status " + code}}
+		}
+		return nil
+	}
+	sch := jsonSchema(resp)
+	if sch == nil {
+		return nil
+	}
+
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return []FieldError{{Field: "body", Message: "invalid JSON: " + err.Error()}}
+	}
+
+	var errs []FieldError
+	s.validate(sch, doc, "", &errs)
+	return errs
+}
+
+//HasJSONBody reports whether the operation for method and path template declares a JSON request body
+func (s *Spec) HasJSONBody(method, pathTemplate string) bool {
+	op := s.operation(method, pathTemplate)
+	reqBody, ok := op["requestBody"].(map[string]interface{})
+	return ok && jsonSchema(reqBody) != nil
+}
+
+// operation returns the operation object of the spec for method and path template
+func (s *Spec) operation(method, pathTemplate string) map[string]interface{} {
+	paths, _ := s.doc["paths"].(map[string]interface{})
+	item, _ := paths[pathTemplate].(map[string]interface{})
+	op, _ := item[strings.ToLower(method)].(map[string]interface{})
+	return op
+}
+
+// jsonSchema returns the application/json schema of a request body or response object
+func jsonSchema(obj map[string]interface{}) schema {
+	content, _ := obj["content"].(map[string]interface{})
+	media, _ := content["application/json"].(map[string]interface{})
+	sch, _ := media["schema"].(map[string]interface{})
+	return sch
+}
+
+// resolve follows a local $ref of the form #/components/schemas/Name or #/components/responses/Name
+func (s *Spec) resolve(sch schema) schema {
+	for i := 0; i < 8; i++ {
+		ref, ok := sch["$ref"].(string)
+		if !ok {
+			return sch
+		}
+		node := interface{}(s.doc)
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			m, _ := node.(map[string]interface{})
+			node = m[part]
+		}
+		next, ok := node.(map[string]interface{})
+		if !ok {
+			return schema{}
+		}
+		sch = next
+	}
+	return sch
+}
+
+func (s *Spec) validate(sch schema, v interface{}, field string, errs *[]FieldError) {
+	sch = s.resolve(sch)
+	fail := func(format string, args ...interface{}) {
+		name := field
+		if name == "" {
+			name = "body"
+		}
+		*errs = append(*errs, FieldError{Field: name, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil {
+		if nullable, _ := sch["nullable"].(bool); !nullable && sch["type"] != nil {
+			fail("must not be null")
+		}
+		return
+	}
+
+	if enum, ok := sch["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", enum)
+			return
+		}
+	}
+
+	switch sch["type"] {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		props, _ := sch["properties"].(map[string]interface{})
+		if required, ok := sch["required"].([]interface{}); ok {
+			for _, r := range required {
+				if _, present := obj[r.(string)]; !present {
+					*errs = append(*errs, FieldError{Field: join(field, r.(string)), Message: "is required"})
+				}
+			}
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, ok := props[k].(map[string]interface{}); ok {
+				s.validate(p, obj[k], join(field, k), errs)
+				continue
+			}
+			switch extra := sch["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					*errs = append(*errs, FieldError{Field: join(field, k), Message: "is not a known field"})
+				}
+			case map[string]interface{}:
+				s.validate(extra, obj[k], join(field, k), errs)
+			}
+		}
+
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			fail("must be an array")
+			return
+		}
+		if min, ok := number(sch["minItems"]); ok && float64(len(arr)) < min {
+			fail("must contain at least %v items", min)
+		}
+		if max, ok := number(sch["maxItems"]); ok && float64(len(arr)) > max {
+			fail("must contain at most %v items", max)
+		}
+		if items, ok := sch["items"].(map[string]interface{}); ok {
+			for i, item := range arr {
+				s.validate(items, item, fmt.Sprintf("%v[%d]", field, i), errs)
+			}
+		}
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if min, ok := number(sch["minLength"]); ok && float64(len([]rune(str))) < min {
+			fail("must be at least %v characters long", min)
+		}
+		if max, ok := number(sch["maxLength"]); ok && float64(len([]rune(str))) > max {
+			fail("must be at most %v characters long", max)
+		}
+		if pattern, ok := sch["pattern"].(string); ok && !compile(pattern).MatchString(str) {
+			fail("must match %v", pattern)
+		}
+
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("must be a %v", sch["type"])
+			return
+		}
+		if sch["type"] == "integer" {
+			if _, err := n.Int64(); err != nil {
+				fail("must be an integer")
+				return
+			}
+		}
+		f, _ := n.Float64()
+		if min, ok := number(sch["minimum"]); ok && f < min {
+			fail("must be at least %v", min)
+		}
+		if max, ok := number(sch["maximum"]); ok && f > max {
+			fail("must be at most %v", max)
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			fail("must be a boolean")
+		}
+	}
+}
+
+// join builds the dotted path of a nested field
+func join(parent, field string) string {
+	if parent == "" {
+		return field
+	}
+	return parent + "." + field
+}
+
+// number returns a schema keyword as float64
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// compile returns the cached regexp of a schema pattern
+func compile(pattern string) *regexp.Regexp {
+	patternsMu.Lock()
+	defer patternsMu.Unlock()
+	re, ok := patterns[pattern]
+	if !ok {
+		re = regexp.MustCompile(pattern)
+		patterns[pattern] = re
+	}
+	return re
+}
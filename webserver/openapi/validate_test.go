@@ -0,0 +1,170 @@
+/*
+ * validate_test.go checks the JSON schema subset of validate.go on a small specification.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package openapi
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testSpecJSON = `{
+  "openapi": "3.0.3",
+  "paths": {
+    "/things": {
+      "post": {
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Thing"}}}},
+        "responses": {
+          "201": {"description": "Created", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Thing"}}}},
+          "204": {"description": "Nothing"},
+          "4XX": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "get": {
+        "responses": {
+          "200": {"description": "Listing", "content": {"text/plain": {"schema": {"type": "string"}}}},
+          "default": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "responses": {
+      "Error": {"description": "Error", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}}
+    },
+    "schemas": {
+      "Name": {"$ref": "#/components/schemas/Slug"},
+      "Slug": {"type": "string", "pattern": "^[a-z][a-z0-9-]*$", "maxLength": 8},
+      "Thing": {
+        "type": "object",
+        "required": ["name", "size"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"$ref": "#/components/schemas/Name"},
+          "size": {"type": "integer", "minimum": 1},
+          "note": {"type": "string", "nullable": true},
+          "owner": {"type": "string"},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}},
+          "tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "enum": ["a", "b"]}}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {"error": {"type": "object", "required": ["code"], "properties": {"code": {"type": "string"}}}}
+      }
+    }
+  }
+}`
+
+var testSpec = mustParse(testSpecJSON)
+
+// fields returns the sorted fields of errs
+func fields(errs []FieldError) []string {
+	names := []string{}
+	for _, e := range errs {
+		names = append(names, e.Field)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestValidateRequest(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"valid", `{"name": "abc", "size": 1}`, []string{}},
+		{"valid with every field", `{"name": "abc", "size": 2, "note": null, "owner": "x", "labels": {"k": "v"}, "tags": ["a", "b"]}`, []string{}},
+		{"required", `{}`, []string{"name", "size"}},
+		{"ref resolved twice", `{"name": 1, "size": 1}`, []string{"name"}},
+		{"pattern", `{"name": "Abc", "size": 1}`, []string{"name"}},
+		{"max length", `{"name": "abcdefghi", "size": 1}`, []string{"name"}},
+		{"minimum", `{"name": "abc", "size": 0}`, []string{"size"}},
+		{"integer", `{"name": "abc", "size": 1.5}`, []string{"size"}},
+		{"unknown field", `{"name": "abc", "size": 1, "colour": "red"}`, []string{"colour"}},
+		{"additional properties schema", `{"name": "abc", "size": 1, "labels": {"k": 1}}`, []string{"labels.k"}},
+		{"nullable", `{"name": "abc", "size": 1, "note": null}`, []string{}},
+		{"not nullable", `{"name": "abc", "size": 1, "owner": null}`, []string{"owner"}},
+		{"enum items", `{"name": "abc", "size": 1, "tags": ["c"]}`, []string{"tags[0]"}},
+		{"max items", `{"name": "abc", "size": 1, "tags": ["a", "a", "a"]}`, []string{"tags"}},
+		{"type", `[]`, []string{"body"}},
+		{"missing body", ``, []string{"body"}},
+		{"invalid JSON", `{`, []string{"body"}},
+	}
+	for _, c := range cases {
+		got := fields(testSpec.ValidateRequest("POST", "/things", []byte(c.body)))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got errors at %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestValidateRequestWithoutSchema(t *testing.T) {
+	if errs := testSpec.ValidateRequest("GET", "/things", []byte(`anything`)); errs != nil {
+		t.Errorf("operation without request body: %v", errs)
+	}
+	if errs := testSpec.ValidateRequest("POST", "/unknown", []byte(`{`)); errs != nil {
+		t.Errorf("unknown operation: %v", errs)
+	}
+	if !testSpec.HasJSONBody("POST", "/things") || testSpec.HasJSONBody("GET", "/things") {
+		t.Error("HasJSONBody does not match the request bodies of the spec")
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		status int
+		body   string
+		want   []string
+	}{
+		{"declared status", "POST", "/things", 201, `{"name": "abc", "size": 1}`, []string{}},
+		{"body diverges", "POST", "/things", 201, `{"name": "abc"}`, []string{"size"}},
+		{"status range and response ref", "POST", "/things", 404, `{"error": {"code": "not_found"}}`, []string{}},
+		{"error diverges", "POST", "/things", 409, `{"message": "conflict"}`, []string{"error"}},
+		{"undeclared status", "POST", "/things", 500, `{"error": {"code": "internal_error"}}`, []string{"status"}},
+		{"default", "GET", "/things", 503, `{"error": {"code": "storage_unavailable"}}`, []string{}},
+		{"other media type", "GET", "/things", 200, `plain text`, []string{}},
+		{"no content", "POST", "/things", 204, ``, []string{}},
+		{"unexpected content", "POST", "/things", 204, `{}`, []string{"body"}},
+		{"invalid JSON", "POST", "/things", 201, `{`, []string{"body"}},
+		{"unknown operation", "DELETE", "/things", 204, ``, []string{"operation"}},
+	}
+	for _, c := range cases {
+		got := fields(testSpec.ValidateResponse(c.method, c.path, c.status, []byte(c.body)))
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v: got errors at %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestDefaultSpecResolves(t *testing.T) {
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if ref, ok := node["$ref"].(string); ok {
+				if len(Default.resolve(schema{"$ref": ref})) == 0 {
+					t.Errorf("%v does not resolve", ref)
+				}
+			}
+			for _, child := range node {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range node {
+				walk(child)
+			}
+		}
+	}
+	walk(Default.doc)
+}
@@ -0,0 +1,349 @@
+/*
+ * queue.go admits testbeds only while the host has capacity for them, the others wait Queued.
+ *
+ *     GET /api/v1/queue    queued testbeds in admission order, with their position and ETA
+ *
+ * The host capacity is configured by (see config.go)
+ *     capacity.max_containers     containers on the host, by default capacity.containers_per_cpu (16)
+ *                                 per CPU of the docker host
+ *     capacity.memory_reserve_mb  memory left to the host, the rest of the docker host memory goes to
+ *                                 the memory limits of testbed containers, 1024 by default
+ * Usage is computed from the store like quotas (see quota.go), services without limits count with the
+ * container defaults or the memory estimate of their image. The containers running on the host count
+ * when there are more of them than provisioned testbeds hold, e.g. containers not started by the server.
+ *
+ * A created testbed which does not fit, or arrives while others are waiting, is recorded Queued. Queued
+ * testbeds are admitted by priority class (high, normal, low) and in arrival order within a class, as soon
+ * as the one at the head fits. Their time to live starts once they are admitted. The ETA is estimated from
+ * the recent admission rate and is only known once the queue moved. Clones are queued the same way.
+ * Scaling is not queued, added instances which do not fit are refused with 429 (see scale.go).
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// admissionInterval is how often the queue is checked when no testbed status changed
+const admissionInterval = 10 * time.Second
+
+// defaultPriority is the priority class of testbeds which do not ask for one
+const defaultPriority = "normal"
+
+var (
+	// priorityRanks orders the priority classes, higher ranks are admitted first
+	priorityRanks = map[string]int{"high": 2, "normal": 1, "low": 0}
+
+	// provisionedStatuses are the statuses of testbeds holding host capacity
+	provisionedStatuses = []string{db.StatusInitiated, db.StatusInProgress, db.StatusCompleted, db.StatusStopped, db.StatusPaused, db.StatusFailed}
+
+	// Host capacity set from the config, without maxHostContainers it is derived from the host CPUs
+	maxHostContainers int
+	containersPerCPU  = 16
+	memoryReserveMB   int64
+)
+
+// admission serializes admission decisions. interval is the moving average of the time between two
+// admissions from the queue, it estimates the ETA of queued testbeds.
+var admission = struct {
+	mu        sync.Mutex
+	wake      chan struct{}
+	lastAdmit time.Time
+	interval  time.Duration
+}{wake: make(chan struct{}, 1)}
+
+//queueEntry is a queued testbed in the queue listing
+type queueEntry struct {
+	ID         string    `json:"_id"`
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner,omitempty"`
+	Priority   string    `json:"priority"`
+	QueuedAt   time.Time `json:"queued_at"`
+	Position   int       `json:"queue_position"`
+	ETASeconds int       `json:"eta_seconds,omitempty"`
+}
+
+// hostCapacity returns what testbeds may hold on the host, and the number of containers running on it
+func hostCapacity() (capacity usage, running int, err error) {
+	info, err := dockercontainer.HostInfo(ctx)
+	if err != nil {
+		return usage{}, 0, err
+	}
+	capacity = usage{Containers: maxHostContainers, MemoryMB: info.MemTotal>>20 - memoryReserveMB}
+	if capacity.Containers == 0 {
+		capacity.Containers = info.NCPU * containersPerCPU
+	}
+	if capacity.Containers < 1 {
+		capacity.Containers = 1
+	}
+	if capacity.MemoryMB < 1 {
+		capacity.MemoryMB = 1
+	}
+	return capacity, info.ContainersRunning, nil
+}
+
+// fitsHost reports whether demand fits next to the provisioned testbeds, and whether it could fit at all
+func fitsHost(demand usage) (fits bool, possible bool, err error) {
+	capacity, running, err := hostCapacity()
+	if err != nil {
+		return false, false, err
+	}
+	committed, err := storeUsage(db.TestBedQuery{Status: provisionedStatuses})
+	if err != nil {
+		return false, false, err
+	}
+	// Testbeds being provisioned do not run yet, containers the store does not know of do
+	if running > committed.Containers {
+		committed.Containers = running
+	}
+	exceeds := func(u usage) bool {
+		return u.Containers > capacity.Containers || u.MemoryMB > capacity.MemoryMB
+	}
+	return !exceeds(committed.add(demand)), !exceeds(demand), nil
+}
+
+/*
+  admitOrQueue decides whether a new testbed is provisioned now or Queued, setting its status, and writes
+  the 403 response for testbeds larger than the host. The caller records the testbed and calls release,
+  no other testbed is admitted in between.
+*/
+func admitOrQueue(w http.ResponseWriter, tb *db.TestBed, priority string) (release func(), ok bool) {
+	admission.mu.Lock()
+
+	queue, err := queuedTestBeds()
+	if err != nil {
+		admission.mu.Unlock()
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not look up the admission queue, nothing was provisioned")
+		return nil, false
+	}
+	demand := testbedUsage(tb.Container)
+	fits, possible, err := fitsHost(demand)
+	if err != nil {
+		// Without the host capacity the testbed is provisioned, docker reports what it cannot do
+		logging.Error.Println("Could not compute host capacity: ", err)
+		fits, possible = true, true
+	}
+	if !possible {
+		admission.mu.Unlock()
+		writeError(w, http.StatusForbidden, errCodeQuotaExceeded, fmt.Sprintf("Testbed needs %v containers and %v MB memory, more than the host can hold", demand.Containers, demand.MemoryMB))
+		return nil, false
+	}
+
+	if !fits || len(queue) > 0 {
+		now := time.Now()
+		tb.Status = db.StatusQueued
+		tb.Priority = priority
+		if tb.Priority == "" {
+			tb.Priority = defaultPriority
+		}
+		tb.QueuedAt = &now
+	}
+	return admission.mu.Unlock, true
+}
+
+// runAdmission admits queued testbeds whenever a testbed status changes, and every admissionInterval
+func runAdmission(ctx context.Context) {
+	ticker := time.NewTicker(admissionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-admission.wake:
+		}
+		admitQueued()
+	}
+}
+
+// wakeAdmission makes the admission check the queue, e.g. because a testbed released its containers
+func wakeAdmission() {
+	select {
+	case admission.wake <- struct{}{}:
+	default:
+	}
+}
+
+// admitQueued provisions queued testbeds in order for as long as the head of the queue fits
+func admitQueued() {
+	admission.mu.Lock()
+	defer admission.mu.Unlock()
+
+	queue, err := queuedTestBeds()
+	if err != nil {
+		logging.Error.Println("Could not read the admission queue: ", err)
+		return
+	}
+	for len(queue) > 0 {
+		tb := queue[0]
+		fits, _, err := fitsHost(testbedUsage(tb.Container))
+		if err != nil {
+			logging.Error.Println("Could not compute host capacity: ", err)
+			return
+		}
+		if !fits {
+			return
+		}
+		admit(tb)
+		queue = queue[1:]
+	}
+	// The next admission does not measure the time the queue was empty
+	admission.lastAdmit = time.Time{}
+}
+
+// admit provisions a queued testbed, its time to live is moved by the time it waited
+func admit(tb db.TestBed) {
+	waited := time.Duration(0)
+	if tb.QueuedAt != nil {
+		waited = time.Since(*tb.QueuedAt)
+	}
+	expires := tb.ExpiresAt
+	if expires > 0 {
+		expires += int(waited.Seconds())
+	}
+
+	admitted, err := db.AdmitTestBed(ctx, tb.ID, expires)
+	if err != nil {
+		logging.Error.Println("Could not admit testbed ", tb.ID, ": ", err)
+		return
+	}
+	if !admitted {
+		return
+	}
+
+	now := time.Now()
+	if !admission.lastAdmit.IsZero() {
+		gap := now.Sub(admission.lastAdmit)
+		if admission.interval == 0 {
+			admission.interval = gap
+		} else {
+			admission.interval = (3*admission.interval + gap) / 4
+		}
+	}
+	admission.lastAdmit = now
+
+	logging.Info.Println("Admitted testbed ", tb.ID, " after ", waited.Round(time.Second), " in the queue")
+	events.Publish(ctx, db.TestBedEvent{TestBedID: tb.ID, Type: events.StatusChanged, Status: db.StatusInitiated,
+		Message: "Admitted after " + waited.Round(time.Second).String() + " in the queue"})
+	if tb.CloneData {
+		go provisionAdmittedClone(tb)
+		return
+	}
+	go pullDockerImageAndCreateContainer(tb.ID, tb.Container)
+}
+
+/*
+  admitInstances checks that the host has capacity for instances added to a testbed, writing the 429
+  response while it has not or testbeds are queued, and the 403 response if it never will. The caller
+  records the instances and calls release, no testbed is admitted in between.
+*/
+func admitInstances(w http.ResponseWriter, demand usage) (release func(), ok bool) {
+	admission.mu.Lock()
+
+	queue, err := queuedTestBeds()
+	if err != nil {
+		admission.mu.Unlock()
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not look up the admission queue, nothing was provisioned")
+		return nil, false
+	}
+	fits, possible, err := fitsHost(demand)
+	if err != nil {
+		// Without the host capacity the instances are added, docker reports what it cannot do
+		logging.Error.Println("Could not compute host capacity: ", err)
+		fits, possible = true, true
+	}
+	if !possible {
+		admission.mu.Unlock()
+		writeError(w, http.StatusForbidden, errCodeQuotaExceeded, fmt.Sprintf("Instances need %v containers and %v MB memory, more than the host can hold", demand.Containers, demand.MemoryMB))
+		return nil, false
+	}
+	if !fits || len(queue) > 0 {
+		admission.mu.Unlock()
+		writeError(w, http.StatusTooManyRequests, errCodeQuotaExceeded, fmt.Sprintf("Host has no capacity for %v more containers and %v MB memory, %v testbeds are queued. Retry later", demand.Containers, demand.MemoryMB, len(queue)))
+		return nil, false
+	}
+	return admission.mu.Unlock, true
+}
+
+// queuedTestBeds returns the Queued testbeds in admission order
+func queuedTestBeds() ([]db.TestBed, error) {
+	queue, err := db.ListTestBeds(ctx, db.TestBedQuery{Status: []string{db.StatusQueued}})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(queue, func(i, j int) bool {
+		a, b := queue[i], queue[j]
+		if priorityRanks[a.Priority] != priorityRanks[b.Priority] {
+			return priorityRanks[a.Priority] > priorityRanks[b.Priority]
+		}
+		if a.QueuedAt != nil && b.QueuedAt != nil && !a.QueuedAt.Equal(*b.QueuedAt) {
+			return a.QueuedAt.Before(*b.QueuedAt)
+		}
+		return a.ID < b.ID
+	})
+	return queue, nil
+}
+
+// queueETA returns the estimated seconds until the testbed at position is admitted, 0 when unknown
+func queueETA(position int) int {
+	admission.mu.Lock()
+	interval := admission.interval
+	admission.mu.Unlock()
+	return int((time.Duration(position) * interval).Seconds())
+}
+
+// setQueuePosition sets the position and ETA of a Queued testbed
+func setQueuePosition(tb *db.TestBed) {
+	queue, err := queuedTestBeds()
+	if err != nil {
+		logging.Error.Println(err)
+		return
+	}
+	for i, queued := range queue {
+		if queued.ID == tb.ID {
+			tb.QueuePosition = i + 1
+			tb.ETASeconds = queueETA(i + 1)
+			return
+		}
+	}
+}
+
+// Handler for GET /api/v1/queue, lists the queued testbeds visible to the caller in admission order
+func queuehandler(w http.ResponseWriter, r *http.Request) {
+	queue, err := queuedTestBeds()
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not read the admission queue")
+		return
+	}
+
+	p := requestPrincipal(r)
+	entries := []queueEntry{}
+	for i, tb := range queue {
+		if !p.can(tb.Owner, tb.Team, accessRead) {
+			continue
+		}
+		entry := queueEntry{ID: tb.ID, Name: tb.Name, Owner: tb.Owner, Priority: tb.Priority, Position: i + 1, ETASeconds: queueETA(i + 1)}
+		if tb.QueuedAt != nil {
+			entry.QueuedAt = *tb.QueuedAt
+		}
+		entries = append(entries, entry)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
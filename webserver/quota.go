@@ -0,0 +1,381 @@
+/*
+ * quota.go limits what the testbeds of an owner, a team and the whole host may hold.
+ *
+ * Quotas are read from the JSON file named by the quota.config setting (see config.go):
+ *     {"default":            {"max_testbeds": 20, "max_containers": 40, "max_memory_mb": 16384, "max_cpus": 8, "max_ttl_seconds": 86400},
+ *      "owners":             {"ci": {"max_testbeds": 100, "max_containers": 200, "max_ttl_seconds": 7200}},
+ *      "teams":              {"payments": {"max_memory_mb": 65536}},
+ *      "host":               {"max_containers": 500},
+ *      "container_defaults": {"memory_mb": 512, "cpus": 1}}
+ *
+ * An owner is limited by its own quota or the default one, by the quota of its team when there is one and by
+ * the host quota. Usage is computed from the store, every testbed which is neither Expired nor Deleted counts,
+ * queued ones included (see queue.go),
+ * services without resource limits count with the container defaults, which they are also created with.
+ * Without a memory limit a service counts with the memory estimate of its image, or capacity.default_memory_mb.
+ * A testbed which would exceed a quota that is used up is answered with 429, one which alone exceeds a quota
+ * or asks for a longer time to live than allowed with 403.
+ *
+ * Testbeds live for ttl_seconds, or the max_ttl_seconds of their quotas when none is asked for. Once that
+ * elapsed they are torn down and Expired. Without the config file nothing is limited and testbeds live
+ * until they are deleted unless they ask for a time to live.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"webserver/db"
+	"webserver/logging"
+)
+
+// reapInterval is how often testbeds are checked for an elapsed time to live
+const reapInterval = 30 * time.Second
+
+// activeStatuses are the statuses of the testbeds counting towards quotas, queued ones included
+var activeStatuses = append([]string{db.StatusQueued}, provisionedStatuses...)
+
+var (
+	// imageMemoryEstimates are the MB a service image typically uses when it runs without a memory limit
+	imageMemoryEstimates = map[string]int64{"mongo": 1024, "kafka": 1024, "zookeeper": 512, "redis": 256}
+
+	// defaultMemoryMB is counted for services without limits whose image has no estimate, set from the config
+	defaultMemoryMB int64 = 512
+)
+
+// quotas holds the quota config, nil when nothing is limited. Checking a quota and recording the testbed
+// it admits happen under mu, so that concurrent requests cannot overrun it together.
+var quotas = struct {
+	mu     sync.Mutex
+	config *quotaConfig
+}{}
+
+//quotaConfig is the content of the quota config file
+type quotaConfig struct {
+	Default           quota            `json:"default"`
+	Owners            map[string]quota `json:"owners"`
+	Teams             map[string]quota `json:"teams"`
+	Host              quota            `json:"host"`
+	ContainerDefaults db.Resources     `json:"container_defaults"`
+}
+
+//quota limits the testbeds of a scope, zero values do not limit
+type quota struct {
+	MaxTestBeds   int     `json:"max_testbeds"`
+	MaxContainers int     `json:"max_containers"`
+	MaxMemoryMB   int64   `json:"max_memory_mb"`
+	MaxCPUs       float64 `json:"max_cpus"`
+	MaxTTLSeconds int     `json:"max_ttl_seconds"`
+}
+
+//usage is what testbeds hold, or what a request asks for
+type usage struct {
+	TestBeds   int
+	Containers int
+	MemoryMB   int64
+	CPUs       float64
+}
+
+// quotaScope is a quota with the testbeds it applies to
+type quotaScope struct {
+	name  string // e.g. owner ci
+	limit quota
+	query db.TestBedQuery
+}
+
+// loadQuotas reads a quota config file
+func loadQuotas(path string) (*quotaConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := quotaConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid quota config %v: %v", path, err)
+	}
+
+	limits := map[string]quota{"default": config.Default, "host": config.Host}
+	for name, q := range config.Owners {
+		limits["owners."+name] = q
+	}
+	for name, q := range config.Teams {
+		limits["teams."+name] = q
+	}
+	for name, q := range limits {
+		if q.MaxTestBeds < 0 || q.MaxContainers < 0 || q.MaxMemoryMB < 0 || q.MaxCPUs < 0 || q.MaxTTLSeconds < 0 {
+			return nil, fmt.Errorf("invalid quota config %v: %v must not have negative limits", path, name)
+		}
+	}
+	if config.ContainerDefaults.MemoryMB < 0 || config.ContainerDefaults.CPUs < 0 {
+		return nil, fmt.Errorf("invalid quota config %v: container_defaults must not be negative", path)
+	}
+	return &config, nil
+}
+
+// initQuotas loads the quotas of a quota config file, it reports whether testbeds are limited
+func initQuotas(path string) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	config, err := loadQuotas(path)
+	if err != nil {
+		return false, err
+	}
+	quotas.config = config
+	return true, nil
+}
+
+// quotaScopes returns the quotas applying to the testbeds of owner and team
+func quotaScopes(owner, team string) []quotaScope {
+	config := quotas.config
+	var scopes []quotaScope
+	if owner != "" {
+		limit, ok := config.Owners[owner]
+		if !ok {
+			limit = config.Default
+		}
+		scopes = append(scopes, quotaScope{name: "owner " + owner, limit: limit, query: db.TestBedQuery{Owner: owner, Status: activeStatuses}})
+	}
+	if limit, ok := config.Teams[team]; ok && team != "" {
+		scopes = append(scopes, quotaScope{name: "team " + team, limit: limit, query: db.TestBedQuery{Team: team, Status: activeStatuses}})
+	}
+	if config.Host != (quota{}) {
+		scopes = append(scopes, quotaScope{name: "the host", limit: config.Host, query: db.TestBedQuery{Status: activeStatuses}})
+	}
+	return scopes
+}
+
+/*
+  reserveQuota checks that the testbeds of owner and team may hold demand on top of what they hold,
+  writing the 429 or 403 response if they may not. On success the caller records what it admitted and
+  calls release, no other request is admitted in between.
+*/
+func reserveQuota(w http.ResponseWriter, owner, team string, demand usage) (release func(), ok bool) {
+	if quotas.config == nil {
+		return func() {}, true
+	}
+
+	quotas.mu.Lock()
+	for _, scope := range quotaScopes(owner, team) {
+		if needed, limit := scope.limit.exceededBy(demand); limit != "" {
+			quotas.mu.Unlock()
+			writeError(w, http.StatusForbidden, errCodeQuotaExceeded, fmt.Sprintf("Request needs %v, more than the quota of %v of %v", needed, limit, scope.name))
+			return nil, false
+		}
+		used, err := storeUsage(scope.query)
+		if err != nil {
+			quotas.mu.Unlock()
+			logging.Error.Println(err)
+			writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not compute quota usage, nothing was provisioned")
+			return nil, false
+		}
+		if _, limit := scope.limit.exceededBy(used.add(demand)); limit != "" {
+			quotas.mu.Unlock()
+			writeError(w, http.StatusTooManyRequests, errCodeQuotaExceeded, fmt.Sprintf("Quota of %v of %v is used up, it holds %v. Delete testbeds or wait for them to expire", limit, scope.name, used))
+			return nil, false
+		}
+	}
+	return quotas.mu.Unlock, true
+}
+
+// quotaTTL returns the time to live in seconds of a testbed of owner and team, the requested one or
+// the longest allowed when none is requested, 0 for no limit. A requested time to live longer than
+// allowed is answered with 403.
+func quotaTTL(w http.ResponseWriter, owner, team string, requested int) (int, bool) {
+	if quotas.config == nil {
+		return requested, true
+	}
+
+	allowed, scopeName := 0, ""
+	for _, scope := range quotaScopes(owner, team) {
+		if max := scope.limit.MaxTTLSeconds; max > 0 && (allowed == 0 || max < allowed) {
+			allowed, scopeName = max, scope.name
+		}
+	}
+	if allowed > 0 && requested > allowed {
+		writeError(w, http.StatusForbidden, errCodeQuotaExceeded, fmt.Sprintf("Testbeds of %v live at most %v seconds", scopeName, allowed),
+			fieldError{Field: "ttl_seconds", Message: "must be at most " + strconv.Itoa(allowed)})
+		return 0, false
+	}
+	if requested == 0 {
+		return allowed, true
+	}
+	return requested, true
+}
+
+// storeUsage sums what the testbeds matching a query hold
+func storeUsage(q db.TestBedQuery) (usage, error) {
+	testbeds, err := db.ListTestBeds(ctx, q)
+	if err != nil {
+		return usage{}, err
+	}
+	used := usage{}
+	for _, tb := range testbeds {
+		used = used.add(testbedUsage(tb.Container))
+	}
+	return used, nil
+}
+
+// testbedUsage returns what a testbed with containers holds
+func testbedUsage(containers []db.ContainerProp) usage {
+	u := usage{TestBeds: 1}
+	for _, cnt := range containers {
+		u = u.add(instanceUsage(cnt, 1+len(cnt.Replicas)))
+	}
+	return u
+}
+
+// instanceUsage returns what n instances of a testbed service hold, services without a memory limit
+// count with the memory estimate of their image
+func instanceUsage(cnt db.ContainerProp, n int) usage {
+	res := containerResources(cnt.Resources)
+	u := usage{Containers: n, MemoryMB: int64(n) * imageMemoryMB(cnt.Image)}
+	if res != nil {
+		if res.MemoryMB > 0 {
+			u.MemoryMB = int64(n) * res.MemoryMB
+		}
+		u.CPUs = float64(n) * res.CPUs
+	}
+	return u
+}
+
+// imageMemoryMB returns the memory a container of image uses without limits, defaultMemoryMB for images without an estimate
+func imageMemoryMB(image string) int64 {
+	if mb, ok := imageMemoryEstimates[image]; ok {
+		return mb
+	}
+	return defaultMemoryMB
+}
+
+// containerResources returns the resource limits of a service, the container defaults when it has none
+func containerResources(res *db.Resources) *db.Resources {
+	if res != nil && (res.MemoryMB > 0 || res.CPUs > 0) {
+		return res
+	}
+	if quotas.config == nil || quotas.config.ContainerDefaults == (db.Resources{}) {
+		return nil
+	}
+	defaults := quotas.config.ContainerDefaults
+	return &defaults
+}
+
+func (u usage) add(o usage) usage {
+	return usage{
+		TestBeds:   u.TestBeds + o.TestBeds,
+		Containers: u.Containers + o.Containers,
+		MemoryMB:   u.MemoryMB + o.MemoryMB,
+		CPUs:       u.CPUs + o.CPUs,
+	}
+}
+
+func (u usage) String() string {
+	return fmt.Sprintf("%v testbeds, %v containers, %v MB memory and %v CPUs", u.TestBeds, u.Containers, u.MemoryMB, u.CPUs)
+}
+
+// exceededBy returns the first limit of the quota which u exceeds along with what u has of it,
+// empty strings when it exceeds none
+func (q quota) exceededBy(u usage) (has, limit string) {
+	switch {
+	case q.MaxTestBeds > 0 && u.TestBeds > q.MaxTestBeds:
+		return fmt.Sprintf("%v testbeds", u.TestBeds), fmt.Sprintf("%v testbeds", q.MaxTestBeds)
+	case q.MaxContainers > 0 && u.Containers > q.MaxContainers:
+		return fmt.Sprintf("%v containers", u.Containers), fmt.Sprintf("%v containers", q.MaxContainers)
+	case q.MaxMemoryMB > 0 && u.MemoryMB > q.MaxMemoryMB:
+		return fmt.Sprintf("%v MB memory", u.MemoryMB), fmt.Sprintf("%v MB memory", q.MaxMemoryMB)
+	case q.MaxCPUs > 0 && u.CPUs > q.MaxCPUs:
+		return fmt.Sprintf("%v CPUs", u.CPUs), fmt.Sprintf("%v CPUs", q.MaxCPUs)
+	}
+	return "", ""
+}
+
+// validateResources returns the field level errors of the resource limits of a createenv request
+func validateResources(post postRequestBody) []fieldError {
+	var errs []fieldError
+
+	services := make([]string, 0, len(post.Resources))
+	for svc := range post.Resources {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+
+	for _, svc := range services {
+		res := post.Resources[svc]
+		found := false
+		for _, cnt := range post.Containers {
+			found = found || cnt == svc
+		}
+		switch {
+		case !found:
+			errs = append(errs, fieldError{Field: "resources." + svc, Message: "service is not part of the testbed"})
+		case res == nil:
+		case res.MemoryMB < 0:
+			errs = append(errs, fieldError{Field: "resources." + svc + ".memory_mb", Message: "must not be negative"})
+		case res.CPUs < 0:
+			errs = append(errs, fieldError{Field: "resources." + svc + ".cpus", Message: "must not be negative"})
+		}
+	}
+	return errs
+}
+
+// expiresAt returns the expiry of a testbed living ttl seconds from now, 0 for never
+func expiresAt(ttl int) int {
+	if ttl <= 0 {
+		return 0
+	}
+	return int(time.Now().Unix()) + ttl
+}
+
+// reapExpiredTestBeds tears down the testbeds whose time to live elapsed every reapInterval
+func reapExpiredTestBeds(ctx context.Context) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		testbeds, err := db.ListExpiredTestBeds(ctx, int(time.Now().Unix()))
+		if err != nil {
+			logging.Error.Println("Could not list expired testbeds: ", err)
+			continue
+		}
+		for _, tb := range testbeds {
+			// Testbeds being provisioned are torn down once they settled
+			if isSettled(tb.Status) {
+				expireTestBed(tb)
+			}
+		}
+	}
+}
+
+// expireTestBed removes the containers of a testbed whose time to live elapsed, it is Expired once
+// every container is gone and retried on the next round otherwise
+func expireTestBed(tb db.TestBed) {
+	logging.Info.Println("Time to live of testbed ", tb.ID, " elapsed, tearing it down")
+	var failed []string
+	for _, cnt := range tb.Container {
+		if res := removeContainer(tb.ID, cnt); !res.OK {
+			failed = append(failed, cnt.Image+": "+res.Error)
+		}
+	}
+	if len(failed) > 0 {
+		logging.Error.Println("Could not tear down expired testbed ", tb.ID, ": ", strings.Join(failed, ", "))
+		return
+	}
+	setTestBedStatus(tb.ID, db.StatusExpired, "Time to live elapsed")
+}
@@ -0,0 +1,229 @@
+/*
+ * routes_test.go calls every route of newRouter and checks the responses against the OpenAPI spec.
+ *
+ * The store and docker are the ones named by PROVISIONER_TEST_MONGO_URI and DOCKER_HOST. Without them
+ * unreachable backends are used, and the handlers are checked with the error responses they answer then.
+ * The resources read by the loaders are answered from fixtures to check the responses of their success.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/openapi"
+)
+
+// routeTimeout ends streaming responses, e.g. of events or logs
+const routeTimeout = 2 * time.Second
+
+// routeVars are the values of the path variables of the tested routes
+var routeVars = map[string]string{"id": "testbed-missing", "name": "redis", "tag": "testbed-missing"}
+
+// routeBodies are valid request bodies of the routes which take one, by method and path template
+var routeBodies = map[string]string{
+	"POST /api/v1/testbeds": `{"name": "routes-test", "containers": ["redis"]}`,
+	"POST /set/createenv":   `{"name": "routes-test", "containers": ["redis"]}`,
+	"POST /testbeds":        `{"name": "routes-test", "containers": ["redis"]}`,
+	"POST /api/v1/testbeds/{id}/containers/{name}/exec":   `{"cmd": ["true"]}`,
+	"PUT /api/v1/testbeds/{id}/containers/{name}/files":   "routes-test",
+	"POST /api/v1/testbeds/{id}/containers/{name}/faults": `{"type": "kill"}`,
+	"PATCH /api/v1/testbeds/{id}/services/{name}":         `{"replicas": 2}`,
+	"POST /api/v1/templates":                              `{"name": "routes-test", "testbed_name": "routes-test", "containers": ["redis"]}`,
+	"PUT /api/v1/templates/{name}":                        `{"testbed_name": "routes-test", "containers": ["redis"]}`,
+	"POST /templates":                                     `{"name": "routes-test", "testbed_name": "routes-test", "containers": ["redis"]}`,
+	"PUT /templates/{name}":                               `{"testbed_name": "routes-test", "containers": ["redis"]}`,
+	"POST /api/v1/webhooks":                               `{"url": "http://127.0.0.1:1/hook", "secret": "0123456789abcdef"}`,
+	"POST /api/v1/artifacts":                              "dump",
+}
+
+// routeQueries are the query strings of the routes which need one, by method and path template
+var routeQueries = map[string]string{
+	"PUT /api/v1/testbeds/{id}/containers/{name}/files": "path=/tmp/routes-test",
+	"GET /api/v1/testbeds/{id}/containers/{name}/files": "path=/tmp",
+}
+
+var connectBackends sync.Once
+
+// testBackends connects the store and docker of the environment, or unreachable ones
+func testBackends(t *testing.T) {
+	connectBackends.Do(func() {
+		uri := os.Getenv("PROVISIONER_TEST_MONGO_URI")
+		if uri == "" {
+			uri = "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=200&connectTimeoutMS=200"
+		}
+		if err := db.Connect(uri, "provisionertest"); err != nil {
+			t.Fatal(err)
+		}
+		host := os.Getenv("DOCKER_HOST")
+		if host == "" {
+			host = "tcp://127.0.0.1:1"
+		}
+		if err := dockercontainer.Connect(host, ""); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// testRoute is a method and path template of newRouter
+type testRoute struct {
+	method, template string
+}
+
+// routes returns every method and path template of newRouter
+func routes(t *testing.T, r *mux.Router) []testRoute {
+	var all []testRoute
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			all = append(all, testRoute{method, template})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return all
+}
+
+// routePath fills the path variables of a template
+func routePath(template string) string {
+	path := template
+	for name, value := range routeVars {
+		path = strings.Replace(path, "{"+name+"}", value, -1)
+	}
+	return path
+}
+
+func TestRoutesAnswerAsSpecified(t *testing.T) {
+	testBackends(t)
+	router := newRouter()
+
+	for _, route := range routes(t, router) {
+		route := route
+		t.Run(route.method+" "+route.template, func(t *testing.T) {
+			target := routePath(route.template)
+			if query, ok := routeQueries[route.method+" "+route.template]; ok {
+				target += "?" + query
+			}
+			var req *http.Request
+			if body, ok := routeBodies[route.method+" "+route.template]; ok {
+				req = httptest.NewRequest(route.method, target, strings.NewReader(body))
+				if openapi.Default.HasJSONBody(route.method, route.template) {
+					req.Header.Set("content-type", "application/json")
+				} else {
+					req.Header.Set("content-type", "application/octet-stream")
+				}
+			} else {
+				req = httptest.NewRequest(route.method, target, nil)
+			}
+			reqCtx, cancel := context.WithTimeout(req.Context(), routeTimeout)
+			defer cancel()
+			req = req.WithContext(reqCtx)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code >= 400 && !strings.HasPrefix(rec.Header().Get("content-type"), "application/json") {
+				t.Errorf("status %v answered as %q: %s", rec.Code, rec.Header().Get("content-type"), rec.Body.String())
+			}
+			for _, e := range openapi.Default.ValidateResponse(route.method, route.template, rec.Code, rec.Body.Bytes()) {
+				t.Errorf("status %v: %v %v, body %s", rec.Code, e.Field, e.Message, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestResourcesAnswerAsSpecified(t *testing.T) {
+	testBackends(t)
+	savedTestBed, savedTemplate, savedArtifact, savedSnapshot, savedWebhook := getTestBed, getTemplate, getArtifact, getSnapshot, getWebhook
+	defer func() {
+		getTestBed, getTemplate, getArtifact, getSnapshot, getWebhook = savedTestBed, savedTemplate, savedArtifact, savedSnapshot, savedWebhook
+	}()
+	getTestBed = func(ctx context.Context, id string) (db.TestBed, error) {
+		return db.TestBed{ID: id, Name: "routes-test", Status: db.StatusCompleted,
+			Container: []db.ContainerProp{{Image: "redis", CID: "0", IP: "0.0.0.0", SvcPort: 9000}}}, nil
+	}
+	getTemplate = func(ctx context.Context, name string, version int) (db.TestBedTemplate, error) {
+		return db.TestBedTemplate{ID: "template-fixture", Name: name, Version: 1, TestBedName: "routes-test", Containers: []string{"redis"}}, nil
+	}
+	getArtifact = func(ctx context.Context, id string) (db.Artifact, error) {
+		return db.Artifact{ID: id, Name: "dump", Size: 4, SHA256: strings.Repeat("0", 64)}, nil
+	}
+	getSnapshot = func(ctx context.Context, id string) (db.Snapshot, error) {
+		return db.Snapshot{ID: id, TestBedID: "testbed-fixture", TestBedName: "routes-test", Status: db.StatusCompleted,
+			Containers: []db.SnapshotContainer{{Image: "redis", ImageRef: "provisioner-snapshot:redis"}}}, nil
+	}
+	getWebhook = func(ctx context.Context, id string) (db.Webhook, error) {
+		return db.Webhook{ID: id, URL: "http://127.0.0.1:1/hook", Secret: "0123456789abcdef"}, nil
+	}
+
+	router := newRouter()
+	cases := []struct {
+		template, path string
+		field, want    string // a field of the response and its expected value
+	}{
+		{"/api/v1/testbeds/{id}", "/api/v1/testbeds/testbed-fixture", "_id", "testbed-fixture"},
+		{"/api/v1/testbeds/{id}/containers/{name}", "/api/v1/testbeds/testbed-fixture/containers/redis", "name", "testbed-fixture-redis"},
+		{"/api/v1/templates/{name}", "/api/v1/templates/routes-test", "name", "routes-test"},
+		{"/api/v1/artifacts/{id}", "/api/v1/artifacts/artifact-fixture", "_id", "artifact-fixture"},
+		{"/api/v1/snapshots/{id}", "/api/v1/snapshots/snapshot-fixture", "_id", "snapshot-fixture"},
+		{"/api/v1/webhooks/{id}", "/api/v1/webhooks/webhook-fixture", "_id", "webhook-fixture"},
+		{"/api/v1/openapi.json", "/api/v1/openapi.json", "openapi", "3.0.3"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("GET %v: status %v, body %s", c.path, rec.Code, rec.Body.String())
+			continue
+		}
+		for _, e := range openapi.Default.ValidateResponse("GET", c.template, rec.Code, rec.Body.Bytes()) {
+			t.Errorf("GET %v: %v %v, body %s", c.path, e.Field, e.Message, rec.Body.String())
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("GET %v: %v", c.path, err)
+		} else if body[c.field] != c.want {
+			t.Errorf("GET %v: %v is %v, want %v", c.path, c.field, body[c.field], c.want)
+		}
+	}
+}
+
+func TestUnknownRoutesAnswerJSONErrors(t *testing.T) {
+	router := newRouter()
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/api/v1/unknown", nil),
+		httptest.NewRequest("PUT", "/api/v1/testbeds", nil),
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusNotFound && rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%v %v: status %v", req.Method, req.URL, rec.Code)
+		}
+		if !strings.HasPrefix(rec.Header().Get("content-type"), "application/json") {
+			t.Errorf("%v %v: content-type %q", req.Method, req.URL, rec.Header().Get("content-type"))
+		}
+	}
+}
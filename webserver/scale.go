@@ -0,0 +1,252 @@
+/*
+ * scale.go changes the number of instances of a service within a running testbed.
+ *
+ *     PATCH /api/v1/testbeds/{id}/services/{name}    {"replicas": 3}
+ *
+ * The first instance is the container described by the ContainerProp of the service, additional
+ * instances are recorded in its replicas and named <testbed id>-<service>-<n> from 2 on. They get
+ * their own host port, IP and named volumes, and are seeded like the first one. Scaling down removes
+ * the highest numbered instances first, releasing their ports and volumes. Clones and testbeds created
+ * from a snapshot record planned replicas, which are created when they are provisioned. Scaling up
+ * records the added instances as planned replicas too, until they are created.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// maxReplicas limits the instances of one service
+const maxReplicas = 10
+
+//scaleRequestBody is the request struct of a scale
+type scaleRequestBody struct {
+	Replicas int `json:"replicas"`
+}
+
+// scaling holds the testbeds being scaled, a testbed is scaled by one request at a time
+var scaling = struct {
+	mu       sync.Mutex
+	testbeds map[string]bool
+}{testbeds: make(map[string]bool)}
+
+/*
+  Handler for PATCH /testbeds/{id}/services/{name} call
+
+  Only Completed testbeds can be scaled. The response is the service with its replicas once the added
+  instances are healthy and seeded, or the removed ones are gone. An instance which could not be added
+  is removed again and answered with 502, the instances added before it are kept. Instances beyond the
+  quotas of the testbed owner, team or host are refused with 429 or 403 (see quota.go), so are instances
+  the host has no capacity for (see queue.go).
+*/
+func scaleservicehandler(w http.ResponseWriter, r *http.Request) {
+	body := scaleRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid scale body: "+err.Error())
+		return
+	}
+	if body.Replicas < 1 || body.Replicas > maxReplicas {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid scale request",
+			fieldError{Field: "replicas", Message: fmt.Sprintf("must be between 1 and %v", maxReplicas)})
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	if tb.Status != db.StatusCompleted {
+		writeError(w, http.StatusConflict, errCodeConflict, "Testbed "+tb.ID+" is "+tb.Status+", only Completed testbeds can be scaled")
+		return
+	}
+	cnt, ok := loadContainer(w, r, tb)
+	if !ok {
+		return
+	}
+
+	scaling.mu.Lock()
+	if scaling.testbeds[tb.ID] {
+		scaling.mu.Unlock()
+		writeError(w, http.StatusConflict, errCodeConflict, "Testbed "+tb.ID+" is already being scaled")
+		return
+	}
+	scaling.testbeds[tb.ID] = true
+	scaling.mu.Unlock()
+	defer func() {
+		scaling.mu.Lock()
+		delete(scaling.testbeds, tb.ID)
+		scaling.mu.Unlock()
+	}()
+
+	// Added instances are recorded as planned replicas before the reservation is released, so that they
+	// count towards the quotas and the host capacity while they are created
+	if added := body.Replicas - 1 - len(cnt.Replicas); added > 0 {
+		release, ok := reserveQuota(w, tb.Owner, tb.Team, instanceUsage(cnt, added))
+		if !ok {
+			return
+		}
+		admitted, ok := admitInstances(w, instanceUsage(cnt, added))
+		if !ok {
+			release()
+			return
+		}
+		planned := append([]db.Replica{}, cnt.Replicas...)
+		for index := len(cnt.Replicas) + 2; index <= body.Replicas; index++ {
+			planned = append(planned, db.Replica{Index: index})
+		}
+		_, err := db.UpdateContainerProperty(ctx, tb.ID, cnt.Image, "replicas", planned)
+		admitted()
+		release()
+		if err != nil {
+			logging.Error.Println(err)
+			writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record the added instances, nothing was provisioned")
+			return
+		}
+	}
+
+	replicas := cnt.Replicas
+	var scaleErr error
+	for len(replicas)+1 < body.Replicas {
+		replica, err := addReplica(tb.ID, cnt, len(replicas)+2)
+		if err != nil {
+			scaleErr = err
+			break
+		}
+		replicas = append(replicas, replica)
+	}
+	for len(replicas)+1 > body.Replicas {
+		if err := removeReplica(tb.ID, cnt, replicas[len(replicas)-1]); err != nil {
+			scaleErr = err
+			break
+		}
+		replicas = replicas[:len(replicas)-1]
+	}
+
+	if replicas == nil {
+		replicas = []db.Replica{}
+	}
+	if _, err := db.UpdateContainerProperty(ctx, tb.ID, cnt.Image, "replicas", replicas); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Service was scaled but its replicas could not be recorded")
+		return
+	}
+	cnt.Replicas = replicas
+
+	if scaleErr != nil {
+		writeError(w, http.StatusBadGateway, errCodeDocker, fmt.Sprintf("Service %v is at %v instances: %v", cnt.Image, len(replicas)+1, scaleErr))
+		return
+	}
+	publishEvent(tb.ID, events.ServiceScaled, cnt.Image, "Service scaled to "+strconv.Itoa(len(replicas)+1)+" instances")
+	writeJSON(w, http.StatusOK, cnt)
+}
+
+// provisionReplicas creates the planned replicas of a service whose first instance was just provisioned,
+// e.g. of a clone or of a testbed created from a snapshot. The created replicas are recorded, also when
+// one of them fails.
+func provisionReplicas(testbedID string, cnt db.ContainerProp) error {
+	if len(cnt.Replicas) == 0 {
+		return nil
+	}
+	replicas := []db.Replica{}
+	var provisionErr error
+	for _, planned := range cnt.Replicas {
+		replica, err := addReplica(testbedID, plannedInstance(cnt, planned), planned.Index)
+		if err != nil {
+			provisionErr = fmt.Errorf("instance %v: %v", planned.Index, err)
+			break
+		}
+		replicas = append(replicas, replica)
+	}
+	if _, err := db.UpdateContainerProperty(ctx, testbedID, cnt.Image, "replicas", replicas); err != nil {
+		logging.Error.Println(err)
+		if provisionErr == nil {
+			provisionErr = errors.New("Replicas were created but could not be recorded")
+		}
+	}
+	return provisionErr
+}
+
+// plannedInstance returns the properties a planned replica is created with, the image and volume content
+// of a replica restored from a snapshot replace the ones of the first instance
+func plannedInstance(cnt db.ContainerProp, planned db.Replica) db.ContainerProp {
+	if planned.ImageRef != "" {
+		cnt.ImageRef = planned.ImageRef
+		cnt.Restore = planned.Restore
+	}
+	return cnt
+}
+
+// addReplica creates, starts and seeds an instance of a testbed service, it is removed again if that fails
+func addReplica(testbedID string, cnt db.ContainerProp, index int) (db.Replica, error) {
+	inst, err := createInstance(testbedID, cnt, index)
+	replica := db.Replica{Index: index, Name: inst.Name, CID: inst.ID, IP: inst.IP, SvcPort: inst.SvcPort}
+	if err == nil {
+		replica.SeedResults, err = readyInstance(testbedID, cnt, inst)
+	}
+	if err != nil {
+		publishEvent(testbedID, events.ContainerFailed, cnt.Image, "Instance "+inst.Name+" failed: "+err.Error())
+		if err := removeReplica(testbedID, cnt, replica); err != nil {
+			logging.Error.Println(err)
+		}
+		return replica, err
+	}
+	return replica, nil
+}
+
+// removeReplica stops and removes an additional instance of a testbed service, deallocates its service
+// port and removes its named volumes unless they are retained
+func removeReplica(testbedID string, cnt db.ContainerProp, replica db.Replica) error {
+	name := containerName(testbedID, cnt.Image) + replicaSuffix(replica.Index)
+
+	// Stop errors are not fatal here, the removal decides the outcome
+	dockercontainer.StopContainer(ctx, name)
+	if err := dockercontainer.RemoveContainer(ctx, name); err != nil && !dockercontainer.IsNotFound(err) {
+		logging.Error.Println(err)
+		return err
+	}
+	clearFault(name)
+
+	if replica.SvcPort != 0 {
+		if err := db.DeletePortFromMeta(ctx, replica.SvcPort); err != nil {
+			logging.Error.Println(err)
+		}
+	}
+
+	if failed := removeVolumes(testbedID, cnt, replica.Index); len(failed) > 0 {
+		return fmt.Errorf("container %v removed but not its volumes %v", name, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// replicaSuffix returns the suffix of the container and volume names of an instance, the first has none
+func replicaSuffix(replica int) string {
+	if replica <= 1 {
+		return ""
+	}
+	return "-" + strconv.Itoa(replica)
+}
+
+// instanceNames returns the container names of every instance of a testbed service
+func instanceNames(testbedID string, cnt db.ContainerProp) []string {
+	names := []string{containerName(testbedID, cnt.Image)}
+	for _, replica := range cnt.Replicas {
+		names = append(names, containerName(testbedID, cnt.Image)+replicaSuffix(replica.Index))
+	}
+	return names
+}
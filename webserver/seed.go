@@ -0,0 +1,288 @@
+/*
+ * seed.go loads fixtures into datastore containers once they are ready.
+ *
+ * createenv accepts seed steps per service:
+ *     "seed": {"mongo": [{"name": "users.js", "content": "db.users.insertOne({name: 'a'})"},
+ *                        {"artifact": "<id>", "path": "/seed", "run": ["mongorestore", "/seed/dump"]}]}
+ *
+ * Each step copies an inline file, a base64 tar archive or an uploaded artifact (see artifacts.go)
+ * into the container and runs a command. Inline files default to the service runner, e.g. the
+ * mongo shell for mongo. The outcome of every step is stored as seed_results of the container.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/util"
+)
+
+// defaultSeedPath is the directory seed files are copied to when a step names none
+const defaultSeedPath = "/seed"
+
+// Timeouts of seeding, set from the config (see config.go)
+var (
+	seedReadyTimeout time.Duration
+	seedStepTimeout  time.Duration
+)
+
+// maxSeedOutput limits the command output kept in a seed result
+const maxSeedOutput = 4096
+
+// seedRunners are the default commands running an inline seed file, {file} is replaced with its path
+var seedRunners = map[string][]string{
+	"mongo": {"sh", "-c", "$(command -v mongosh || command -v mongo) --quiet {file}"},
+	"redis": {"sh", "-c", "redis-cli < {file}"},
+}
+
+// serviceProbes are commands exiting 0 once a datastore accepts connections
+var serviceProbes = map[string][]string{
+	"mongo": {"sh", "-c", "$(command -v mongosh || command -v mongo) --quiet --eval 'db.adminCommand({ping: 1})'"},
+	"redis": {"redis-cli", "ping"},
+}
+
+// validateSeed returns the field level errors of the seed steps of a createenv request
+func validateSeed(post postRequestBody) []fieldError {
+	var errs []fieldError
+
+	for _, svc := range seedServices(post.Seed) {
+		steps := post.Seed[svc]
+		found := false
+		for _, cnt := range post.Containers {
+			found = found || cnt == svc
+		}
+		if !found {
+			errs = append(errs, fieldError{Field: "seed." + svc, Message: "service is not part of the testbed"})
+			continue
+		}
+
+		for i, step := range steps {
+			field := fmt.Sprintf("seed.%v[%d]", svc, i)
+			sources := 0
+			for _, src := range []string{step.Content, step.Archive, step.Artifact} {
+				if src != "" {
+					sources++
+				}
+			}
+			if sources != 1 {
+				errs = append(errs, fieldError{Field: field, Message: "must set exactly one of content, archive or artifact"})
+			}
+			if step.Content != "" && (step.Name == "" || strings.Contains(step.Name, "/")) {
+				errs = append(errs, fieldError{Field: field + ".name", Message: "must be a file name for inline content"})
+			}
+			if step.Archive != "" {
+				if _, err := base64.StdEncoding.DecodeString(step.Archive); err != nil {
+					errs = append(errs, fieldError{Field: field + ".archive", Message: "must be a base64 encoded tar archive"})
+				}
+			}
+			if step.Path != "" && !path.IsAbs(step.Path) {
+				errs = append(errs, fieldError{Field: field + ".path", Message: "must be an absolute path"})
+			}
+		}
+	}
+	return errs
+}
+
+// seedArtifactErrors returns an error for every seed step referencing an artifact which does not exist
+// or which the principal may not read
+func seedArtifactErrors(p *principal, seed map[string][]db.SeedStep) ([]fieldError, error) {
+	var errs []fieldError
+	for _, svc := range seedServices(seed) {
+		for i, step := range seed[svc] {
+			if step.Artifact == "" {
+				continue
+			}
+			artifact, err := db.GetArtifactFromID(ctx, step.Artifact)
+			if err == db.ErrNoMatchDocument || (err == nil && !p.can(artifact.Owner, artifact.Team, accessRead)) {
+				errs = append(errs, fieldError{Field: fmt.Sprintf("seed.%v[%d].artifact", svc, i), Message: "no artifact found with id " + step.Artifact})
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return errs, nil
+}
+
+// seedServices returns the services of a seed map in a stable order
+func seedServices(seed map[string][]db.SeedStep) []string {
+	services := make([]string, 0, len(seed))
+	for svc := range seed {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// seedContainer waits until the datastore of a container accepts connections and runs its seed steps.
+// It returns the results of the steps run, the first failing step ends seeding with an error.
+func seedContainer(tbid, image, id string, steps []db.SeedStep) ([]db.SeedResult, error) {
+	publishEvent(tbid, events.SeedStarted, image, fmt.Sprintf("Seeding %v step(s) in %v", len(steps), id))
+
+	results := make([]db.SeedResult, 0, len(steps))
+	if err := waitServiceReady(image, id); err != nil {
+		publishEvent(tbid, events.SeedFailed, image, err.Error())
+		return results, err
+	}
+
+	for i, step := range steps {
+		res := runSeedStep(image, id, step)
+		res.Step = i
+		results = append(results, res)
+		if !res.OK {
+			msg := fmt.Sprintf("seed step %d failed: %v", i, res.Error)
+			publishEvent(tbid, events.SeedFailed, image, msg)
+			return results, errors.New(msg)
+		}
+	}
+
+	publishEvent(tbid, events.SeedDone, image, fmt.Sprintf("Seeded %v step(s) in %v", len(steps), id))
+	return results, nil
+}
+
+// waitServiceReady runs the probe of a service until it succeeds or seedReadyTimeout expires
+func waitServiceReady(image, id string) error {
+	probe, ok := serviceProbes[image]
+	if !ok {
+		return nil
+	}
+
+	deadline := time.Now().Add(seedReadyTimeout)
+	for {
+		probeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		result, err := dockercontainer.ExecRun(probeCtx, id, probe, nil, "", nil, maxSeedOutput)
+		cancel()
+		if err == nil && result.ExitCode == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v did not accept connections within %v", image, seedReadyTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// runSeedStep copies the files of a step into the container and runs its command
+func runSeedStep(image, id string, step db.SeedStep) db.SeedResult {
+	res := db.SeedResult{}
+	dir := step.Path
+	if dir == "" {
+		dir = defaultSeedPath
+	}
+
+	stepCtx, cancel := context.WithTimeout(ctx, seedStepTimeout)
+	defer cancel()
+
+	mkdir, err := dockercontainer.ExecRun(stepCtx, id, []string{"mkdir", "-p", dir}, nil, "", nil, maxSeedOutput)
+	if err == nil && mkdir.ExitCode != 0 {
+		err = errors.New(strings.TrimSpace(string(mkdir.Stderr)))
+	}
+	if err != nil {
+		res.Error = "could not create " + dir + ": " + err.Error()
+		return res
+	}
+
+	archive, err := seedArchive(step)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	err = dockercontainer.CopyToContainer(stepCtx, id, dir, archive)
+	archive.Close()
+	if err != nil {
+		res.Error = "copy failed: " + err.Error()
+		return res
+	}
+
+	cmd := seedCommand(image, dir, step)
+	if len(cmd) == 0 {
+		res.OK = true
+		return res
+	}
+	result, err := dockercontainer.ExecRun(stepCtx, id, cmd, nil, dir, nil, maxSeedOutput)
+	res.ExitCode = result.ExitCode
+	res.Output = string(result.Stdout) + string(result.Stderr)
+	switch {
+	case err != nil:
+		res.Error = err.Error()
+	case result.ExitCode != 0:
+		res.Error = fmt.Sprintf("%v exited with %v", strings.Join(cmd, " "), result.ExitCode)
+	default:
+		res.OK = true
+	}
+	return res
+}
+
+// seedArchive returns the tar stream copied into the container for a step
+func seedArchive(step db.SeedStep) (io.ReadCloser, error) {
+	switch {
+	case step.Content != "":
+		data, err := util.TarFile(step.Name, []byte(step.Content), 0644)
+		return ioutil.NopCloser(bytes.NewReader(data)), err
+	case step.Archive != "":
+		data, err := base64.StdEncoding.DecodeString(step.Archive)
+		return ioutil.NopCloser(bytes.NewReader(data)), err
+	}
+
+	artifact, err := db.GetArtifactFromID(ctx, step.Artifact)
+	if err != nil {
+		return nil, fmt.Errorf("artifact %v: %v", step.Artifact, err)
+	}
+	f, err := os.Open(artifactPath(artifact.ID))
+	if err != nil {
+		return nil, err
+	}
+	if isArchiveName(artifact.Name) {
+		return f, nil
+	}
+
+	// A plain file is streamed as an archive holding it under its artifact name
+	pr, pw := io.Pipe()
+	go func() {
+		defer f.Close()
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{Name: artifact.Name, Mode: 0644, Size: artifact.Size, ModTime: time.Now()})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// seedCommand returns the command of a step, inline files without one run with the service runner
+func seedCommand(image, dir string, step db.SeedStep) []string {
+	if len(step.Run) > 0 {
+		return step.Run
+	}
+	runner, ok := seedRunners[image]
+	if step.Content == "" || !ok {
+		return nil
+	}
+	cmd := make([]string, len(runner))
+	for i, arg := range runner {
+		cmd[i] = strings.Replace(arg, "{file}", path.Join(dir, step.Name), -1)
+	}
+	return cmd
+}
@@ -0,0 +1,354 @@
+/*
+ * snapshots.go captures the state of a testbed so that new testbeds can start from it.
+ * Supports
+ *     Snapshot a testbed (POST /testbeds/{id}/snapshots), captured in the background
+ *     List the snapshots of a testbed
+ *     Get a snapshot
+ *     Delete a snapshot along with its images and artifacts
+ *     Create a testbed from a snapshot (POST /testbeds?from_snapshot=<id>&name=<name>)
+ *
+ * The filesystem of every container is committed as the image infra-provisioner/snapshot:<snapshot id>-<service>,
+ * with the replica number appended for additional instances of a scaled service (see scale.go), the
+ * content of its volumes is kept as tar artifacts (see artifacts.go). Containers are paused while
+ * they are captured. A testbed created from a snapshot runs the committed images with as many instances
+ * per service, the environment and resource limits of the captured testbed, and gets the volume content
+ * copied in before its containers start, it is not seeded again.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// snapshotRepository is the repository of committed snapshot images
+const snapshotRepository = "infra-provisioner/snapshot"
+
+// errSnapshotNotReady is returned when a testbed is requested from a snapshot which is not Completed
+var errSnapshotNotReady = errors.New("snapshot is not completed")
+
+//snapshotRequestBody is the optional request struct of a snapshot
+type snapshotRequestBody struct {
+	Name string `json:"name"`
+}
+
+/*
+  Handler for POST /testbeds/{id}/snapshots call
+
+  Only a Completed testbed can be captured. The snapshot is answered with 202 and InProgress,
+  GET /snapshots/{id} reports when it is Completed or Failed.
+*/
+func createsnapshothandler(w http.ResponseWriter, r *http.Request) {
+	body := snapshotRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid snapshot body: "+err.Error())
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessOperate)
+	if !ok {
+		return
+	}
+	if tb.Status != db.StatusCompleted {
+		writeError(w, http.StatusConflict, errCodeConflict, "Testbed "+tb.ID+" is "+tb.Status+", only Completed testbeds can be captured")
+		return
+	}
+
+	snapshot := db.NewSnapshot(tb)
+	snapshot.Name = body.Name
+	if _, err := db.InsertSnapshot(ctx, snapshot); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not record snapshot")
+		return
+	}
+
+	go captureSnapshot(tb, snapshot)
+
+	w.Header().Set("location", "/api/v1/snapshots/"+snapshot.ID)
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+// Handler for GET /api/v1/testbeds/{id}/snapshots call
+func listsnapshotshandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+	snapshots, err := db.ListSnapshots(ctx, tb.ID)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing snapshots")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshots)
+}
+
+// Handler for GET /api/v1/snapshots/{id} call
+func getsnapshothandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := loadSnapshot(w, r, accessRead)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// Handler for DELETE /api/v1/snapshots/{id} call, removes the committed images and the volume artifacts
+func deletesnapshothandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, ok := loadSnapshot(w, r, accessDelete)
+	if !ok {
+		return
+	}
+	if snapshot.Status == db.StatusInProgress {
+		writeError(w, http.StatusConflict, errCodeConflict, "Snapshot "+snapshot.ID+" is still being captured")
+		return
+	}
+
+	if err := discardSnapshot(snapshot); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeDocker, "Could not remove snapshot "+snapshot.ID+": "+err.Error())
+		return
+	}
+	if _, err := db.DeleteSnapshot(ctx, snapshot.ID); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while deleting snapshot")
+		return
+	}
+
+	logging.Info.Println("Deleted snapshot ", snapshot.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadSnapshot returns the snapshot named by the {id} route variable if the request may access it at level,
+// writing the error response if it cannot
+func loadSnapshot(w http.ResponseWriter, r *http.Request, level accessLevel) (db.Snapshot, bool) {
+	id := mux.Vars(r)["id"]
+	snapshot, err := getSnapshot(ctx, id)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No snapshot found with id "+id)
+		return snapshot, false
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching snapshot "+id)
+		return snapshot, false
+	}
+	if !authorize(w, r, snapshot.Owner, snapshot.Team, level, "snapshot with id "+id) {
+		return snapshot, false
+	}
+	return snapshot, true
+}
+
+// captureSnapshot commits every container of a testbed and stores the content of its volumes,
+// the snapshot ends up Completed or Failed
+func captureSnapshot(tb db.TestBed, snapshot *db.Snapshot) {
+	for _, cnt := range tb.Container {
+		captured, err := captureContainer(tb, snapshot.ID, cnt)
+		snapshot.Containers = append(snapshot.Containers, captured)
+		if err != nil {
+			logging.Error.Println("Snapshot ", snapshot.ID, " of testbed ", tb.ID, " failed: ", err)
+			if err := discardSnapshot(*snapshot); err != nil {
+				logging.Error.Println(err)
+			}
+			snapshot.Status = db.StatusFailed
+			snapshot.Error = cnt.Image + ": " + err.Error()
+			snapshot.Containers = []db.SnapshotContainer{}
+			break
+		}
+	}
+	if snapshot.Status != db.StatusFailed {
+		snapshot.Status = db.StatusCompleted
+	}
+
+	if err := db.UpdateSnapshot(ctx, snapshot); err != nil {
+		logging.Error.Println(err)
+	}
+	if snapshot.Status == db.StatusFailed {
+		publishEvent(tb.ID, events.SnapshotFailed, "", "Snapshot "+snapshot.ID+" failed: "+snapshot.Error)
+		return
+	}
+	publishEvent(tb.ID, events.SnapshotDone, "", "Captured snapshot "+snapshot.ID)
+}
+
+// captureContainer captures every instance of a testbed service.
+// The returned capture holds what was stored so far, also when an error is returned.
+func captureContainer(tb db.TestBed, snapshotID string, cnt db.ContainerProp) (db.SnapshotContainer, error) {
+	captured := db.SnapshotContainer{Image: cnt.Image, Volumes: cnt.Volumes, Env: cnt.Env, Resources: cnt.Resources}
+
+	var err error
+	captured.ImageRef, captured.Data, err = captureInstance(tb, snapshotID, cnt, 1)
+	if err != nil {
+		return captured, err
+	}
+	for _, replica := range cnt.Replicas {
+		ref, data, err := captureInstance(tb, snapshotID, cnt, replica.Index)
+		captured.Replicas = append(captured.Replicas, db.SnapshotReplica{Index: replica.Index, ImageRef: ref, Data: data})
+		if err != nil {
+			return captured, fmt.Errorf("instance %v: %v", replica.Index, err)
+		}
+	}
+	return captured, nil
+}
+
+// captureInstance commits an instance of a testbed service and stores the content of its volumes, pausing
+// it meanwhile. It returns the committed image and the stored volumes, also what was stored before an error.
+func captureInstance(tb db.TestBed, snapshotID string, cnt db.ContainerProp, replica int) (string, []db.VolumeArchive, error) {
+	name := containerName(tb.ID, cnt.Image) + replicaSuffix(replica)
+	var data []db.VolumeArchive
+
+	inspectData := dockercontainer.InspectContainer(ctx, name)
+	if inspectData.ContainerJSONBase == nil {
+		return "", data, errors.New("container " + name + " does not exist on the host")
+	}
+	if inspectData.State.Running && !inspectData.State.Paused {
+		if err := dockercontainer.PauseContainer(ctx, name); err != nil {
+			return "", data, err
+		}
+		defer func() {
+			if err := dockercontainer.UnpauseContainer(ctx, name); err != nil {
+				logging.Error.Println(err)
+			}
+		}()
+	}
+
+	ref := snapshotRepository + ":" + snapshotID + "-" + cnt.Image + replicaSuffix(replica)
+	if _, err := dockercontainer.CommitContainer(ctx, name, ref); err != nil {
+		return "", data, err
+	}
+
+	// Bind mounts belong to the host and tmpfs is not worth keeping, only volume content is stored
+	for _, m := range inspectData.Mounts {
+		if m.Type != mount.TypeVolume {
+			continue
+		}
+		reader, _, err := dockercontainer.CopyFromContainer(ctx, name, m.Destination)
+		if err != nil {
+			return ref, data, err
+		}
+		artifactName := cnt.Image + replicaSuffix(replica) + strings.Replace(m.Destination, "/", "-", -1) + ".tar"
+		// The volume content belongs to the owner of the testbed like the snapshot
+		artifact, err := storeArtifact(artifactName, tb.Owner, tb.Team, reader)
+		reader.Close()
+		if err != nil {
+			return ref, data, fmt.Errorf("could not store volume %v: %v", m.Destination, err)
+		}
+		data = append(data, db.VolumeArchive{Target: m.Destination, Artifact: artifact.ID})
+	}
+	return ref, data, nil
+}
+
+// discardSnapshot removes the images and artifacts of a snapshot
+func discardSnapshot(snapshot db.Snapshot) error {
+	for _, captured := range snapshot.Containers {
+		if err := discardCapture(captured.ImageRef, captured.Data); err != nil {
+			return err
+		}
+		for _, replica := range captured.Replicas {
+			if err := discardCapture(replica.ImageRef, replica.Data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// discardCapture removes the committed image and the volume artifacts of a captured instance
+func discardCapture(ref string, data []db.VolumeArchive) error {
+	if ref != "" {
+		if err := dockercontainer.RemoveImage(ctx, ref); err != nil && !dockercontainer.IsNotFound(err) {
+			return err
+		}
+	}
+	for _, d := range data {
+		if _, err := removeArtifact(d.Artifact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postRequestFromSnapshot builds the createenv request of a testbed started from a snapshot,
+// ?name names the testbed, by default it is named like the captured testbed
+func postRequestFromSnapshot(query url.Values) (postRequestBody, db.Snapshot, error) {
+	post := postRequestBody{Name: query.Get("name")}
+
+	snapshot, err := db.GetSnapshotFromID(ctx, query.Get("from_snapshot"))
+	if err != nil {
+		return post, snapshot, err
+	}
+	if snapshot.Status != db.StatusCompleted {
+		return post, snapshot, errSnapshotNotReady
+	}
+
+	if post.Name == "" {
+		post.Name = snapshot.TestBedName
+	}
+	post.Volumes = make(map[string][]db.VolumeSpec)
+	post.Resources = make(map[string]*db.Resources)
+	for _, captured := range snapshot.Containers {
+		post.Containers = append(post.Containers, captured.Image)
+		if len(captured.Volumes) > 0 {
+			post.Volumes[captured.Image] = captured.Volumes
+		}
+		if captured.Resources != nil {
+			post.Resources[captured.Image] = captured.Resources
+		}
+	}
+	return post, snapshot, nil
+}
+
+// applySnapshot makes the containers of a testbed start from the images and volume content of a snapshot,
+// the captured replicas of a service are planned to be created with it. Containers without an environment
+// get the captured one.
+func applySnapshot(tb *db.TestBed, snapshot db.Snapshot) {
+	tb.Snapshot = snapshot.ID
+	for i := range tb.Container {
+		for _, captured := range snapshot.Containers {
+			if captured.Image != tb.Container[i].Image {
+				continue
+			}
+			tb.Container[i].ImageRef = captured.ImageRef
+			tb.Container[i].Restore = captured.Data
+			if len(tb.Container[i].Env) == 0 {
+				tb.Container[i].Env = captured.Env
+			}
+			tb.Container[i].Replicas = nil
+			for _, replica := range captured.Replicas {
+				tb.Container[i].Replicas = append(tb.Container[i].Replicas, db.Replica{Index: replica.Index, ImageRef: replica.ImageRef, Restore: replica.Data})
+			}
+		}
+	}
+}
+
+// restoreVolumes copies the captured volume content of a created container into it
+func restoreVolumes(id string, cnt db.ContainerProp) error {
+	for _, data := range cnt.Restore {
+		f, err := os.Open(artifactPath(data.Artifact))
+		if err != nil {
+			return fmt.Errorf("volume %v: %v", data.Target, err)
+		}
+		// The archive holds the volume directory itself, it is extracted into its parent
+		err = dockercontainer.CopyToContainer(ctx, id, path.Dir(data.Target), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("could not restore volume %v: %v", data.Target, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+/*
+ * templates.go contains the handlers for named testbed templates.
+ * Supports
+ *     Create a template
+ *     List templates
+ *     Get a template (latest or a given version)
+ *     Publish a new version of a template
+ *     Delete a template
+ *     Instantiate a template as a testbed (POST /testbeds?template=<name>&vars=k=v,...)
+ *
+ * Templates can be read and instantiated by everyone. They belong to the principal who created them and
+ * to its team: team members may publish new versions, only the owner or an admin may delete them.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/logging"
+)
+
+var templateNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+//templateRequestBody is the request struct for creating and updating templates
+type templateRequestBody struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	TestBedName string            `json:"testbed_name"`
+	Containers  []string          `json:"containers"`
+	Vars        map[string]string `json:"vars"`
+
+	// Settings of the created testbeds, validated when the template is instantiated
+	Seed       map[string][]db.SeedStep   `json:"seed"`
+	Volumes    map[string][]db.VolumeSpec `json:"volumes"`
+	Resources  map[string]*db.Resources   `json:"resources"`
+	TTLSeconds int                        `json:"ttl_seconds"`
+	Priority   string                     `json:"priority"`
+}
+
+//errTemplateRequest is returned when template parameters of a request are invalid
+type errTemplateRequest string
+
+func (e errTemplateRequest) Error() string {
+	return string(e)
+}
+
+// Handler for POST /templates call, creates version 1 of a template
+func createtemplatehandler(w http.ResponseWriter, r *http.Request) {
+	body := templateRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid template body: "+err.Error())
+		return
+	}
+	if !templateNameRegexp.MatchString(body.Name) {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid template name", fieldError{Field: "name", Message: "must match " + templateNameRegexp.String()})
+		return
+	}
+
+	tmpl := db.NewTestBedTemplate(body.Name, 1)
+	if p := requestPrincipal(r); p != nil {
+		tmpl.Owner = p.Name
+		tmpl.Team = p.Team
+	}
+	saveTemplateVersion(w, tmpl, body, http.StatusCreated)
+}
+
+// Handler for PUT /templates/{name} call, publishes the next version of a template
+func updatetemplatehandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	latest, ok := loadTemplate(w, r, accessOperate)
+	if !ok {
+		return
+	}
+
+	body := templateRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid template body: "+err.Error())
+		return
+	}
+
+	tmpl := db.NewTestBedTemplate(name, latest.Version+1)
+	tmpl.Owner = latest.Owner
+	tmpl.Team = latest.Team
+	saveTemplateVersion(w, tmpl, body, http.StatusOK)
+}
+
+// loadTemplate fetches the latest version of the template named by the {name} route variable if the
+// request may access it at level (see authz.go), writing the error response if it can't
+func loadTemplate(w http.ResponseWriter, r *http.Request, level accessLevel) (db.TestBedTemplate, bool) {
+	name := mux.Vars(r)["name"]
+
+	tmpl, err := getTemplate(ctx, name, 0)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No template found with name "+name)
+		return tmpl, false
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching template")
+		return tmpl, false
+	}
+	if !authorize(w, r, tmpl.Owner, tmpl.Team, level, "template with name "+name) {
+		return tmpl, false
+	}
+	return tmpl, true
+}
+
+// saveTemplateVersion validates and stores a template version from body and writes it back to the client
+func saveTemplateVersion(w http.ResponseWriter, tmpl *db.TestBedTemplate, body templateRequestBody, status int) {
+	if body.TestBedName == "" || len(body.Containers) == 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Template requires testbed_name and at least one container")
+		return
+	}
+	if body.TTLSeconds < 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid template", fieldError{Field: "ttl_seconds", Message: "must not be negative"})
+		return
+	}
+	if _, ok := priorityRanks[body.Priority]; body.Priority != "" && !ok {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid template", fieldError{Field: "priority", Message: "must be high, normal or low"})
+		return
+	}
+
+	tmpl.Description = body.Description
+	tmpl.TestBedName = body.TestBedName
+	tmpl.Containers = body.Containers
+	tmpl.Vars = body.Vars
+	tmpl.Seed = body.Seed
+	tmpl.Volumes = body.Volumes
+	tmpl.Resources = body.Resources
+	tmpl.TTLSeconds = body.TTLSeconds
+	tmpl.Priority = body.Priority
+
+	_, err := db.InsertTestBedTemplate(ctx, tmpl)
+	if err == db.ErrDocumentExists {
+		writeError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("Template %v version %v already exists", tmpl.Name, tmpl.Version))
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while storing template")
+		return
+	}
+
+	logging.Info.Println("Stored template ", tmpl.Name, " version ", tmpl.Version)
+	writeJSON(w, status, tmpl)
+}
+
+// Handler for GET /templates call, optionally filtered by ?name=
+func listtemplateshandler(w http.ResponseWriter, r *http.Request) {
+	templates, err := db.ListTestBedTemplates(ctx, r.URL.Query().Get("name"))
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing templates")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, templates)
+}
+
+// Handler for GET /templates/{name} call, returns latest version unless ?version= is given
+func gettemplatehandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	version, err := templateVersion(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+
+	tmpl, err := getTemplate(ctx, name, version)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No template found with name "+name)
+		return
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching template")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tmpl)
+}
+
+// Handler for DELETE /templates/{name} call, removes all versions unless ?version= is given
+func deltemplatehandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	version, err := templateVersion(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, err.Error())
+		return
+	}
+	if _, ok := loadTemplate(w, r, accessDelete); !ok {
+		return
+	}
+
+	deleteResult, err := db.DeleteTestBedTemplate(ctx, name, version)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while deleting template")
+		return
+	}
+	if deleteResult.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No template found with name "+name)
+		return
+	}
+
+	logging.Info.Println("Deleted ", deleteResult.DeletedCount, " version(s) of template ", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// templateVersion parses the optional ?version= query parameter, 0 meaning latest
+func templateVersion(query url.Values) (int, error) {
+	v := query.Get("version")
+	if v == "" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, errTemplateRequest(fmt.Sprintf("Invalid template version %q", v))
+	}
+	return version, nil
+}
+
+/*
+  postRequestFromTemplate builds a createenv request from the template named in ?template=.
+
+  Variables are given as ?vars=key1=value1,key2=value2 (the parameter may be repeated) and
+  override the defaults stored with the template. Every ${var} referenced by the template must resolve.
+  The request carries the seed steps, volumes, resource limits, time to live and priority of the template,
+  it is validated like any create request.
+*/
+func postRequestFromTemplate(query url.Values) (postRequestBody, db.TestBedTemplate, error) {
+	post := postRequestBody{}
+
+	version, err := templateVersion(query)
+	if err != nil {
+		return post, db.TestBedTemplate{}, err
+	}
+	tmpl, err := db.GetTestBedTemplate(ctx, query.Get("template"), version)
+	if err != nil {
+		return post, tmpl, err
+	}
+
+	values := make(map[string]string)
+	for k, v := range tmpl.Vars {
+		values[k] = v
+	}
+	for _, param := range query["vars"] {
+		for _, pair := range strings.Split(param, ",") {
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return post, tmpl, errTemplateRequest(fmt.Sprintf("Invalid template variable %q, expected key=value", pair))
+			}
+			values[kv[0]] = kv[1]
+		}
+	}
+
+	missing := make(map[string]bool)
+	expand := func(s string) string {
+		return os.Expand(s, func(key string) string {
+			v, ok := values[key]
+			if !ok {
+				missing[key] = true
+			}
+			return v
+		})
+	}
+
+	post.Name = expand(tmpl.TestBedName)
+	for _, cnt := range tmpl.Containers {
+		post.Containers = append(post.Containers, expand(cnt))
+	}
+	for cnt, steps := range tmpl.Seed {
+		if post.Seed == nil {
+			post.Seed = make(map[string][]db.SeedStep)
+		}
+		post.Seed[expand(cnt)] = steps
+	}
+	for cnt, volumes := range tmpl.Volumes {
+		if post.Volumes == nil {
+			post.Volumes = make(map[string][]db.VolumeSpec)
+		}
+		post.Volumes[expand(cnt)] = volumes
+	}
+	for cnt, res := range tmpl.Resources {
+		if post.Resources == nil {
+			post.Resources = make(map[string]*db.Resources)
+		}
+		post.Resources[expand(cnt)] = res
+	}
+	post.TTLSeconds = tmpl.TTLSeconds
+	post.Priority = tmpl.Priority
+
+	if len(missing) > 0 {
+		var names []string
+		for k := range missing {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		return post, tmpl, errTemplateRequest("Missing values for template variables: " + strings.Join(names, ", "))
+	}
+	return post, tmpl, nil
+}
@@ -0,0 +1,394 @@
+/*
+ * testbeds.go contains the /api/v1 handlers for testbeds and their containers.
+ * Supports
+ *     List testbeds with filters, sorting and cursor pagination
+ *     Get a testbed
+ *     Delete a testbed (removes its containers and deallocates ports)
+ *     Get and delete a single container of a testbed
+ *     List every container on the host
+ *
+ * Stop, pause, start and restart of testbeds and containers are in lifecycle.go.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/logging"
+)
+
+//testbedActionResp is the response for operations spanning all containers of a testbed
+type testbedActionResp struct {
+	ID         string            `json:"id"`
+	Status     string            `json:"status"`
+	Containers []containerResult `json:"containers"`
+}
+
+//containerDetail is a stored container enriched with its live docker state
+type containerDetail struct {
+	db.ContainerProp
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+//hostContainer is an entry of the host wide container listing
+type hostContainer struct {
+	ID     string   `json:"id"`
+	Names  []string `json:"names"`
+	Image  string   `json:"image"`
+	State  string   `json:"state"`
+	Status string   `json:"status"`
+}
+
+// Page sizes of the testbed listing
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// sortFields maps the sort parameter of the listing to testbed fields
+var sortFields = map[string]string{
+	"created": "_cts",
+	"name":    "name",
+	"status":  "status",
+}
+
+//testbedPage is a page of the testbed listing
+type testbedPage struct {
+	Items      []db.TestBed `json:"items"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+//pageCursor points after the last testbed of a page, it is handed to clients base64 encoded
+type pageCursor struct {
+	Sort  string      `json:"s"`
+	Value interface{} `json:"v"`
+	ID    string      `json:"id"`
+}
+
+/*
+  Handler for GET /api/v1/testbeds
+
+  Lists testbed records from the store. Supported query parameters:
+      status=Completed,Failed         one or more statuses
+      name_prefix=payments
+      owner=ci
+      label=team=payments (repeatable, label=key matches any value)
+      created_after / created_before  RFC3339 time or unix seconds
+      sort=created|name|status        prefixed with - for descending, default -created
+      limit=50                        at most 500
+      cursor=...                      next_cursor of the previous page
+*/
+func listtestbedshandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q, errs := testbedQuery(query)
+	if len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid testbed query", errs...)
+		return
+	}
+
+	q.Visible = visibleTo(r)
+
+	// One extra testbed tells whether there is a next page
+	limit := q.Limit
+	q.Limit++
+	testbeds, err := db.ListTestBeds(ctx, q)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not list testbeds")
+		return
+	}
+
+	page := testbedPage{Items: testbeds}
+	if len(testbeds) > limit {
+		page.Items = testbeds[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeCursor(query.Get("sort"), q.SortField, last)
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// testbedQuery builds the store query from the listing parameters
+func testbedQuery(query url.Values) (db.TestBedQuery, []fieldError) {
+	var errs []fieldError
+	q := db.TestBedQuery{
+		NamePrefix: query.Get("name_prefix"),
+		Owner:      query.Get("owner"),
+		Limit:      defaultPageSize,
+		SortField:  "_cts",
+		Descending: true,
+	}
+
+	for _, status := range query["status"] {
+		for _, s := range strings.Split(status, ",") {
+			if s != "" {
+				q.Status = append(q.Status, s)
+			}
+		}
+	}
+
+	for _, label := range query["label"] {
+		kv := strings.SplitN(label, "=", 2)
+		if !labelKeyRegexp.MatchString(kv[0]) {
+			errs = append(errs, fieldError{Field: "label", Message: "label key must match " + labelKeyRegexp.String()})
+			continue
+		}
+		if q.Labels == nil {
+			q.Labels = make(map[string]string)
+		}
+		if len(kv) == 2 {
+			q.Labels[kv[0]] = kv[1]
+		} else {
+			q.Labels[kv[0]] = ""
+		}
+	}
+
+	for field, target := range map[string]*int{"created_after": &q.CreatedAfter, "created_before": &q.CreatedBefore} {
+		if v := query.Get(field); v != "" {
+			ts, err := parseTimeParam(v)
+			if err != nil {
+				errs = append(errs, fieldError{Field: field, Message: "must be an RFC3339 time or unix seconds"})
+			}
+			*target = ts
+		}
+	}
+
+	sortParam := query.Get("sort")
+	if sortParam != "" {
+		q.Descending = strings.HasPrefix(sortParam, "-")
+		field, ok := sortFields[strings.TrimPrefix(sortParam, "-")]
+		if !ok {
+			errs = append(errs, fieldError{Field: "sort", Message: "must be one of created, name, status, optionally prefixed with -"})
+		}
+		q.SortField = field
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			errs = append(errs, fieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %v", maxPageSize)})
+		}
+		q.Limit = limit
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil || c.Sort != sortParam {
+			errs = append(errs, fieldError{Field: "cursor", Message: "is not a cursor of this listing and sort order"})
+		} else {
+			q.AfterValue = c.Value
+			q.AfterID = c.ID
+		}
+	}
+	return q, errs
+}
+
+// parseTimeParam parses an RFC3339 time or unix seconds into unix seconds
+func parseTimeParam(v string) (int, error) {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return secs, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return 0, err
+	}
+	return int(t.Unix()), nil
+}
+
+// encodeCursor returns the cursor of the page following testbed tb
+func encodeCursor(sortParam, sortField string, tb db.TestBed) string {
+	c := pageCursor{Sort: sortParam, ID: tb.ID}
+	switch sortField {
+	case "name":
+		c.Value = tb.Name
+	case "status":
+		c.Value = tb.Status
+	default:
+		c.Value = tb.CTS
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor handed out by encodeCursor
+func decodeCursor(v string) (pageCursor, error) {
+	c := pageCursor{}
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, err
+	}
+	// JSON numbers decode as float64, creation times are stored as integers
+	if f, ok := c.Value.(float64); ok {
+		c.Value = int(f)
+	}
+	if c.ID == "" {
+		return c, fmt.Errorf("cursor without id")
+	}
+	return c, nil
+}
+
+// Handler for GET /api/v1/testbeds/{id}
+func gettestbedhandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if wait := query.Get("wait"); wait != "" {
+		if wait != "ready" {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid wait condition",
+				fieldError{Field: "wait", Message: "must be ready"})
+			return
+		}
+		timeout, err := waitTimeout(query.Get("timeout"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid wait timeout",
+				fieldError{Field: "timeout", Message: err.Error()})
+			return
+		}
+		waitForTestBed(w, r, timeout)
+		return
+	}
+
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+	if tb.Status == db.StatusQueued {
+		setQueuePosition(&tb)
+	}
+	writeJSON(w, http.StatusOK, tb)
+}
+
+// Handler for DELETE /api/v1/testbeds/{id}, stops and removes every container and deallocates their ports
+func deletetestbedhandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessDelete)
+	if !ok {
+		return
+	}
+
+	var results []containerResult
+	var failed []fieldError
+	for _, cnt := range tb.Container {
+		res := removeContainer(tb.ID, cnt)
+		results = append(results, res)
+		if !res.OK {
+			failed = append(failed, fieldError{Field: cnt.Image, Message: res.Error})
+		}
+	}
+
+	if len(failed) > 0 {
+		writeError(w, http.StatusInternalServerError, errCodeDocker, "Could not remove every container of testbed "+tb.ID, failed...)
+		return
+	}
+
+	if err := setTestBedStatus(tb.ID, db.StatusDeleted, ""); err != nil {
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Containers removed but testbed status could not be updated")
+		return
+	}
+	writeJSON(w, http.StatusOK, testbedActionResp{ID: tb.ID, Status: db.StatusDeleted, Containers: results})
+}
+
+// Handler for GET /api/v1/testbeds/{id}/containers/{name}
+func gettestbedcontainerhandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessRead)
+	if !ok {
+		return
+	}
+	cnt, ok := loadContainer(w, r, tb)
+	if !ok {
+		return
+	}
+
+	detail := containerDetail{ContainerProp: cnt, Name: containerName(tb.ID, cnt.Image)}
+	detail.State = containerState(detail.Name)
+	writeJSON(w, http.StatusOK, detail)
+}
+
+// Handler for DELETE /api/v1/testbeds/{id}/containers/{name}, removes the container from docker and the testbed
+func deletecontainerhandler(w http.ResponseWriter, r *http.Request) {
+	tb, ok := loadTestBed(w, r, accessDelete)
+	if !ok {
+		return
+	}
+	cnt, ok := loadContainer(w, r, tb)
+	if !ok {
+		return
+	}
+
+	res := removeContainer(tb.ID, cnt)
+	if !res.OK {
+		writeError(w, http.StatusInternalServerError, errCodeDocker, res.Error)
+		return
+	}
+	if _, err := db.RemoveContainerFromTestBed(ctx, tb.ID, cnt.Image); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Container removed but testbed could not be updated")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/containers, lists every container on the host
+func hostcontainershandler(w http.ResponseWriter, r *http.Request) {
+	containers := []hostContainer{}
+	for _, container := range dockercontainer.ListContainers(ctx) {
+		containers = append(containers, hostContainer{
+			ID:     container.ID,
+			Names:  container.Names,
+			Image:  container.Image,
+			State:  container.State,
+			Status: container.Status,
+		})
+	}
+	writeJSON(w, http.StatusOK, containers)
+}
+
+// removeContainer stops and removes a testbed container and its replicas, deallocates their service ports
+// and removes their named volumes unless they are retained
+func removeContainer(testbedID string, cnt db.ContainerProp) containerResult {
+	name := containerName(testbedID, cnt.Image)
+	res := containerResult{Name: cnt.Image, OK: true}
+
+	for _, replica := range cnt.Replicas {
+		if err := removeReplica(testbedID, cnt, replica); err != nil {
+			res.OK = false
+			res.Error = err.Error()
+			return res
+		}
+	}
+
+	// Stop errors are not fatal here, the removal decides the outcome
+	dockercontainer.StopContainer(ctx, name)
+	if err := dockercontainer.RemoveContainer(ctx, name); err != nil && !dockercontainer.IsNotFound(err) {
+		logging.Error.Println("Error shown is : ", err.Error())
+		res.OK = false
+		res.Error = err.Error()
+		return res
+	}
+	clearFault(name)
+
+	if cnt.SvcPort != 0 {
+		if err := db.DeletePortFromMeta(ctx, cnt.SvcPort); err != nil {
+			logging.Error.Println(err)
+		}
+	}
+
+	if failed := removeVolumes(testbedID, cnt, 1); len(failed) > 0 {
+		res.OK = false
+		res.Error = "container removed but not its volumes " + strings.Join(failed, ", ")
+	}
+	return res
+}
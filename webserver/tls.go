@@ -0,0 +1,177 @@
+/*
+ * tls.go serves the API over TLS, optionally authenticating callers by client certificate.
+ *
+ * TLS is enabled by the settings (see config.go)
+ *     tls.cert       PEM certificate chain of the server
+ *     tls.key        PEM private key of the server
+ *     tls.client_ca  PEM bundle of the CAs issuing client certificates, optional
+ * The files are checked for changes at most every tlsReloadInterval while handshakes happen, so rotated
+ * certificates are picked up without a restart. Files which cannot be loaded keep the previous ones.
+ *
+ * With a client CA, clients may present a certificate. Its subject, as in "CN=ci-runner,O=Payments",
+ * is mapped to a principal by the client_certs of the auth config (see auth.go):
+ *     {"client_certs": [{"subject": "CN=ci-runner,O=Payments", "principal": "ci"}]}
+ * Clients without a certificate authenticate with a token or a signature instead.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"webserver/logging"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes
+const tlsReloadInterval = 10 * time.Second
+
+//authClientCert maps the subject of a client certificate to a principal
+type authClientCert struct {
+	Subject   string `json:"subject"`
+	Principal string `json:"principal"`
+}
+
+//clientCertAuthenticator accepts requests over TLS with a verified client certificate of a known subject
+type clientCertAuthenticator struct {
+	subjects map[string]string // subject to principal
+}
+
+func (a clientCertAuthenticator) authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", errNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.String()
+	name, ok := a.subjects[subject]
+	if !ok {
+		return "", errors.New("Unknown client certificate subject " + subject)
+	}
+	return name, nil
+}
+
+// certReloader holds the server certificate and client CAs, reloading them when their files change
+type certReloader struct {
+	certFile, keyFile, caFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+	checked  time.Time
+}
+
+// load reads the certificate files
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %v", err)
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		data, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return fmt.Errorf("could not load client CA: %v", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("client CA %v holds no PEM certificate", c.caFile)
+		}
+	}
+	c.cert, c.clientCA = &cert, pool
+	return nil
+}
+
+// modified returns the modification times of the certificate files, and whether they differ from the loaded ones
+func (c *certReloader) modified() (map[string]time.Time, bool) {
+	modTimes := make(map[string]time.Time)
+	changed := false
+	for _, file := range []string{c.certFile, c.keyFile, c.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			logging.Error.Println("Could not check TLS file ", file, ": ", err)
+			return c.modTimes, false
+		}
+		modTimes[file] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(c.modTimes[file])
+	}
+	return modTimes, changed
+}
+
+// current returns the certificate and client CAs, reloaded when their files changed
+func (c *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= tlsReloadInterval {
+		c.checked = time.Now()
+		if modTimes, changed := c.modified(); changed {
+			if err := c.load(); err != nil {
+				logging.Error.Println(err, ", keeping the previous certificate")
+			} else {
+				logging.Info.Println("Reloaded TLS certificate ", c.certFile)
+				c.modTimes = modTimes
+			}
+		}
+	}
+	return c.cert, c.clientCA
+}
+
+// configForClient returns the TLS config of a handshake with the current certificate and client CAs
+func (c *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cert, pool := c.current()
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if pool != nil {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// initTLS returns the TLS config of the certificate files, nil when the API is served without TLS
+func initTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+
+	usesClientCerts := false
+	for _, a := range authenticators {
+		_, ok := a.(clientCertAuthenticator)
+		usesClientCerts = usesClientCerts || ok
+	}
+	if usesClientCerts && reloader.caFile == "" {
+		return nil, errors.New("client_certs of the auth config need tls.client_ca")
+	}
+	if certFile == "" {
+		return nil, nil
+	}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	reloader.modTimes, _ = reloader.modified()
+	reloader.checked = time.Now()
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: reloader.configForClient,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := reloader.current()
+			return cert, nil
+		},
+	}, nil
+}
@@ -8,11 +8,15 @@
 package util
 
 import (
+	"archive/tar"
+	"bytes"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"math/rand"
 	"net"
 	"os"
+	"time"
 	"webserver/logging"
 )
 
@@ -78,6 +82,42 @@ func ConvertIntSlicetoStringBoolMap(slice []int) map[string]bool {
 	return dict
 }
 
+// TarFile returns a tar archive holding a single file, as expected by the docker copy API
+func TarFile(name string, data []byte, mode int64) ([]byte, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// TarStream returns a tar archive holding a single file name of size bytes read from content, the archive
+// is written as it is read so that the file is not kept in memory. Reading fails when content is shorter.
+func TarStream(name string, size int64, mode int64, content io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		hdr := &tar.Header{Name: name, Mode: mode, Size: size, ModTime: time.Now()}
+		err := tw.WriteHeader(hdr)
+		if err == nil {
+			_, err = io.CopyN(tw, content, size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
 // GetFreePort returns on free TCP port available on system
 func GetFreePort() (int, error) {
         ln, err := net.Listen("tcp", ":0")
@@ -0,0 +1,212 @@
+/*
+ * volumes.go declares the storage of testbed services.
+ *
+ * createenv accepts mounts per service:
+ *     "volumes": {"mongo": [{"type": "volume", "name": "data", "target": "/data/db", "retain": true},
+ *                           {"type": "tmpfs", "target": "/tmp", "size_mb": 256}],
+ *                 "redis": [{"type": "bind", "source": "/srv/fixtures/redis", "target": "/fixtures"}]}
+ *
+ * Named volumes are created as <testbed id>-<service>-<name> carrying the testbed ownership labels,
+ * with the replica number appended for additional instances of the service (see scale.go),
+ * they survive container restarts and are removed on teardown unless retain is set. Binds are always
+ * read-only and only allowed below the host directories listed in PROVISIONER_BIND_ALLOWLIST
+ * (colon separated), without it binds are rejected. The source of a bind is resolved when the request is
+ * validated and that path is mounted. It is checked again whenever a container is created, so that a
+ * symlink changed meanwhile cannot get another host path mounted.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/mount"
+	"webserver/db"
+	"webserver/dockercontainer"
+	"webserver/logging"
+)
+
+// Labels marking the containers and volumes owned by a testbed
+const (
+	labelTestBed = "infra-provisioner.testbed"
+	labelService = "infra-provisioner.service"
+)
+
+// maxVolumesPerService limits the mounts declared for one service
+const maxVolumesPerService = 16
+
+var (
+	// Host directories below which binds are allowed, set from the config (see config.go)
+	bindAllowlist []string
+
+	volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,62}$`)
+)
+
+// validateVolumes returns the field level errors of the volumes of a createenv request,
+// it records the resolved source of every valid bind in the specs of the request
+func validateVolumes(post postRequestBody) []fieldError {
+	var errs []fieldError
+
+	for _, svc := range volumeServices(post.Volumes) {
+		specs := post.Volumes[svc]
+		found := false
+		for _, cnt := range post.Containers {
+			found = found || cnt == svc
+		}
+		if !found {
+			errs = append(errs, fieldError{Field: "volumes." + svc, Message: "service is not part of the testbed"})
+			continue
+		}
+		if len(specs) > maxVolumesPerService {
+			errs = append(errs, fieldError{Field: "volumes." + svc, Message: fmt.Sprintf("must declare at most %v volumes", maxVolumesPerService)})
+			continue
+		}
+
+		targets := make(map[string]bool)
+		names := make(map[string]bool)
+		for i, spec := range specs {
+			field := fmt.Sprintf("volumes.%v[%d]", svc, i)
+			if !path.IsAbs(spec.Target) || path.Clean(spec.Target) == "/" {
+				errs = append(errs, fieldError{Field: field + ".target", Message: "must be an absolute path other than /"})
+			} else if targets[path.Clean(spec.Target)] {
+				errs = append(errs, fieldError{Field: field + ".target", Message: "is mounted more than once"})
+			}
+			targets[path.Clean(spec.Target)] = true
+
+			switch spec.Type {
+			case db.VolumeNamed:
+				if !volumeNameRegexp.MatchString(spec.Name) {
+					errs = append(errs, fieldError{Field: field + ".name", Message: "must match " + volumeNameRegexp.String()})
+				} else if names[spec.Name] {
+					errs = append(errs, fieldError{Field: field + ".name", Message: "is declared more than once"})
+				}
+				names[spec.Name] = true
+			case db.VolumeTmpfs:
+				if spec.SizeMB < 0 {
+					errs = append(errs, fieldError{Field: field + ".size_mb", Message: "must not be negative"})
+				}
+			case db.VolumeBind:
+				resolved, msg := resolveBindSource(spec.Source)
+				if msg != "" {
+					errs = append(errs, fieldError{Field: field + ".source", Message: msg})
+				}
+				specs[i].Resolved = resolved
+			default:
+				errs = append(errs, fieldError{Field: field + ".type", Message: "must be one of volume, tmpfs or bind"})
+			}
+			if spec.Retain && spec.Type != db.VolumeNamed {
+				errs = append(errs, fieldError{Field: field + ".retain", Message: "only applies to named volumes"})
+			}
+		}
+	}
+	return errs
+}
+
+// resolveBindSource returns a host path with its symlinks resolved, and why it may not be bound or an
+// empty string if it may
+func resolveBindSource(source string) (string, string) {
+	if !filepath.IsAbs(source) {
+		return "", "must be an absolute host path"
+	}
+	// Symlinks are resolved so that they cannot point out of the allowlisted directories
+	resolved, err := filepath.EvalSymlinks(source)
+	if err != nil {
+		return "", "does not exist on the host"
+	}
+	for _, root := range bindAllowlist {
+		if root == "" {
+			continue
+		}
+		root, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		if resolved == root || strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return resolved, ""
+		}
+	}
+	return "", "is not below an allowlisted host directory"
+}
+
+// volumeServices returns the services of a volumes map in a stable order
+func volumeServices(volumes map[string][]db.VolumeSpec) []string {
+	services := make([]string, 0, len(volumes))
+	for svc := range volumes {
+		services = append(services, svc)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// volumeName returns the host name of a named volume of a testbed service
+func volumeName(testbedID, image, name string) string {
+	return testbedID + "-" + image + "-" + name
+}
+
+// ownershipLabels returns the labels of the containers and volumes of a testbed service
+func ownershipLabels(testbedID, image string) map[string]string {
+	return map[string]string{labelTestBed: testbedID, labelService: image}
+}
+
+// containerMounts converts the volumes of a testbed service into the docker mounts of one of its instances.
+// Binds mount the source resolved at validation, it fails when that path is no longer allowed or resolves
+// elsewhere now.
+func containerMounts(testbedID string, cnt db.ContainerProp, replica int) ([]mount.Mount, error) {
+	var mounts []mount.Mount
+	for _, spec := range cnt.Volumes {
+		m := mount.Mount{Target: spec.Target}
+		switch spec.Type {
+		case db.VolumeNamed:
+			// Docker creates the volume with these labels when the container is created
+			m.Type = mount.TypeVolume
+			m.Source = volumeName(testbedID, cnt.Image, spec.Name) + replicaSuffix(replica)
+			m.VolumeOptions = &mount.VolumeOptions{Labels: ownershipLabels(testbedID, cnt.Image)}
+		case db.VolumeTmpfs:
+			m.Type = mount.TypeTmpfs
+			m.TmpfsOptions = &mount.TmpfsOptions{SizeBytes: spec.SizeMB << 20}
+		case db.VolumeBind:
+			// Testbeds recorded before sources were resolved mount the source resolved now
+			source := spec.Resolved
+			if source == "" {
+				source = spec.Source
+			}
+			resolved, msg := resolveBindSource(source)
+			if msg != "" {
+				return nil, fmt.Errorf("bind source %v %v", spec.Source, msg)
+			}
+			if spec.Resolved != "" && resolved != spec.Resolved {
+				return nil, fmt.Errorf("bind source %v resolves to %v since it was validated", spec.Source, resolved)
+			}
+			m.Type = mount.TypeBind
+			m.Source = resolved
+			m.ReadOnly = true
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, nil
+}
+
+// removeVolumes removes the named volumes of an instance of a testbed service which are not retained,
+// it returns the names of the volumes which could not be removed
+func removeVolumes(testbedID string, cnt db.ContainerProp, replica int) []string {
+	var failed []string
+	for _, spec := range cnt.Volumes {
+		if spec.Type != db.VolumeNamed || spec.Retain {
+			continue
+		}
+		name := volumeName(testbedID, cnt.Image, spec.Name) + replicaSuffix(replica)
+		if err := dockercontainer.RemoveVolume(ctx, name); err != nil && !dockercontainer.IsNotFound(err) {
+			logging.Error.Println(err)
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
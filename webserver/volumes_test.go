@@ -0,0 +1,82 @@
+/*
+ * volumes_test.go checks that binds mount the source resolved at validation.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"webserver/db"
+)
+
+func TestBindMountsResolvedSource(t *testing.T) {
+	root, err := ioutil.TempDir("", "bind-allowlist-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "bind-outside-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	allowed := filepath.Join(root, "fixtures")
+	if err := os.Mkdir(allowed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(root, "current")
+	if err := os.Symlink(allowed, link); err != nil {
+		t.Fatal(err)
+	}
+	saved := bindAllowlist
+	bindAllowlist = []string{root}
+	defer func() { bindAllowlist = saved }()
+
+	post := postRequestBody{
+		Containers: []string{"redis"},
+		Volumes:    map[string][]db.VolumeSpec{"redis": {{Type: db.VolumeBind, Source: link, Target: "/fixtures"}}},
+	}
+	if errs := validateVolumes(post); len(errs) > 0 {
+		t.Fatalf("validation failed: %v", errs)
+	}
+	cnt := db.ContainerProp{Image: "redis", Volumes: post.Volumes["redis"]}
+	resolved, _ := filepath.EvalSymlinks(allowed)
+
+	mounts, err := containerMounts("tb", cnt, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounts[0].Source != resolved {
+		t.Errorf("mounted %v, want the resolved source %v", mounts[0].Source, resolved)
+	}
+
+	// The symlink now points out of the allowlist, the recorded path is mounted
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, link); err != nil {
+		t.Fatal(err)
+	}
+	if mounts, err := containerMounts("tb", cnt, 2); err != nil || mounts[0].Source != resolved {
+		t.Errorf("after the symlink changed: mounted %v, %v", mounts, err)
+	}
+
+	// The recorded path is replaced by a symlink out of the allowlist
+	if err := os.Remove(allowed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, allowed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := containerMounts("tb", cnt, 1); err == nil {
+		t.Error("a source resolving out of the allowlist was mounted")
+	}
+}
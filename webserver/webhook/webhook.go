@@ -0,0 +1,296 @@
+/*
+ * webhook.go delivers testbed lifecycle events to webhook subscriptions.
+ *
+ * Run reads the testbed.status events of every testbed from the testbedevent collection, in the order
+ * of their sequence numbers and from a cursor stored in the webhookcursor collection, so that no event
+ * is missed while the server is busy or stopped. When a testbed becomes ready, fails, expires or is
+ * deleted, each matching webhook receives a JSON POST signed with its secret:
+ *     X-Webhook-Event:      testbed.ready
+ *     X-Webhook-Delivery:   delivery id, also found in the delivery log
+ *     X-Webhook-Timestamp:  unix seconds
+ *     X-Webhook-Signature:  sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret>
+ *
+ * Any response other than 2xx is retried after retryDelays, every attempt is recorded in the
+ * webhookdelivery collection. Deliveries still pending when the server stops are resumed by Run, and
+ * an event dispatched again after a restart is not delivered twice to the same webhook.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"webserver/db"
+	"webserver/events"
+	"webserver/logging"
+)
+
+// Webhook event types
+const (
+	TestBedReady   = "testbed.ready"
+	TestBedFailed  = "testbed.failed"
+	TestBedExpired = "testbed.expired"
+	TestBedDeleted = "testbed.deleted"
+)
+
+//Events lists the events a webhook can subscribe to
+var Events = []string{TestBedReady, TestBedFailed, TestBedExpired, TestBedDeleted}
+
+// statusEvents maps the testbed status transitions to the webhook event they trigger
+var statusEvents = map[string]string{
+	db.StatusCompleted: TestBedReady,
+	db.StatusFailed:    TestBedFailed,
+	db.StatusExpired:   TestBedExpired,
+	db.StatusDeleted:   TestBedDeleted,
+}
+
+// pollInterval is how often the stored events are checked for new ones
+const pollInterval = time.Second
+
+// settleDelay is how old an event is before it is dispatched. Events get their sequence number before
+// they are stored, a concurrent publisher may store a lower number shortly after a higher one.
+const settleDelay = 5 * time.Second
+
+// eventBatch limits the events read at once
+const eventBatch = 100
+
+// retryDelays are the waits before each retry of a failed delivery
+var retryDelays = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+//Payload is the JSON body POSTed to a webhook
+type Payload struct {
+	DeliveryID string     `json:"delivery_id"`
+	Event      string     `json:"event"`
+	Time       time.Time  `json:"time"`
+	Message    string     `json:"message,omitempty"`
+	TestBed    db.TestBed `json:"testbed"`
+}
+
+//IsEvent reports whether name is an event a webhook can subscribe to
+func IsEvent(name string) bool {
+	for _, e := range Events {
+		if e == name {
+			return true
+		}
+	}
+	return false
+}
+
+//Sign returns the X-Webhook-Signature value of a payload sent at timestamp
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//Run delivers webhooks for testbed status transitions until ctx is done
+func Run(ctx context.Context) {
+	resumePending(ctx)
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	cursor, loaded := int64(0), false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !loaded {
+			if cursor, loaded = loadCursor(ctx); !loaded {
+				continue
+			}
+		}
+		cursor = dispatchStored(ctx, cursor)
+	}
+}
+
+// loadCursor returns the stored cursor. Without one, webhooks start with the events from now on.
+func loadCursor(ctx context.Context) (int64, bool) {
+	cursor, err := db.GetWebhookCursor(ctx)
+	if err == db.ErrNoMatchDocument {
+		cursor = time.Now().UnixNano()
+		err = db.SetWebhookCursor(ctx, cursor)
+	}
+	if err != nil {
+		logging.Error.Println("Could not load the webhook cursor: ", err)
+		return 0, false
+	}
+	return cursor, true
+}
+
+// dispatchStored dispatches the settled events after cursor in order, and returns the new cursor.
+// It stops at an event which could not be dispatched, to try it again on the next poll.
+func dispatchStored(ctx context.Context, cursor int64) int64 {
+	statuses := make([]string, 0, len(statusEvents))
+	for status := range statusEvents {
+		statuses = append(statuses, status)
+	}
+	start := cursor
+	defer func() {
+		if cursor == start {
+			return
+		}
+		if err := db.SetWebhookCursor(ctx, cursor); err != nil {
+			logging.Error.Println("Could not store the webhook cursor: ", err)
+		}
+	}()
+
+	for {
+		stored, err := db.ListEvents(ctx, db.EventQuery{Type: events.StatusChanged, Status: statuses, AfterSeq: cursor,
+			UntilSeq: time.Now().Add(-settleDelay).UnixNano(), Limit: eventBatch})
+		if err != nil {
+			logging.Error.Println("Could not read testbed events for webhooks: ", err)
+			return cursor
+		}
+		for _, event := range stored {
+			if err := dispatch(ctx, statusEvents[event.Status], event); err != nil {
+				logging.Error.Println("Could not dispatch event ", event.Seq, " to webhooks, retrying: ", err)
+				return cursor
+			}
+			cursor = event.Seq
+		}
+		if len(stored) < eventBatch {
+			return cursor
+		}
+	}
+}
+
+// dispatch records a delivery of the event for every subscribed webhook and starts delivering them.
+// Webhooks which already have a delivery of the event are skipped.
+func dispatch(ctx context.Context, name string, event db.TestBedEvent) error {
+	hooks, err := db.ListWebhooks(ctx, name)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	tb, err := db.GetTestBedFromID(ctx, event.TestBedID)
+	if err == db.ErrNoMatchDocument {
+		logging.Warning.Println("Testbed ", event.TestBedID, " of event ", event.Seq, " no longer exists, no webhook is sent")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		delivery := db.NewWebhookDelivery(hook.ID, name, tb.ID, "")
+		delivery.EventSeq = event.Seq
+		payload, err := json.Marshal(Payload{DeliveryID: delivery.ID, Event: name, Time: event.Time, Message: event.Message, TestBed: tb})
+		if err != nil {
+			logging.Error.Println(err)
+			continue
+		}
+		delivery.Payload = string(payload)
+
+		err = db.InsertWebhookDelivery(ctx, delivery)
+		if err == db.ErrDocumentExists {
+			continue
+		} else if err != nil {
+			return err
+		}
+		go deliver(ctx, hook, delivery)
+	}
+	return nil
+}
+
+// resumePending continues the deliveries which were interrupted by a restart
+func resumePending(ctx context.Context) {
+	deliveries, err := db.GetPendingWebhookDeliveries(ctx)
+	if err != nil {
+		logging.Error.Println("Could not load pending webhook deliveries: ", err)
+		return
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		hook, err := db.GetWebhookFromID(ctx, delivery.WebhookID)
+		if err != nil {
+			delivery.Status = db.DeliveryFailed
+			delivery.Error = "webhook no longer exists"
+			db.UpdateWebhookDelivery(ctx, delivery)
+			continue
+		}
+		logging.Info.Println("Resuming delivery ", delivery.ID, " to webhook ", hook.ID)
+		go deliver(ctx, hook, delivery)
+	}
+}
+
+// deliver POSTs a delivery until it succeeds or the retries are exhausted
+func deliver(ctx context.Context, hook db.Webhook, delivery *db.WebhookDelivery) {
+	for {
+		delivery.Attempts++
+		delivery.LastAttempt = time.Now().UTC()
+		delivery.ResponseCode, delivery.Error = post(ctx, hook, delivery)
+
+		switch {
+		case delivery.Error == "":
+			delivery.Status = db.DeliveryDelivered
+		case delivery.Attempts > len(retryDelays):
+			delivery.Status = db.DeliveryFailed
+		}
+		if err := db.UpdateWebhookDelivery(ctx, delivery); err != nil {
+			logging.Error.Println("Could not record delivery attempt ", delivery.ID, ": ", err)
+		}
+		if delivery.Status != db.DeliveryPending {
+			logging.Info.Println("Delivery ", delivery.ID, " to webhook ", hook.ID, " ", delivery.Status, " after ", delivery.Attempts, " attempts")
+			return
+		}
+
+		logging.Warning.Println("Delivery ", delivery.ID, " to webhook ", hook.ID, " failed: ", delivery.Error)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelays[delivery.Attempts-1]):
+		}
+	}
+}
+
+// post sends one attempt of a delivery, returning the response code and the error of a failed attempt
+func post(ctx context.Context, hook db.Webhook, delivery *db.WebhookDelivery) (int, string) {
+	payload := []byte(delivery.Payload)
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set("User-Agent", "infra-provisioner-webhook/1.0")
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Delivery", delivery.ID)
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(hook.Secret, timestamp, payload))
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, "unexpected response " + resp.Status
+	}
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,169 @@
+/*
+ * webhooks.go contains the handlers for webhook subscriptions.
+ * Supports
+ *     Register a webhook (URL, event filter, secret)
+ *     List webhooks
+ *     Get a webhook
+ *     Delete a webhook
+ *     List the delivery log of a webhook
+ *
+ * Deliveries are made by the webhook package, see webhook/webhook.go for the signature scheme.
+ *
+ * API version: 1.0.0
+ * Contact: Arun K, Vibhore
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"webserver/db"
+	"webserver/logging"
+	"webserver/webhook"
+)
+
+// minWebhookSecretLength is the shortest secret accepted for signing deliveries
+const minWebhookSecretLength = 16
+
+//webhookRequestBody is the request struct for registering a webhook
+type webhookRequestBody struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// Handler for POST /api/v1/webhooks call
+func createwebhookhandler(w http.ResponseWriter, r *http.Request) {
+	body := webhookRequestBody{}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeBadRequest, "Invalid webhook body: "+err.Error())
+		return
+	}
+	if errs := validateWebhookRequest(body); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid webhook request", errs...)
+		return
+	}
+
+	hook := db.NewWebhook()
+	hook.URL = body.URL
+	hook.Events = body.Events
+	hook.Secret = body.Secret
+	if _, err := db.InsertWebhook(ctx, hook); err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusServiceUnavailable, errCodeStorage, "Could not store webhook")
+		return
+	}
+
+	logging.Info.Println("Registered webhook ", hook.ID, " for ", hook.URL)
+	w.Header().Set("location", "/api/v1/webhooks/"+hook.ID)
+	writeJSON(w, http.StatusCreated, hook)
+}
+
+// validateWebhookRequest returns the field level errors of a webhook registration
+func validateWebhookRequest(body webhookRequestBody) []fieldError {
+	var errs []fieldError
+
+	u, err := url.Parse(body.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	}
+	for i, event := range body.Events {
+		if !webhook.IsEvent(event) {
+			errs = append(errs, fieldError{Field: fmt.Sprintf("events[%d]", i), Message: "must be one of " + strings.Join(webhook.Events, ", ")})
+		}
+	}
+	if len(body.Secret) < minWebhookSecretLength {
+		errs = append(errs, fieldError{Field: "secret", Message: fmt.Sprintf("must be at least %v characters long", minWebhookSecretLength)})
+	}
+	return errs
+}
+
+// Handler for GET /api/v1/webhooks call
+func listwebhookshandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := db.ListWebhooks(ctx, "")
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing webhooks")
+		return
+	}
+	writeJSON(w, http.StatusOK, hooks)
+}
+
+// Handler for GET /api/v1/webhooks/{id} call
+func getwebhookhandler(w http.ResponseWriter, r *http.Request) {
+	hook, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, hook)
+}
+
+// Handler for DELETE /api/v1/webhooks/{id} call, the delivery log of the webhook is removed with it
+func deletewebhookhandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	deleteResult, err := db.DeleteWebhook(ctx, id)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while deleting webhook")
+		return
+	}
+	if deleteResult.DeletedCount == 0 {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No webhook found with id "+id)
+		return
+	}
+
+	logging.Info.Println("Deleted webhook ", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for GET /api/v1/webhooks/{id}/deliveries call, newest first, ?limit=50 at most 500
+func listwebhookdeliverieshandler(w http.ResponseWriter, r *http.Request) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, http.StatusBadRequest, errCodeValidation, "Invalid limit",
+				fieldError{Field: "limit", Message: fmt.Sprintf("must be an integer between 1 and %v", maxPageSize)})
+			return
+		}
+		limit = n
+	}
+
+	hook, ok := loadWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := db.ListWebhookDeliveries(ctx, hook.ID, limit)
+	if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while listing deliveries")
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveries)
+}
+
+// loadWebhook fetches the webhook named by the {id} route variable, writing the error response if it can't
+func loadWebhook(w http.ResponseWriter, r *http.Request) (db.Webhook, bool) {
+	id := mux.Vars(r)["id"]
+
+	hook, err := getWebhook(ctx, id)
+	if err == db.ErrNoMatchDocument {
+		writeError(w, http.StatusNotFound, errCodeNotFound, "No webhook found with id "+id)
+		return hook, false
+	} else if err != nil {
+		logging.Error.Println(err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "Error observed while fetching webhook "+id)
+		return hook, false
+	}
+	return hook, true
+}